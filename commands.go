@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/XiaoweiQian/macvlan-driver/drivers"
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/stringid"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+var flagFormat = cli.StringFlag{
+	Name:  "format, f",
+	Value: formatTable,
+	Usage: "output format, table or json",
+}
+
+// commands inspect the host and the local store without stopping the plugin
+var commands = []cli.Command{
+	{
+		Name:   "ls",
+		Usage:  "list the endpoints of the local store by network",
+		Flags:  []cli.Flag{flagFormat},
+		Action: listStore,
+	},
+	{
+		Name:  "doctor",
+		Usage: "check the host can run the plugin, exits non-zero on failure",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "parent, p",
+				Usage: "parent link to check, repeat for several networks",
+			},
+			cli.BoolFlag{
+				Name:  "promisc",
+				Usage: "verify the parents accept promiscuous mode by toggling it",
+			},
+		},
+		Action: doctor,
+	},
+	{
+		Name:      "inspect",
+		Usage:     "print the stored networks or endpoints matching the ids as json",
+		ArgsUsage: "ID [ID...]",
+		Action:    inspectStore,
+	},
+	{
+		Name:  "state",
+		Usage: "export or import the networks and endpoints of the local store",
+		Subcommands: []cli.Command{
+			{
+				Name:  "export",
+				Usage: "write the stored networks and endpoints as a json document",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "output, o",
+						Usage: "file to write, stdout by default",
+					},
+				},
+				Action: exportState,
+			},
+			{
+				Name:      "import",
+				Usage:     "add the networks and endpoints of an exported document to the local store",
+				ArgsUsage: "FILE|-",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print the changes and conflicts without writing the store",
+					},
+				},
+				Action: importState,
+			},
+		},
+	},
+	{
+		Name:      "capture",
+		Usage:     "write the frames of an endpoint as pcap, until interrupted or the count is reached",
+		ArgsUsage: "ENDPOINT|CONTAINER [EXPRESSION]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "pcap file to write, stdout by default",
+			},
+			cli.IntFlag{
+				Name:  "count, c",
+				Usage: "exit after capturing count frames",
+			},
+			cli.IntFlag{
+				Name:  "snaplen, s",
+				Usage: "bytes captured of each frame",
+				Value: drivers.DefaultSnaplen,
+			},
+		},
+		Action: capture,
+	},
+	{
+		Name:      "probe",
+		Usage:     "check layer by layer the endpoints reach their gateway, exits non-zero on failure",
+		ArgsUsage: "NETWORK|ENDPOINT|CONTAINER",
+		Flags: []cli.Flag{
+			flagFormat,
+			cli.IntFlag{
+				Name:  "count, c",
+				Usage: "echo requests sent to each gateway",
+				Value: 3,
+			},
+			cli.DurationFlag{
+				Name:  "timeout, t",
+				Usage: "wait for each reply",
+				Value: time.Second,
+			},
+		},
+		Action: probe,
+	},
+}
+
+// commandConfig resolves the config of a subcommand from the global flags
+func commandConfig(ctx *cli.Context) (*daemonConfig, error) {
+	global := ctx
+	for global.Parent() != nil {
+		global = global.Parent()
+	}
+
+	return resolveConfig(global.String("config"), flagsConfig(global))
+}
+
+func readStore(ctx *cli.Context) ([]*drivers.NetworkState, error) {
+	cfg, err := commandConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return drivers.ReadStoreState(cfg.driverOptions())
+}
+
+func listStore(ctx *cli.Context) error {
+	networks, err := readStore(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	switch ctx.String("format") {
+	case formatJSON:
+		return printJSON(os.Stdout, networks)
+	case formatTable:
+		printTable(os.Stdout, networks)
+		return nil
+	default:
+		return cli.NewExitError(fmt.Sprintf("unknown format %s, use table or json", ctx.String("format")), 1)
+	}
+}
+
+func printTable(w io.Writer, networks []*drivers.NetworkState) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tENDPOINT\tSRC NAME\tMAC\tIPV4\tIPV6\tHOST LINK")
+	for _, n := range networks {
+		for _, ep := range n.Endpoints {
+			link := "no"
+			if ep.LinkExists {
+				link = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", stringid.TruncateID(n.ID), stringid.TruncateID(ep.ID),
+				ep.SrcName, ep.MacAddress, ep.Address, ep.AddressIPv6, link)
+		}
+	}
+	tw.Flush()
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(b))
+
+	return nil
+}
+
+func inspectStore(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.NewExitError("inspect requires at least one network or endpoint id", 1)
+	}
+	networks, err := readStore(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var found []interface{}
+	var missing []string
+	for _, id := range ctx.Args() {
+		matches := matchState(networks, id)
+		if len(matches) == 0 {
+			missing = append(missing, id)
+		}
+		found = append(found, matches...)
+	}
+	if err := printJSON(os.Stdout, found); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if len(missing) > 0 {
+		return cli.NewExitError(fmt.Sprintf("no such network or endpoint: %s", strings.Join(missing, ", ")), 1)
+	}
+
+	return nil
+}
+
+// matchState returns the networks and endpoints whose id starts with id
+func matchState(networks []*drivers.NetworkState, id string) []interface{} {
+	var matches []interface{}
+	for _, n := range networks {
+		if strings.HasPrefix(n.ID, id) {
+			matches = append(matches, n)
+		}
+		for _, ep := range n.Endpoints {
+			if strings.HasPrefix(ep.ID, id) {
+				matches = append(matches, ep)
+			}
+		}
+	}
+
+	return matches
+}
+
+func doctor(ctx *cli.Context) error {
+	cfg, err := commandConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	results := drivers.Preflight(cfg.driverOptions(), ctx.StringSlice("parent"), ctx.Bool("promisc"))
+	printResults(os.Stdout, results)
+	if drivers.PreflightFailed(results) {
+		return cli.NewExitError("preflight failed", 1)
+	}
+
+	return nil
+}
+
+func printResults(w io.Writer, results []*drivers.CheckResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "[%s] %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Status != drivers.CheckPass && r.Hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", r.Hint)
+		}
+	}
+}
+
+func exportState(ctx *cli.Context) error {
+	cfg, err := commandConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	state, err := drivers.ExportState(cfg.driverOptions())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := io.Writer(os.Stdout)
+	if path := ctx.String("output"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := printJSON(w, state); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
+
+func importState(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("import requires the exported file, - for stdin", 1)
+	}
+	cfg, err := commandConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var b []byte
+	if path := ctx.Args().First(); path == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	state, err := drivers.DecodeState(b)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	var changes []*drivers.ImportChange
+	if ctx.Bool("dry-run") {
+		changes, err = drivers.PlanImport(cfg.driverOptions(), state)
+	} else {
+		changes, err = drivers.ImportState(cfg.driverOptions(), state)
+	}
+	for _, c := range changes {
+		fmt.Fprintln(os.Stdout, c)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if drivers.ImportConflicts(changes) {
+		return cli.NewExitError("the state conflicts with the local store", 1)
+	}
+
+	return nil
+}
+
+func capture(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return cli.NewExitError("capture requires an endpoint or container id", 1)
+	}
+	if ctx.Int("snaplen") <= 0 || ctx.Int("snaplen") > drivers.DefaultSnaplen {
+		return cli.NewExitError(fmt.Sprintf("snaplen must be between 1 and %d", drivers.DefaultSnaplen), 1)
+	}
+	networks, err := readStore(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	ep, sandboxKey, err := resolveEndpoint(networks, ctx.Args().First(), inspectContainer)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := io.Writer(os.Stdout)
+	if path := ctx.String("output"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+		w = f
+	}
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		close(stop)
+	}()
+	opts := drivers.CaptureOptions{
+		Filter:  strings.Join(ctx.Args().Tail(), " "),
+		Snaplen: uint32(ctx.Int("snaplen")),
+		Count:   ctx.Int("count"),
+		Stop:    stop,
+	}
+	if err := drivers.Capture(sandboxKey, ep.MacAddress, opts, w); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
+
+func inspectContainer(id string) (*docker.Container, error) {
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.InspectContainer(id)
+}
+
+// resolveEndpoint returns the stored endpoint whose id starts with id and its
+// sandbox, or else the endpoint of the container id
+func resolveEndpoint(networks []*drivers.NetworkState, id string, inspect func(string) (*docker.Container, error)) (*drivers.EndpointState, string, error) {
+	var eps []*drivers.EndpointState
+	for _, m := range matchState(networks, id) {
+		if ep, ok := m.(*drivers.EndpointState); ok {
+			eps = append(eps, ep)
+		}
+	}
+	switch {
+	case len(eps) > 1:
+		return nil, "", fmt.Errorf("endpoint id %s is ambiguous", id)
+	case len(eps) == 1:
+		if eps[0].SandboxKey == "" {
+			return nil, "", fmt.Errorf("endpoint %s is not joined to a sandbox", stringid.TruncateID(eps[0].ID))
+		}
+		return eps[0], eps[0].SandboxKey, nil
+	}
+
+	c, err := inspect(id)
+	if err != nil {
+		return nil, "", fmt.Errorf("no such endpoint or container %s: %v", id, err)
+	}
+	if c.NetworkSettings == nil || c.NetworkSettings.SandboxKey == "" {
+		return nil, "", fmt.Errorf("container %s has no sandbox, is it running?", id)
+	}
+	for _, n := range networks {
+		for _, ep := range n.Endpoints {
+			for _, cn := range c.NetworkSettings.Networks {
+				if cn.EndpointID == ep.ID {
+					eps = append(eps, ep)
+				}
+			}
+		}
+	}
+	switch len(eps) {
+	case 0:
+		return nil, "", fmt.Errorf("container %s has no endpoint of the plugin", id)
+	case 1:
+		return eps[0], c.NetworkSettings.SandboxKey, nil
+	}
+	var ids []string
+	for _, ep := range eps {
+		ids = append(ids, stringid.TruncateID(ep.ID))
+	}
+
+	return nil, "", fmt.Errorf("container %s has several endpoints, capture one of %s", id, strings.Join(ids, ", "))
+}
+
+// probeTarget is an endpoint to probe in a sandbox
+type probeTarget struct {
+	endpoint   *drivers.EndpointState
+	sandboxKey string
+}
+
+// resolveProbeTargets returns the endpoints in a sandbox of the network whose
+// id starts with id, or else the endpoint of resolveEndpoint
+func resolveProbeTargets(networks []*drivers.NetworkState, id string, inspect func(string) (*docker.Container, error)) ([]probeTarget, error) {
+	matches := matchState(networks, id)
+	if len(matches) == 1 {
+		if n, ok := matches[0].(*drivers.NetworkState); ok {
+			var targets []probeTarget
+			for _, ep := range n.Endpoints {
+				if ep.SandboxKey != "" {
+					targets = append(targets, probeTarget{ep, ep.SandboxKey})
+				}
+			}
+			if len(targets) == 0 {
+				return nil, fmt.Errorf("network %s has no endpoint joined to a sandbox", stringid.TruncateID(n.ID))
+			}
+			return targets, nil
+		}
+	}
+	ep, sandboxKey, err := resolveEndpoint(networks, id, inspect)
+	if err != nil {
+		return nil, err
+	}
+
+	return []probeTarget{{ep, sandboxKey}}, nil
+}
+
+func probe(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("probe requires a network, endpoint or container id", 1)
+	}
+	format := ctx.String("format")
+	if format != formatTable && format != formatJSON {
+		return cli.NewExitError(fmt.Sprintf("unknown format %s, use table or json", format), 1)
+	}
+	cfg, err := commandConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	networks, err := drivers.ReadStoreState(cfg.driverOptions())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	targets, err := resolveProbeTargets(networks, ctx.Args().First(), inspectContainer)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	popts := drivers.ProbeOptions{Count: ctx.Int("count"), Timeout: ctx.Duration("timeout")}
+	var reports []*drivers.ProbeReport
+	failed := false
+	for _, target := range targets {
+		report, err := drivers.Probe(cfg.driverOptions(), target.endpoint.ID, target.sandboxKey, popts)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		failed = failed || drivers.PreflightFailed(report.Results)
+		reports = append(reports, report)
+	}
+	if format == formatJSON {
+		if err := printJSON(os.Stdout, reports); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		for i, r := range reports {
+			if i > 0 {
+				fmt.Fprintln(os.Stdout)
+			}
+			fmt.Fprintf(os.Stdout, "endpoint %s of network %s\n", stringid.TruncateID(r.EndpointID), stringid.TruncateID(r.NetworkID))
+			printResults(os.Stdout, r.Results)
+		}
+	}
+	if failed {
+		return cli.NewExitError("probe failed", 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/XiaoweiQian/macvlan-driver/drivers"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStates() []*drivers.NetworkState {
+	return []*drivers.NetworkState{{
+		ID: "4f1cc9a0b7c6d5e4",
+		Endpoints: []*drivers.EndpointState{{
+			ID:         "9e3b7a1c2d4f5a6b",
+			NetworkID:  "4f1cc9a0b7c6d5e4",
+			SrcName:    "veth1a2b3c4",
+			MacAddress: "02:42:c0:a8:02:02",
+			Address:    "192.168.2.2/24",
+			LinkExists: true,
+		}},
+	}}
+}
+
+func TestPrintTable(t *testing.T) {
+	var b bytes.Buffer
+	printTable(&b, testStates())
+	assert.Equal(t, "NETWORK       ENDPOINT      SRC NAME     MAC                IPV4            IPV6  HOST LINK\n"+
+		"4f1cc9a0b7c6  9e3b7a1c2d4f  veth1a2b3c4  02:42:c0:a8:02:02  192.168.2.2/24        yes\n", b.String())
+}
+
+func TestMatchState(t *testing.T) {
+	ns := testStates()
+	assert.EqualValues(t, []interface{}{ns[0]}, matchState(ns, "4f1c"))
+	assert.EqualValues(t, []interface{}{ns[0].Endpoints[0]}, matchState(ns, "9e3b7a1c2d4f5a6b"))
+	assert.Empty(t, matchState(ns, "ffff"))
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	ns := testStates()
+	inspect := func(id string) (*docker.Container, error) {
+		if id != "web" {
+			return nil, fmt.Errorf("no such container")
+		}
+		return &docker.Container{NetworkSettings: &docker.NetworkSettings{
+			SandboxKey: "/var/run/docker/netns/1c2d3e4f",
+			Networks:   map[string]docker.ContainerNetwork{"lan": {EndpointID: "9e3b7a1c2d4f5a6b"}},
+		}}, nil
+	}
+
+	_, _, err := resolveEndpoint(ns, "9e3b", inspect)
+	assert.EqualError(t, err, "endpoint 9e3b7a1c2d4f is not joined to a sandbox")
+	ns[0].Endpoints[0].SandboxKey = "/var/run/docker/netns/1c2d3e4f"
+	ep, key, err := resolveEndpoint(ns, "9e3b", inspect)
+	assert.Nil(t, err)
+	assert.Equal(t, ns[0].Endpoints[0], ep)
+	assert.Equal(t, "/var/run/docker/netns/1c2d3e4f", key)
+
+	ep, key, err = resolveEndpoint(ns, "web", inspect)
+	assert.Nil(t, err)
+	assert.Equal(t, ns[0].Endpoints[0], ep)
+	assert.Equal(t, "/var/run/docker/netns/1c2d3e4f", key)
+
+	_, _, err = resolveEndpoint(ns, "db", inspect)
+	assert.EqualError(t, err, "no such endpoint or container db: no such container")
+	ns[0].Endpoints = nil
+	_, _, err = resolveEndpoint(ns, "web", inspect)
+	assert.EqualError(t, err, "container web has no endpoint of the plugin")
+}
+
+func TestResolveProbeTargets(t *testing.T) {
+	ns := testStates()
+	noContainer := func(id string) (*docker.Container, error) {
+		return nil, fmt.Errorf("no such container")
+	}
+
+	_, err := resolveProbeTargets(ns, "4f1c", noContainer)
+	assert.EqualError(t, err, "network 4f1cc9a0b7c6 has no endpoint joined to a sandbox")
+	ns[0].Endpoints[0].SandboxKey = "/var/run/docker/netns/1c2d3e4f"
+	targets, err := resolveProbeTargets(ns, "4f1c", noContainer)
+	assert.Nil(t, err)
+	assert.Equal(t, []probeTarget{{ns[0].Endpoints[0], "/var/run/docker/netns/1c2d3e4f"}}, targets)
+
+	targets, err = resolveProbeTargets(ns, "9e3b", noContainer)
+	assert.Nil(t, err)
+	assert.Equal(t, []probeTarget{{ns[0].Endpoints[0], "/var/run/docker/netns/1c2d3e4f"}}, targets)
+
+	_, err = resolveProbeTargets(ns, "ffff", noContainer)
+	assert.EqualError(t, err, "no such endpoint or container ffff: no such container")
+}
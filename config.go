@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/macvlan-driver/drivers"
+	"github.com/codegangsta/cli"
+)
+
+const (
+	defaultGroup     = "root"
+	logFormatText    = "text"
+	logFormatJSON    = "json"
+	defaultLogLevel  = "info"
+	defaultLogFormat = logFormatText
+)
+
+// daemonConfig is the content of the --config file. Settings are resolved
+// from the defaults, then the config file, then the command line flags, the
+// last one set wins. The swarm endpoint falls back to $SWARM_HOST when it is
+// set nowhere.
+type daemonConfig struct {
+	Socket      string `json:"socket"`
+	Group       string `json:"group"`
+	StorePath   string `json:"store_path"`
+	SwarmHost   string `json:"swarm_host"`
+	TLSCACert   string `json:"tls_ca_cert"`
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	LogLevel    string `json:"log_level"`
+	LogFormat   string `json:"log_format"`
+	LogFile     string `json:"log_file"`
+	DefaultMode string `json:"default_mode"`
+	DefaultMtu  int    `json:"default_mtu"`
+
+	StoreBackend string `json:"store_backend"`
+	StoreAddress string `json:"store_address"`
+	StoreBucket  string `json:"store_bucket"`
+	StorePrefix  string `json:"store_prefix"`
+	StoreTimeout string `json:"store_timeout"`
+	StoreRetries int    `json:"store_retries"`
+
+	GatewayMonitor string `json:"gateway_monitor"`
+}
+
+// configFlags are the command line flags overriding the config file
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "config, c",
+		Usage: "path of the json config file, re-read on SIGHUP",
+	},
+	cli.StringFlag{
+		Name:  "socket",
+		Usage: "plugin socket name under /run/docker/plugins or absolute path (default: " + networkType + ")",
+	},
+	cli.StringFlag{
+		Name:  "group",
+		Usage: "group owning the plugin socket (default: " + defaultGroup + ")",
+	},
+	cli.StringFlag{
+		Name:  "store-path",
+		Usage: "boltdb file of the local store (default: /var/lib/docker/network/files/local-kv.db)",
+	},
+	cli.StringFlag{
+		Name:  "swarm-host, H",
+		Usage: "docker/swarm endpoint, tcp://host:port or unix:///path (default: $SWARM_HOST or http://localhost:6732)",
+	},
+	cli.StringFlag{
+		Name:  "tlscacert",
+		Usage: "CA certificate verifying the swarm endpoint",
+	},
+	cli.StringFlag{
+		Name:  "tlscert",
+		Usage: "client certificate presented to the swarm endpoint",
+	},
+	cli.StringFlag{
+		Name:  "tlskey",
+		Usage: "key of the client certificate",
+	},
+	cli.StringFlag{
+		Name:  "log-level",
+		Usage: "debug, info, warning, error, fatal or panic (default: " + defaultLogLevel + ")",
+	},
+	cli.StringFlag{
+		Name:  "log-format",
+		Usage: "text or json (default: " + defaultLogFormat + ")",
+	},
+	cli.StringFlag{
+		Name:  "log-file",
+		Usage: "log to a file instead of stderr, reopened on SIGHUP",
+	},
+	cli.StringFlag{
+		Name:  "default-mode",
+		Usage: "macvlan mode of networks created without -o macvlan_mode (default: bridge)",
+	},
+	cli.IntFlag{
+		Name:  "default-mtu",
+		Usage: "mtu of the container interfaces, 0 inherits the parent's",
+	},
+	cli.StringFlag{
+		Name:  "store-backend",
+		Usage: "boltdb, memory, consul, etcd or zk (default: boltdb)",
+	},
+	cli.StringFlag{
+		Name:  "store-address",
+		Usage: "comma separated host:port of the consul, etcd or zk servers",
+	},
+	cli.StringFlag{
+		Name:  "store-bucket",
+		Usage: "boltdb bucket of the records (default: libnetwork)",
+	},
+	cli.StringFlag{
+		Name:  "store-prefix",
+		Usage: "key prefix of the records on consul, etcd or zk",
+	},
+	cli.StringFlag{
+		Name:  "store-timeout",
+		Usage: "connection timeout of the store, ex. 30s (default: 1m)",
+	},
+	cli.IntFlag{
+		Name:  "store-retries",
+		Usage: "attempts to open the store again before failing the start",
+	},
+	cli.StringFlag{
+		Name:  "gateway-monitor",
+		Usage: "interval of the arp/ndp probes of the network gateways, ex. 30s (default: disabled)",
+	},
+}
+
+// flagsConfig returns the settings given on the command line
+func flagsConfig(ctx *cli.Context) *daemonConfig {
+	return &daemonConfig{
+		Socket:      ctx.String("socket"),
+		Group:       ctx.String("group"),
+		StorePath:   ctx.String("store-path"),
+		SwarmHost:   ctx.String("swarm-host"),
+		TLSCACert:   ctx.String("tlscacert"),
+		TLSCert:     ctx.String("tlscert"),
+		TLSKey:      ctx.String("tlskey"),
+		LogLevel:    ctx.String("log-level"),
+		LogFormat:   ctx.String("log-format"),
+		LogFile:     ctx.String("log-file"),
+		DefaultMode: ctx.String("default-mode"),
+		DefaultMtu:  ctx.Int("default-mtu"),
+
+		StoreBackend: ctx.String("store-backend"),
+		StoreAddress: ctx.String("store-address"),
+		StoreBucket:  ctx.String("store-bucket"),
+		StorePrefix:  ctx.String("store-prefix"),
+		StoreTimeout: ctx.String("store-timeout"),
+		StoreRetries: ctx.Int("store-retries"),
+
+		GatewayMonitor: ctx.String("gateway-monitor"),
+	}
+}
+
+// loadConfig reads the config file, an empty path returns an empty config
+func loadConfig(path string) (*daemonConfig, error) {
+	cfg := &daemonConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file %s: %v", path, err)
+	}
+	if err := checkConfigKeys(b); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// checkConfigKeys rejects keys daemonConfig doesn't know, a typo would
+// otherwise be silently ignored
+func checkConfigKeys(b []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	known := map[string]bool{
+		"socket": true, "group": true, "store_path": true, "swarm_host": true,
+		"tls_ca_cert": true, "tls_cert": true, "tls_key": true, "log_level": true,
+		"log_format": true, "log_file": true, "default_mode": true, "default_mtu": true,
+		"store_backend": true, "store_address": true, "store_bucket": true, "store_prefix": true,
+		"store_timeout": true, "store_retries": true, "gateway_monitor": true,
+	}
+	var unknown []string
+	for k := range keys {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// resolveConfig loads the config file and applies the flags and defaults
+func resolveConfig(path string, flags *daemonConfig) (*daemonConfig, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.merge(flags)
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// merge overrides the settings with the ones set in o
+func (cfg *daemonConfig) merge(o *daemonConfig) {
+	for _, s := range []struct{ dst, src *string }{
+		{&cfg.Socket, &o.Socket},
+		{&cfg.Group, &o.Group},
+		{&cfg.StorePath, &o.StorePath},
+		{&cfg.SwarmHost, &o.SwarmHost},
+		{&cfg.TLSCACert, &o.TLSCACert},
+		{&cfg.TLSCert, &o.TLSCert},
+		{&cfg.TLSKey, &o.TLSKey},
+		{&cfg.LogLevel, &o.LogLevel},
+		{&cfg.LogFormat, &o.LogFormat},
+		{&cfg.LogFile, &o.LogFile},
+		{&cfg.DefaultMode, &o.DefaultMode},
+		{&cfg.StoreBackend, &o.StoreBackend},
+		{&cfg.StoreAddress, &o.StoreAddress},
+		{&cfg.StoreBucket, &o.StoreBucket},
+		{&cfg.StorePrefix, &o.StorePrefix},
+		{&cfg.StoreTimeout, &o.StoreTimeout},
+		{&cfg.GatewayMonitor, &o.GatewayMonitor},
+	} {
+		if *s.src != "" {
+			*s.dst = *s.src
+		}
+	}
+	if o.DefaultMtu != 0 {
+		cfg.DefaultMtu = o.DefaultMtu
+	}
+	if o.StoreRetries != 0 {
+		cfg.StoreRetries = o.StoreRetries
+	}
+}
+
+func (cfg *daemonConfig) setDefaults() {
+	if cfg.Socket == "" {
+		cfg.Socket = networkType
+	}
+	if cfg.Group == "" {
+		cfg.Group = defaultGroup
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = defaultLogLevel
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = defaultLogFormat
+	}
+}
+
+// validate verifies the settings before they are applied
+func (cfg *daemonConfig) validate() error {
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	if cfg.LogFormat != logFormatText && cfg.LogFormat != logFormatJSON {
+		return fmt.Errorf("invalid log format %s, use text or json", cfg.LogFormat)
+	}
+	for _, f := range []string{cfg.TLSCACert, cfg.TLSCert, cfg.TLSKey} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("tls file %s: %v", f, err)
+		}
+	}
+	if cfg.StoreTimeout != "" {
+		if _, err := time.ParseDuration(cfg.StoreTimeout); err != nil {
+			return fmt.Errorf("invalid store timeout: %v", err)
+		}
+	}
+	if cfg.GatewayMonitor != "" {
+		if _, err := time.ParseDuration(cfg.GatewayMonitor); err != nil {
+			return fmt.Errorf("invalid gateway monitor interval: %v", err)
+		}
+	}
+	opts := cfg.driverOptions()
+
+	return opts.Validate()
+}
+
+// driverOptions returns the options passed to the driver, the durations
+// are validated beforehand
+func (cfg *daemonConfig) driverOptions() drivers.Options {
+	timeout, _ := time.ParseDuration(cfg.StoreTimeout)
+	monitor, _ := time.ParseDuration(cfg.GatewayMonitor)
+	return drivers.Options{
+		SwarmHost:   cfg.SwarmHost,
+		TLSCACert:   cfg.TLSCACert,
+		TLSCert:     cfg.TLSCert,
+		TLSKey:      cfg.TLSKey,
+		StorePath:   cfg.StorePath,
+		DefaultMode: cfg.DefaultMode,
+		DefaultMtu:  cfg.DefaultMtu,
+
+		StoreBackend: cfg.StoreBackend,
+		StoreAddress: cfg.StoreAddress,
+		StoreBucket:  cfg.StoreBucket,
+		StorePrefix:  cfg.StorePrefix,
+		StoreTimeout: timeout,
+		StoreRetries: cfg.StoreRetries,
+
+		GatewayMonitor: monitor,
+	}
+}
+
+// logFile is the currently open log output, nil when logging to stderr
+var logFile *os.File
+
+// setupLogging applies the log level and format and (re)opens the log
+// output so that a rotated log file is picked up on reload
+func setupLogging(cfg *daemonConfig, debug bool) error {
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
+	if debug {
+		level = logrus.DebugLevel
+	}
+	logrus.SetLevel(level)
+	if cfg.LogFormat == logFormatJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+
+	old := logFile
+	if cfg.LogFile == "" {
+		logrus.SetOutput(os.Stderr)
+		logFile = nil
+	} else {
+		f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("could not open log file %s: %v", cfg.LogFile, err)
+		}
+		logrus.SetOutput(f)
+		logFile = f
+	}
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "macvlan-config")
+	assert.Nil(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestResolveConfig(t *testing.T) {
+	path := writeConfig(t, `{"log_level": "debug", "default_mode": "vepa", "default_mtu": 1400, "group": "docker"}`)
+	defer os.Remove(path)
+
+	cfg, err := resolveConfig(path, &daemonConfig{DefaultMtu: 9000, LogFormat: logFormatJSON})
+	assert.Nil(t, err)
+	assert.EqualValues(t, &daemonConfig{
+		Socket:      networkType,
+		Group:       "docker",
+		LogLevel:    "debug",
+		LogFormat:   logFormatJSON,
+		DefaultMode: "vepa",
+		DefaultMtu:  9000,
+	}, cfg)
+
+	cfg, err = resolveConfig("", &daemonConfig{})
+	assert.Nil(t, err)
+	assert.EqualValues(t, &daemonConfig{
+		Socket:    networkType,
+		Group:     defaultGroup,
+		LogLevel:  defaultLogLevel,
+		LogFormat: defaultLogFormat,
+	}, cfg)
+}
+
+func TestResolveConfigWithErr(t *testing.T) {
+	path := writeConfig(t, `{"log_levl": "debug"}`)
+	defer os.Remove(path)
+	_, err := resolveConfig(path, &daemonConfig{})
+	assert.EqualError(t, err, "could not parse config file "+path+": unknown keys log_levl")
+
+	_, err = resolveConfig("", &daemonConfig{LogFormat: "xml"})
+	assert.EqualError(t, err, "invalid log format xml, use text or json")
+	_, err = resolveConfig("", &daemonConfig{LogLevel: "loud"})
+	assert.NotNil(t, err)
+	_, err = resolveConfig("", &daemonConfig{DefaultMode: "macvtap"})
+	assert.NotNil(t, err)
+	_, err = resolveConfig("", &daemonConfig{TLSCert: "/nonexistent/cert.pem", TLSKey: "/nonexistent/key.pem"})
+	assert.NotNil(t, err)
+}
+
+func TestStoreOptions(t *testing.T) {
+	path := writeConfig(t, `{"store_backend": "consul", "store_address": "10.0.0.1:8500", "store_prefix": "macvlan", "store_timeout": "5s"}`)
+	defer os.Remove(path)
+
+	cfg, err := resolveConfig(path, &daemonConfig{StoreRetries: 3})
+	assert.Nil(t, err)
+	opts := cfg.driverOptions()
+	assert.Equal(t, "consul", opts.StoreBackend)
+	assert.Equal(t, "10.0.0.1:8500", opts.StoreAddress)
+	assert.Equal(t, "macvlan", opts.StorePrefix)
+	assert.Equal(t, 5*time.Second, opts.StoreTimeout)
+	assert.Equal(t, 3, opts.StoreRetries)
+
+	_, err = resolveConfig("", &daemonConfig{StoreTimeout: "soon"})
+	assert.NotNil(t, err)
+	_, err = resolveConfig("", &daemonConfig{StoreBackend: "consul"})
+	assert.EqualError(t, err, "the consul store requires a store address")
+}
+
+func TestGatewayMonitorOption(t *testing.T) {
+	path := writeConfig(t, `{"gateway_monitor": "30s"}`)
+	defer os.Remove(path)
+
+	cfg, err := resolveConfig(path, &daemonConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, cfg.driverOptions().GatewayMonitor)
+	cfg, err = resolveConfig(path, &daemonConfig{GatewayMonitor: "1m"})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, cfg.driverOptions().GatewayMonitor)
+
+	_, err = resolveConfig("", &daemonConfig{GatewayMonitor: "often"})
+	assert.NotNil(t, err)
+	_, err = resolveConfig("", &daemonConfig{GatewayMonitor: "-1s"})
+	assert.EqualError(t, err, "gateway monitor interval -1s must not be negative")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/macvlan-driver/drivers"
+	"github.com/coreos/go-systemd/activation"
+	"github.com/coreos/go-systemd/util"
+	"github.com/docker/go-connections/sockets"
+)
+
+const (
+	pluginSockDir = "/run/docker/plugins"
+	drainTimeout  = 30 * time.Second
+)
+
+// daemon owns the plugin socket and reacts to signals, SIGHUP reloads the
+// config file and SIGTERM drains the requests in flight before exiting
+type daemon struct {
+	configPath string
+	flags      *daemonConfig
+	config     *daemonConfig
+	debug      bool
+	driver     *drivers.Driver
+	drainer    *drivers.Drainer
+}
+
+// serve listens on the plugin socket until the daemon is told to stop. The
+// socket is created here rather than by the sdk so it can be closed on
+// shutdown.
+func (dm *daemon) serve(h *drivers.Handler, group, name string) error {
+	l, path, err := newUnixListener(name, group)
+	if err != nil {
+		return fmt.Errorf("could not listen on the plugin socket: %v", err)
+	}
+	if path != "" {
+		defer os.Remove(path)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.Serve(l)
+	}()
+	logrus.Infof("Listening on %s", l.Addr())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case err := <-errCh:
+			dm.shutdown()
+			return err
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				dm.reload()
+				continue
+			}
+			logrus.Infof("Received %s, shutting down", sig)
+			l.Close()
+			dm.shutdown()
+			return nil
+		}
+	}
+}
+
+// reload re-reads the config file, reopens the log output, reconnects to
+// swarm and revalidates the networks. The socket and the in-memory state are
+// kept, a config that fails to load leaves the running config in place.
+func (dm *daemon) reload() {
+	logrus.Infof("Received SIGHUP, reloading %s", dm.configPath)
+	cfg, err := resolveConfig(dm.configPath, dm.flags)
+	if err != nil {
+		logrus.Errorf("Reload failed, keeping the current config: %v", err)
+		return
+	}
+	if err := setupLogging(cfg, dm.debug); err != nil {
+		logrus.Errorf("Reload failed to reopen the log output: %v", err)
+	}
+	if err := dm.driver.SetSwarm(cfg.SwarmHost, cfg.TLSCACert, cfg.TLSCert, cfg.TLSKey); err != nil {
+		logrus.Errorf("Reload failed to set the swarm endpoint: %v", err)
+	}
+	if cfg.Socket != dm.config.Socket || cfg.Group != dm.config.Group || cfg.StorePath != dm.config.StorePath ||
+		cfg.DefaultMode != dm.config.DefaultMode || cfg.DefaultMtu != dm.config.DefaultMtu ||
+		cfg.StoreBackend != dm.config.StoreBackend || cfg.StoreAddress != dm.config.StoreAddress ||
+		cfg.StoreBucket != dm.config.StoreBucket || cfg.StorePrefix != dm.config.StorePrefix ||
+		cfg.StoreTimeout != dm.config.StoreTimeout || cfg.StoreRetries != dm.config.StoreRetries {
+		logrus.Warnf("Reload: socket, group, store and network defaults only change on restart")
+	}
+	if err := dm.driver.Revalidate(); err != nil {
+		logrus.Errorf("Reload: %v", err)
+	}
+	dm.config = cfg
+	logrus.Infof("Reload complete")
+}
+
+// shutdown waits for the requests in flight and closes the local store
+func (dm *daemon) shutdown() {
+	if err := dm.drainer.Drain(drainTimeout); err != nil {
+		logrus.Warnf("Shutdown: %v", err)
+	}
+	if err := dm.driver.Close(); err != nil {
+		logrus.Errorf("Failed to close the local store: %v", err)
+	}
+}
+
+// newUnixListener mirrors the sdk listener, preferring a systemd activated
+// socket, and returns the path of the socket it created
+func newUnixListener(name, group string) (net.Listener, string, error) {
+	if util.IsRunningSystemd() {
+		listenFds := activation.Files(false)
+		if len(listenFds) > 1 {
+			return nil, "", fmt.Errorf("expected only one socket from systemd, got %d", len(listenFds))
+		}
+		if len(listenFds) == 1 {
+			l, err := net.FileListener(listenFds[0])
+			return l, "", err
+		}
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+			return nil, "", err
+		}
+		path = filepath.Join(pluginSockDir, name+".sock")
+	}
+	l, err := sockets.NewUnixSocket(path, group)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return l, path, nil
+}
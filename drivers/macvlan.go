@@ -2,7 +2,6 @@ package drivers
 
 import (
 	"fmt"
-	"os"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
@@ -10,7 +9,7 @@ import (
 	pluginNet "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/osl"
-	docker "github.com/fsouza/go-dockerclient"
+	"github.com/docker/libnetwork/types"
 )
 
 const (
@@ -38,7 +37,12 @@ type networkTable map[string]*network
 type Driver struct {
 	networks networkTable
 	store    macStore
-	client   *docker.Client
+	swarm    *swarmConn
+	degraded bool
+	stop     chan struct{}
+	opts     Options
+	tuning   map[string]string         // tuning status of the joined endpoints
+	gateways map[string]*GatewayStatus // reachability of the network gateways
 	sync.Once
 	sync.Mutex
 }
@@ -49,6 +53,9 @@ type network struct {
 	endpoints endpointTable
 	driver    *Driver
 	config    *configuration
+	ops       sync.Mutex    // held by the operation in progress on the network, see acquire
+	allocated bool          // allocated by the swarm manager, not yet created on this node
+	probe     *gatewayProbe // the gateway probe link, see probeGateways
 	sync.Mutex
 }
 
@@ -61,16 +68,11 @@ func Init(d *Driver) (*Driver, error) {
 		}
 	}
 
-	var err error
-	host := os.Getenv("SWARM_HOST")
-	if host == "" {
-		host = swarmHost
-	}
-	d.client, err = docker.NewClient(host)
+	// an unreachable swarm is retried in the background rather than failing
+	// the start, networks are then only known from the daemon requests
+	err := d.SetSwarm(d.opts.SwarmHost, d.opts.TLSCACert, d.opts.TLSCert, d.opts.TLSKey)
 	if err != nil {
-		str := fmt.Sprintf("Could not connect to swarm. Error: %v", err)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		d.degrade(err)
 	}
 
 	if err = d.store.InitStore(d); err != nil {
@@ -78,6 +80,11 @@ func Init(d *Driver) (*Driver, error) {
 		logrus.Errorf(str)
 		return nil, fmt.Errorf(str)
 	}
+	// the restored endpoints keep their tuning
+	d.retune()
+	if d.opts.GatewayMonitor > 0 {
+		d.startGatewayMonitor(d.opts.GatewayMonitor)
+	}
 
 	return d, nil
 }
@@ -99,63 +106,34 @@ func (d *Driver) AllocateNetwork(r *pluginNet.AllocateNetworkRequest) (*pluginNe
 	if id == "" {
 		str := "invalid network id for macvlan network"
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
-	}
-
-	// reject a null v4 network
-	if len(ipV4Data) == 0 || ipV4Data[0].Pool == "0.0.0.0/0" {
-		str := "ipv4 pool is empty"
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
 	}
 
 	options := make(map[string]interface{})
 	options[netlabel.GenericData] = opts
-	// parse and validate the config and bind to networkConfiguration
-	config, err := parseNetworkOptions(id, options)
-	if err != nil {
-		str := fmt.Sprintf("CreateNetwork opts is invalid %s", options)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+	ipv4 := make([]*pluginNet.IPAMData, len(ipV4Data))
+	for i := range ipV4Data {
+		ipv4[i] = &ipV4Data[i]
 	}
-
-	config.ID = id
-	ipv4 := []*pluginNet.IPAMData{}
-	ipv6 := []*pluginNet.IPAMData{}
-	for _, ipd := range ipV4Data {
-		ipv4 = append(ipv4, &ipd)
+	ipv6 := make([]*pluginNet.IPAMData, len(ipV6Data))
+	for i := range ipV6Data {
+		ipv6[i] = &ipV6Data[i]
 	}
-	for _, ipd := range ipV6Data {
-		ipv6 = append(ipv6, &ipd)
-	}
-	err = config.processIPAM(id, ipv4, ipv6)
+	// parse and validate the config and bind to networkConfiguration
+	config, err := d.networkConfig(id, options, ipv4, ipv6, phaseAllocate)
 	if err != nil {
-		str := fmt.Sprintf("CreateNetwork ipV4Data is invalid %s", ipv4)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		logrus.Errorf("AllocateNetwork %v", err)
+		return nil, types.BadRequestErrorf("%v", err)
 	}
 
-	// verify the macvlan mode from -o macvlan_mode option
-	switch config.MacvlanMode {
-	case "", modeBridge:
-		// default to macvlan bridge mode if -o macvlan_mode is empty
-		config.MacvlanMode = modeBridge
-	case modePrivate:
-		config.MacvlanMode = modePrivate
-	case modePassthru:
-		config.MacvlanMode = modePassthru
-	case modeVepa:
-		config.MacvlanMode = modeVepa
-	default:
-		str := fmt.Sprintf("requested macvlan mode '%s' is not valid, 'bridge' mode is the macvlan driver default", config.MacvlanMode)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
-	}
-	// loopback is not a valid parent link
-	if config.Parent == "lo" {
-		str := fmt.Sprintf("loopback interface is not a valid %s parent link", macvlanType)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+	// a retried allocation of the same network succeeds, a different one conflicts
+	if nw, err := d.getNetwork(id); err == nil {
+		if !nw.config.sameNetwork(config) {
+			str := fmt.Sprintf("macvlan network %s already exists with a different configuration", id)
+			logrus.Errorf(str)
+			return nil, types.ForbiddenErrorf("%s", str)
+		}
+		return &pluginNet.AllocateNetworkResponse{Options: opts}, nil
 	}
 
 	networkList := d.getnetworks()
@@ -164,19 +142,18 @@ func (d *Driver) AllocateNetwork(r *pluginNet.AllocateNetworkRequest) (*pluginNe
 			str := fmt.Sprintf("network %s is already using parent interface %s",
 				getDummyName(stringid.TruncateID(nw.config.ID)), config.Parent)
 			logrus.Errorf(str)
-			return nil, fmt.Errorf(str)
+			return nil, types.ForbiddenErrorf("%s", str)
 		}
 	}
 
 	n := &network{
-		id:     id,
-		driver: d,
-		config: config,
+		id:        id,
+		driver:    d,
+		config:    config,
+		allocated: true,
 	}
 
-	d.Lock()
-	d.networks[id] = n
-	d.Unlock()
+	d.addNetwork(n)
 	res := &pluginNet.AllocateNetworkResponse{Options: opts}
 
 	return res, nil
@@ -190,22 +167,13 @@ func (d *Driver) FreeNetwork(r *pluginNet.FreeNetworkRequest) error {
 	if id == "" {
 		str := "invalid network id passed while freeing macvlan network"
 		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		return types.BadRequestErrorf("%s", str)
 	}
 
-	d.Lock()
-	_, ok := d.networks[id]
-	d.Unlock()
-
-	if !ok {
+	if !d.deleteNetwork(id) {
 		logrus.Warnf("macvlan network with id %s not found", id)
-		return nil
 	}
 
-	d.Lock()
-	delete(d.networks, id)
-	d.Unlock()
-
 	return nil
 }
 
@@ -0,0 +1,230 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/libnetwork/types"
+)
+
+const pluginManifest = `{"Implements": ["NetworkDriver"]}`
+
+// ErrorResponse is the body of a failed request. The daemon reports Err,
+// Class names the libnetwork error class and Retryable tells whether the
+// same request may succeed later.
+//
+// The handlers return these classes:
+//
+//	BadRequest      400  invalid ids, options or addresses
+//	Forbidden       403  an id reused with another configuration, a parent in use
+//	NotFound        404  the network or endpoint of a join is unknown
+//	NotImplemented  501
+//	Internal        500  netlink failures and inconsistent state
+//	NoService       503  retryable, the plugin is shutting down
+//	Retry           503  retryable, the store could not be read or written
+//	Timeout         504  retryable
+//
+// The handlers are idempotent, a retried request that already took effect
+// succeeds again.
+type ErrorResponse struct {
+	Err       string
+	Class     string `json:",omitempty"`
+	Retryable bool   `json:",omitempty"`
+}
+
+// errorResponse returns the status and the body of a failed request
+func errorResponse(err error) (int, *ErrorResponse) {
+	res := &ErrorResponse{Err: err.Error()}
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case types.BadRequestError:
+		status, res.Class = http.StatusBadRequest, "BadRequest"
+	case types.ForbiddenError:
+		status, res.Class = http.StatusForbidden, "Forbidden"
+	case types.NotFoundError:
+		status, res.Class = http.StatusNotFound, "NotFound"
+	case types.NotImplementedError:
+		status, res.Class = http.StatusNotImplemented, "NotImplemented"
+	case types.NoServiceError:
+		status, res.Class, res.Retryable = http.StatusServiceUnavailable, "NoService", true
+	case types.RetryError:
+		status, res.Class, res.Retryable = http.StatusServiceUnavailable, "Retry", true
+	case types.TimeoutError:
+		status, res.Class, res.Retryable = http.StatusGatewayTimeout, "Timeout", true
+	case types.InternalError:
+		res.Class = "Internal"
+	}
+
+	return status, res
+}
+
+// Handler serves the NetworkDriver plugin API like the go-plugins-helpers
+// handler, answering failed requests with the status of their error class
+// instead of always 500
+type Handler struct {
+	driver pluginNet.Driver
+	mux    *http.ServeMux
+}
+
+// NewHandler returns a Handler forwarding requests to driver
+func NewHandler(driver pluginNet.Driver) *Handler {
+	h := &Handler{driver: driver, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+		fmt.Fprintln(w, pluginManifest)
+	})
+	h.initMux()
+	if m, ok := driver.(MetricsWriter); ok {
+		h.mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			m.WriteMetrics(w)
+		})
+	}
+
+	return h
+}
+
+// ServeHTTP dispatches a plugin request
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Serve serves the plugin requests on the listener
+func (h *Handler) Serve(l net.Listener) error {
+	server := http.Server{Handler: h}
+	return server.Serve(l)
+}
+
+// decoder reads the request body into req
+type decoder func(req interface{}) error
+
+// handle registers fn to decode and run the request of path
+func (h *Handler) handle(path string, fn func(decode decoder) (interface{}, error)) {
+	h.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		res, err := fn(func(req interface{}) error {
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				return types.BadRequestErrorf("invalid %s request: %v", path, err)
+			}
+			return nil
+		})
+		w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+		if err != nil {
+			status, body := errorResponse(err)
+			logrus.Debugf("%s failed with %d: %s", path, status, body.Err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+		if res == nil {
+			res = map[string]string{}
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+func (h *Handler) initMux() {
+	d := h.driver
+	h.handle("/NetworkDriver.GetCapabilities", func(decode decoder) (interface{}, error) {
+		res, err := d.GetCapabilities()
+		if err == nil && res == nil {
+			err = types.NotImplementedErrorf("network driver must implement GetCapabilities")
+		}
+		return res, err
+	})
+	h.handle("/NetworkDriver.CreateNetwork", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.CreateNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.CreateNetwork(req)
+	})
+	h.handle("/NetworkDriver.AllocateNetwork", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.AllocateNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.AllocateNetwork(req)
+	})
+	h.handle("/NetworkDriver.DeleteNetwork", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.DeleteNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DeleteNetwork(req)
+	})
+	h.handle("/NetworkDriver.FreeNetwork", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.FreeNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.FreeNetwork(req)
+	})
+	h.handle("/NetworkDriver.CreateEndpoint", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.CreateEndpointRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.CreateEndpoint(req)
+	})
+	h.handle("/NetworkDriver.DeleteEndpoint", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.DeleteEndpointRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DeleteEndpoint(req)
+	})
+	h.handle("/NetworkDriver.EndpointOperInfo", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.InfoRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.EndpointInfo(req)
+	})
+	h.handle("/NetworkDriver.Join", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.JoinRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.Join(req)
+	})
+	h.handle("/NetworkDriver.Leave", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.LeaveRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.Leave(req)
+	})
+	h.handle("/NetworkDriver.DiscoverNew", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.DiscoveryNotification{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DiscoverNew(req)
+	})
+	h.handle("/NetworkDriver.DiscoverDelete", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.DiscoveryNotification{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DiscoverDelete(req)
+	})
+	h.handle("/NetworkDriver.ProgramExternalConnectivity", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.ProgramExternalConnectivityRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.ProgramExternalConnectivity(req)
+	})
+	h.handle("/NetworkDriver.RevokeExternalConnectivity", func(decode decoder) (interface{}, error) {
+		req := &pluginNet.RevokeExternalConnectivityRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.RevokeExternalConnectivity(req)
+	})
+}
@@ -0,0 +1,78 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/stretchr/testify/assert"
+)
+
+// post sends the request to the handler and decodes the response into res
+func post(h http.Handler, path string, req interface{}, res interface{}) int {
+	b, _ := json.Marshal(req)
+	if s, ok := req.(string); ok {
+		b = []byte(s)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(b)))
+	json.Unmarshal(w.Body.Bytes(), res)
+	return w.Code
+}
+
+func TestHandlerResponses(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ms.On("StoreUpdate", ep).Return(nil)
+	h := NewHandler(d)
+
+	res := &pluginNet.CreateEndpointResponse{}
+	assert.Equal(t, http.StatusOK, post(h, "/NetworkDriver.CreateEndpoint", r, res))
+	assert.Equal(t, "02:42:c0:a8:02:02", res.Interface.MacAddress)
+	caps := &pluginNet.CapabilitiesResponse{}
+	assert.Equal(t, http.StatusOK, post(h, "/NetworkDriver.GetCapabilities", nil, caps))
+	assert.Equal(t, pluginNet.GlobalScope, caps.Scope)
+	assert.Equal(t, http.StatusOK, post(h, "/NetworkDriver.Leave", &pluginNet.LeaveRequest{NetworkID: "1", EndpointID: "1234567"}, &struct{}{}))
+
+	for _, c := range []struct {
+		path   string
+		req    interface{}
+		status int
+		class  string
+	}{
+		{"/NetworkDriver.CreateEndpoint", "{", http.StatusBadRequest, "BadRequest"},
+		{"/NetworkDriver.CreateNetwork", &pluginNet.CreateNetworkRequest{}, http.StatusBadRequest, "BadRequest"},
+		{"/NetworkDriver.Join", &pluginNet.JoinRequest{NetworkID: "1", EndpointID: "100"}, http.StatusNotFound, "NotFound"},
+		{"/NetworkDriver.CreateEndpoint", &pluginNet.CreateEndpointRequest{NetworkID: "1", EndpointID: "1234567",
+			Interface: &pluginNet.EndpointInterface{Address: "192.168.2.3/24"}}, http.StatusForbidden, "Forbidden"},
+	} {
+		e := &ErrorResponse{}
+		assert.Equal(t, c.status, post(h, c.path, c.req, e), c.path)
+		assert.Equal(t, c.class, e.Class, c.path)
+		assert.NotEmpty(t, e.Err, c.path)
+		assert.False(t, e.Retryable, c.path)
+	}
+}
+
+func TestHandlerRetryableErrors(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ms.On("StoreUpdate", ep).Return(fmt.Errorf("error"))
+	dr := NewDrainer(d)
+	h := NewHandler(dr)
+
+	e := &ErrorResponse{}
+	assert.Equal(t, http.StatusServiceUnavailable, post(h, "/NetworkDriver.CreateEndpoint", r, e))
+	assert.Equal(t, "failed to save macvlan endpoint 1234567 to store: error", e.Err)
+	assert.Equal(t, "Retry", e.Class)
+	assert.True(t, e.Retryable)
+
+	assert.Nil(t, dr.Drain(time.Second))
+	e = &ErrorResponse{}
+	assert.Equal(t, http.StatusServiceUnavailable, post(h, "/NetworkDriver.CreateEndpoint", r, e))
+	assert.Equal(t, "NoService", e.Class)
+	assert.True(t, e.Retryable)
+}
@@ -0,0 +1,147 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
+	"github.com/docker/libkv/store/boltdb"
+	"github.com/docker/libkv/store/consul"
+	"github.com/docker/libkv/store/etcd"
+	"github.com/docker/libkv/store/zookeeper"
+	"github.com/docker/libnetwork/datastore"
+)
+
+// store backends
+const (
+	storeBoltDB = string(store.BOLTDB)
+	storeMemory = "memory"
+	storeConsul = string(store.CONSUL)
+	storeEtcd   = string(store.ETCD)
+	storeZK     = string(store.ZK)
+)
+
+const (
+	defaultStoreTimeout = time.Minute     // libnetwork's boltdb connection timeout
+	storeRetryInterval  = 2 * time.Second // delay between attempts to open the store
+	memoryStoreAddress  = "default"
+)
+
+// validateStore verifies the store options of the backend
+func (o *Options) validateStore() error {
+	switch o.StoreBackend {
+	case "", storeBoltDB:
+		if o.StoreAddress != "" || o.StorePrefix != "" {
+			return fmt.Errorf("the boltdb store takes a store path and bucket, not an address or prefix")
+		}
+	case storeMemory:
+		if o.StorePath != "" || o.StoreBucket != "" {
+			return fmt.Errorf("the memory store takes no store path or bucket")
+		}
+	case storeConsul, storeEtcd, storeZK:
+		if o.StoreAddress == "" {
+			return fmt.Errorf("the %s store requires a store address", o.StoreBackend)
+		}
+		if o.StorePath != "" || o.StoreBucket != "" {
+			return fmt.Errorf("the %s store takes an address and prefix, not a store path or bucket", o.StoreBackend)
+		}
+	default:
+		return fmt.Errorf("store backend %s is not valid, use one of boltdb, memory, consul, etcd or zk", o.StoreBackend)
+	}
+	if strings.Contains(o.StoreAddress, "/") {
+		return fmt.Errorf("store address %s must be a host:port list, set the key prefix with store_prefix", o.StoreAddress)
+	}
+	if o.StoreTimeout < 0 {
+		return fmt.Errorf("store timeout %s must not be negative", o.StoreTimeout)
+	}
+	if o.StoreRetries < 0 {
+		return fmt.Errorf("store retries %d must not be negative", o.StoreRetries)
+	}
+
+	return nil
+}
+
+// storeBackend returns the selected backend, boltdb by default
+func (o *Options) storeBackend() string {
+	if o.StoreBackend == "" {
+		return storeBoltDB
+	}
+
+	return o.StoreBackend
+}
+
+// storeScope returns the datastore scope and config of the backend. Shared
+// kv stores use the global scope, which is not cached, so the records other
+// hosts write are seen.
+func (o *Options) storeScope() (string, *datastore.ScopeCfg) {
+	timeout := o.StoreTimeout
+	if timeout == 0 {
+		timeout = defaultStoreTimeout
+	}
+	cfg := &datastore.ScopeCfg{
+		Client: datastore.ScopeClientCfg{
+			Provider: o.storeBackend(),
+			Config:   &store.Config{ConnectionTimeout: timeout},
+		},
+	}
+	scope := datastore.LocalScope
+	switch o.storeBackend() {
+	case storeBoltDB:
+		cfg.Client.Address = o.StorePath
+		if cfg.Client.Address == "" {
+			cfg.Client.Address = DefaultStorePath()
+		}
+		cfg.Client.Config.Bucket = o.storeBucket()
+	case storeMemory:
+		cfg.Client.Address = o.StoreAddress
+		if cfg.Client.Address == "" {
+			cfg.Client.Address = memoryStoreAddress
+		}
+	default:
+		scope = datastore.GlobalScope
+		cfg.Client.Address = o.StoreAddress
+	}
+	// datastore reads the key prefix from the path of the address
+	if prefix := strings.Trim(o.StorePrefix, "/"); prefix != "" {
+		cfg.Client.Address += "/" + prefix
+	}
+
+	return scope, cfg
+}
+
+// storeBucket returns the boltdb bucket, libnetwork's by default
+func (o *Options) storeBucket() string {
+	if o.StoreBucket == "" {
+		return storeBucket
+	}
+
+	return o.StoreBucket
+}
+
+// openStore connects to the store backend, retrying StoreRetries times when
+// it can't be reached
+func openStore(opts Options) (datastore.DataStore, error) {
+	boltdb.Register()
+	consul.Register()
+	etcd.Register()
+	zookeeper.Register()
+	scope, cfg := opts.storeScope()
+	for attempt := 0; ; attempt++ {
+		ds, err := datastore.NewDataStore(scope, cfg)
+		if err == nil {
+			// connections are lazy, list the driver records to verify the backend answers
+			_, err = ds.KVStore().List(datastore.Key(macvlanPrefix))
+			if err == nil || err == store.ErrKeyNotFound {
+				return ds, nil
+			}
+			ds.Close()
+		}
+		if attempt >= opts.StoreRetries {
+			return nil, fmt.Errorf("could not open the %s store %s: %v", cfg.Client.Provider, cfg.Client.Address, err)
+		}
+		logrus.Warnf("Failed to open the %s store %s, retrying in %s: %v", cfg.Client.Provider, cfg.Client.Address, storeRetryInterval, err)
+		time.Sleep(storeRetryInterval)
+	}
+}
@@ -0,0 +1,239 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	egressRateOpt   = macvlanType + ".egress_rate"   // endpoint option macvlan.egress_rate
+	egressBurstOpt  = macvlanType + ".egress_burst"  // endpoint option macvlan.egress_burst
+	ingressRateOpt  = macvlanType + ".ingress_rate"  // endpoint option macvlan.ingress_rate
+	ingressBurstOpt = macvlanType + ".ingress_burst" // endpoint option macvlan.ingress_burst
+	minBurst        = 32 * 1024                      // smallest default burst in bytes
+	tbfLatency      = 50                             // ms of traffic the egress tbf may queue
+	policeMtu       = 65535                          // largest packet the ingress policer accepts
+)
+
+// bandwidthLimits holds the tc rate limits requested for an endpoint. Rates
+// are in bits per second and bursts in bytes, zero means unlimited.
+type bandwidthLimits struct {
+	EgressRate   uint64
+	EgressBurst  uint64
+	IngressRate  uint64
+	IngressBurst uint64
+}
+
+// getEndpointOption looks up a driver option passed either directly in the
+// endpoint options or through the generic data of the endpoint
+func getEndpointOption(epOptions map[string]interface{}, key string) (string, bool) {
+	v, ok := epOptions[key]
+	if !ok {
+		genData, _ := epOptions[netlabel.GenericData].(map[string]interface{})
+		if v, ok = genData[key]; !ok {
+			return "", false
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	default:
+		return fmt.Sprintf("%v", value), true
+	}
+}
+
+// parseBandwidthOptions parses the macvlan.*_rate and macvlan.*_burst endpoint options
+func parseBandwidthOptions(epOptions map[string]interface{}) (*bandwidthLimits, error) {
+	var (
+		err    error
+		limits = &bandwidthLimits{}
+	)
+	if v, ok := getEndpointOption(epOptions, egressRateOpt); ok {
+		if limits.EgressRate, err = parseRate(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", egressRateOpt, v, err)
+		}
+	}
+	if v, ok := getEndpointOption(epOptions, egressBurstOpt); ok {
+		if limits.EgressBurst, err = parseBurst(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", egressBurstOpt, v, err)
+		}
+	}
+	if v, ok := getEndpointOption(epOptions, ingressRateOpt); ok {
+		if limits.IngressRate, err = parseRate(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", ingressRateOpt, v, err)
+		}
+		// the policer rate is calculated from a 32 bit bits/s value
+		if limits.IngressRate > uint64(^uint32(0)) {
+			return nil, fmt.Errorf("invalid %s %q: rate is too large for the ingress policer", ingressRateOpt, v)
+		}
+	}
+	if v, ok := getEndpointOption(epOptions, ingressBurstOpt); ok {
+		if limits.IngressBurst, err = parseBurst(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", ingressBurstOpt, v, err)
+		}
+	}
+	if limits.EgressBurst != 0 && limits.EgressRate == 0 {
+		return nil, fmt.Errorf("%s requires %s to be set", egressBurstOpt, egressRateOpt)
+	}
+	if limits.IngressBurst != 0 && limits.IngressRate == 0 {
+		return nil, fmt.Errorf("%s requires %s to be set", ingressBurstOpt, ingressRateOpt)
+	}
+	if limits.EgressRate == 0 && limits.IngressRate == 0 {
+		return nil, nil
+	}
+	if limits.EgressRate != 0 && limits.EgressBurst == 0 {
+		limits.EgressBurst = defaultBurst(limits.EgressRate)
+	}
+	if limits.IngressRate != 0 && limits.IngressBurst == 0 {
+		limits.IngressBurst = defaultBurst(limits.IngressRate)
+	}
+
+	return limits, nil
+}
+
+// parseRate parses a tc style rate such as 100mbit or 10mbps into bits per second
+func parseRate(rate string) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], s[i:]
+	}
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("rate must be a positive number followed by an optional unit, ex. 100mbit")
+	}
+	var multiplier float64
+	switch unit {
+	case "", "bit":
+		multiplier = 1
+	case "kbit":
+		multiplier = 1e3
+	case "mbit":
+		multiplier = 1e6
+	case "gbit":
+		multiplier = 1e9
+	case "tbit":
+		multiplier = 1e12
+	case "bps":
+		multiplier = 8
+	case "kbps":
+		multiplier = 8e3
+	case "mbps":
+		multiplier = 8e6
+	case "gbps":
+		multiplier = 8e9
+	case "tbps":
+		multiplier = 8e12
+	default:
+		return 0, fmt.Errorf("unknown rate unit %q, use one of bit, kbit, mbit, gbit, tbit or bps, kbps, mbps, gbps, tbps", unit)
+	}
+	bits := uint64(value * multiplier)
+	// tc rate specs cannot express anything below one byte per second
+	if bits < 8 {
+		return 0, fmt.Errorf("rate must be at least 8bit")
+	}
+
+	return bits, nil
+}
+
+// parseBurst parses a burst size such as 32k or 1mb into bytes
+func parseBurst(burst string) (uint64, error) {
+	size, err := units.RAMInBytes(burst)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 || size > int64(^uint32(0)) {
+		return 0, fmt.Errorf("burst must be between 1 byte and 4gb")
+	}
+
+	return uint64(size), nil
+}
+
+// defaultBurst allows 10ms worth of traffic at the given rate, at least minBurst bytes
+func defaultBurst(rate uint64) uint64 {
+	burst := rate / 8 / 100
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	return burst
+}
+
+// setBandwidthLimits programs the endpoint limits on the macvlan slave. The
+// qdiscs stay attached to the link when it is moved into the container.
+func setBandwidthLimits(linkName string, limits *bandwidthLimits) error {
+	if limits == nil {
+		return nil
+	}
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s to apply bandwidth limits: %v", linkName, err)
+	}
+	if limits.EgressRate != 0 {
+		if err := addEgressTbf(link, limits.EgressRate, limits.EgressBurst); err != nil {
+			return fmt.Errorf("failed to set egress rate on %s: %v", linkName, err)
+		}
+		logrus.Debugf("Set egress rate %dbit burst %db on %s", limits.EgressRate, limits.EgressBurst, linkName)
+	}
+	if limits.IngressRate != 0 {
+		if err := addIngressPolice(link, limits.IngressRate, limits.IngressBurst); err != nil {
+			return fmt.Errorf("failed to set ingress rate on %s: %v", linkName, err)
+		}
+		logrus.Debugf("Set ingress rate %dbit burst %db on %s", limits.IngressRate, limits.IngressBurst, linkName)
+	}
+
+	return nil
+}
+
+// addEgressTbf replaces the root qdisc of the link with a token bucket filter
+func addEgressTbf(link netlink.Link, rate, burst uint64) error {
+	byteRate := rate / 8
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   byteRate,
+		Limit:  uint32(byteRate*tbfLatency/1000 + burst),
+		Buffer: uint32(netlink.Xmittime(byteRate, uint32(burst))),
+	}
+
+	return ns.NlHandle().QdiscReplace(tbf)
+}
+
+// addIngressPolice polices all the traffic received by the link with a
+// match-all u32 filter on the clsact ingress hook, dropping what exceeds the rate.
+func addIngressPolice(link netlink.Link, rate, burst uint64) error {
+	// borrow the rate table calculation of the fw filter, the vendored
+	// u32 filter cannot carry a policer
+	fw, err := netlink.NewFw(netlink.FilterAttrs{}, netlink.FilterFwAttrs{
+		Rate:   uint32(rate),
+		Buffer: uint32(burst),
+		Mtu:    policeMtu,
+		Action: netlink.TC_POLICE_SHOT,
+	})
+	if err != nil {
+		return err
+	}
+
+	return addU32Filter(link, clsactIngress, 1, syscall.ETH_P_ALL, func(options *nl.RtAttr) {
+		police := nl.NewRtAttrChild(options, nl.TCA_U32_POLICE, nil)
+		nl.NewRtAttrChild(police, nl.TCA_POLICE_TBF, fw.Police.Serialize())
+		nl.NewRtAttrChild(police, nl.TCA_POLICE_RATE, netlink.SerializeRtab(fw.Rtab))
+	})
+}
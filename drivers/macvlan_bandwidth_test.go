@@ -0,0 +1,123 @@
+package drivers
+
+import (
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	rates := map[string]uint64{
+		"800":       800,
+		"64kbit":    64000,
+		"100mbit":   100000000,
+		"1.5Gbit":   1500000000,
+		"10mbps":    80000000,
+		" 1kbps ":   8000,
+		"1000bit":   1000,
+		"0.001gbit": 1000000,
+	}
+	for s, bits := range rates {
+		v, err := parseRate(s)
+		assert.Nil(t, err, s)
+		assert.EqualValues(t, bits, v, s)
+	}
+	for _, s := range []string{"", "fast", "-1mbit", "0", "10mb", "4bit"} {
+		_, err := parseRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestParseBandwidthOptions(t *testing.T) {
+	limits, err := parseBandwidthOptions(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Nil(t, limits)
+
+	limits, err = parseBandwidthOptions(map[string]interface{}{
+		egressRateOpt:  "100mbit",
+		egressBurstOpt: "64k",
+		netlabel.GenericData: map[string]interface{}{
+			ingressRateOpt: "1mbit",
+		},
+	})
+	assert.Nil(t, err)
+	assert.EqualValues(t, &bandwidthLimits{
+		EgressRate:   100000000,
+		EgressBurst:  64 * 1024,
+		IngressRate:  1000000,
+		IngressBurst: minBurst,
+	}, limits)
+
+	_, err = parseBandwidthOptions(map[string]interface{}{
+		egressRateOpt: "lots",
+	})
+	assert.NotNil(t, err)
+
+	_, err = parseBandwidthOptions(map[string]interface{}{
+		ingressBurstOpt: "1m",
+	})
+	assert.EqualError(t, err, "macvlan.ingress_burst requires macvlan.ingress_rate to be set")
+
+	_, err = parseBandwidthOptions(map[string]interface{}{
+		ingressRateOpt: "10gbit",
+	})
+	assert.EqualError(t, err, `invalid macvlan.ingress_rate "10gbit": rate is too large for the ingress policer`)
+}
+
+func TestCreateEndpointWithBandwidth(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	r.Options[egressRateOpt] = "10mbit"
+	ep.limits = &bandwidthLimits{EgressRate: 10000000, EgressBurst: minBurst}
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.EqualValues(t, ep, d.networks[ep.nid].endpoints[ep.id])
+}
+
+func TestCreateEndpointWithInvalidBandwidth(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	r.Options[ingressRateOpt] = "4"
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, res)
+	assert.EqualError(t, err, `create endpoint was passed invalid bandwidth options: invalid macvlan.ingress_rate "4": rate must be at least 8bit`)
+}
+
+func TestJoinWithBandwidth(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ep.limits = &bandwidthLimits{EgressRate: 10000000, EgressBurst: minBurst}
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	jr := &pluginNet.JoinRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	res, err := d.Join(jr)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName)
+	assert.Nil(t, err)
+	defer ns.NlHandle().LinkDel(link)
+	qdiscs, err := ns.NlHandle().QdiscList(link)
+	assert.Nil(t, err)
+	types := []string{}
+	for _, q := range qdiscs {
+		types = append(types, q.Type())
+	}
+	assert.Contains(t, types, "tbf")
+}
+
+func TestMarshaJSONWithBandwidth(t *testing.T) {
+	_, _, _, ep := initEndpointData()
+	ep.limits = &bandwidthLimits{EgressRate: 10000000, EgressBurst: minBurst}
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	ep1 := &endpoint{}
+	err1 := ep1.UnmarshalJSON(b)
+	assert.Nil(t, err1)
+	assert.EqualValues(t, ep, ep1)
+}
@@ -0,0 +1,381 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ethernet frame offsets and values used by the capture filters
+const (
+	ethTypeOff  = 12
+	ethHdrLen   = 14
+	ethTypeIPv4 = 0x0800
+	ethTypeIPv6 = 0x86dd
+	ethTypeARP  = 0x0806
+
+	ipv4ProtoOff = ethHdrLen + 9
+	ipv4FragOff  = ethHdrLen + 6
+	ipv4SrcOff   = ethHdrLen + 12
+	ipv4DstOff   = ethHdrLen + 16
+	ipv6NextOff  = ethHdrLen + 6
+	ipv6SrcOff   = ethHdrLen + 8
+	ipv6DstOff   = ethHdrLen + 24
+	ipv6HdrLen   = 40
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// filterNode is a node of a parsed capture filter expression
+type filterNode interface {
+	// emit generates the code jumping to t when the packet matches, to f otherwise
+	emit(p *filterProgram, t, f int)
+}
+
+type andNode struct{ a, b filterNode }
+type orNode struct{ a, b filterNode }
+type notNode struct{ a filterNode }
+
+// testNode loads a packet field and compares it to k. Indexed loads are
+// relative to the end of the ipv4 header.
+type testNode struct {
+	size    uint16 // syscall.BPF_B, BPF_H or BPF_W
+	off     uint32
+	indexed bool
+	jset    bool // match when any bit of k is set rather than on equality
+	k       uint32
+}
+
+func (n *andNode) emit(p *filterProgram, t, f int) {
+	next := p.label()
+	n.a.emit(p, next, f)
+	p.place(next)
+	n.b.emit(p, t, f)
+}
+
+func (n *orNode) emit(p *filterProgram, t, f int) {
+	next := p.label()
+	n.a.emit(p, t, next)
+	p.place(next)
+	n.b.emit(p, t, f)
+}
+
+func (n *notNode) emit(p *filterProgram, t, f int) {
+	n.a.emit(p, f, t)
+}
+
+func (n *testNode) emit(p *filterProgram, t, f int) {
+	if n.indexed {
+		p.add(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, ethHdrLen, -1, -1)
+		p.add(syscall.BPF_LD|n.size|syscall.BPF_IND, ethHdrLen+n.off, -1, -1)
+	} else {
+		p.add(syscall.BPF_LD|n.size|syscall.BPF_ABS, n.off, -1, -1)
+	}
+	op := uint16(syscall.BPF_JEQ)
+	if n.jset {
+		op = syscall.BPF_JSET
+	}
+	p.add(syscall.BPF_JMP|op|syscall.BPF_K, n.k, t, f)
+}
+
+// filterProgram assembles the classic BPF code of an expression, jumps
+// target labels until the labels are placed
+type filterProgram struct {
+	insns  []syscall.SockFilter
+	jumps  [][2]int // the labels of the jumps of each instruction, -1 for none
+	labels []int    // the instruction of each label
+}
+
+func (p *filterProgram) add(code uint16, k uint32, t, f int) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: code, K: k})
+	p.jumps = append(p.jumps, [2]int{t, f})
+}
+
+func (p *filterProgram) label() int {
+	p.labels = append(p.labels, -1)
+	return len(p.labels) - 1
+}
+
+func (p *filterProgram) place(label int) {
+	p.labels[label] = len(p.insns)
+}
+
+// resolve turns the labels of the jumps into offsets
+func (p *filterProgram) resolve() error {
+	for i, j := range p.jumps {
+		if j[0] < 0 {
+			continue
+		}
+		for n, label := range j {
+			off := p.labels[label] - i - 1
+			if off < 0 || off > 255 {
+				return fmt.Errorf("filter expression is too long")
+			}
+			if n == 0 {
+				p.insns[i].Jt = uint8(off)
+			} else {
+				p.insns[i].Jf = uint8(off)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CompileFilter compiles a tcpdump like filter expression for the ethernet
+// frames of a capture. It supports the protocols ip, ip6, arp, tcp, udp,
+// icmp and icmp6, [src|dst] host ADDR and [tcp|udp] [src|dst] port N, combined with
+// and, or, not and parentheses. An empty expression accepts every frame.
+func CompileFilter(expr string, snaplen uint32) ([]syscall.SockFilter, error) {
+	p := &filterProgram{}
+	accept, reject := p.label(), p.label()
+	if strings.TrimSpace(expr) == "" {
+		p.add(syscall.BPF_RET|syscall.BPF_K, snaplen, -1, -1)
+		return p.insns, nil
+	}
+	parser := &filterParser{tokens: tokenizeFilter(expr)}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q in the filter expression", parser.tokens[parser.pos])
+	}
+	node.emit(p, accept, reject)
+	p.place(accept)
+	p.add(syscall.BPF_RET|syscall.BPF_K, snaplen, -1, -1)
+	p.place(reject)
+	p.add(syscall.BPF_RET|syscall.BPF_K, 0, -1, -1)
+	if err := p.resolve(); err != nil {
+		return nil, err
+	}
+
+	return p.insns, nil
+}
+
+func tokenizeFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+// filterParser is a recursive descent parser of the filter expressions
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = &orNode{node, b}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		b, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		node = &andNode{node, b}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in the filter expression")
+		}
+		return node, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("filter expression ends unexpectedly")
+	case "ip":
+		return etherType(ethTypeIPv4), nil
+	case "ip6":
+		return etherType(ethTypeIPv6), nil
+	case "arp":
+		return etherType(ethTypeARP), nil
+	case "tcp", "udp":
+		proto := uint32(protoTCP)
+		if tok == "udp" {
+			proto = protoUDP
+		}
+		if dir := p.direction(); dir != "" || p.peek() == "port" {
+			if tok := p.next(); tok != "port" {
+				return nil, fmt.Errorf("expected port rather than %q in the filter expression", tok)
+			}
+			return p.parsePort(dir, []uint32{proto})
+		}
+		return ipProto(proto), nil
+	case "icmp":
+		return &andNode{etherType(ethTypeIPv4), &testNode{size: syscall.BPF_B, off: ipv4ProtoOff, k: protoICMP}}, nil
+	case "icmp6":
+		return &andNode{etherType(ethTypeIPv6), &testNode{size: syscall.BPF_B, off: ipv6NextOff, k: protoICMPv6}}, nil
+	}
+	dir := ""
+	if tok == "src" || tok == "dst" {
+		dir, tok = tok, p.next()
+	}
+	switch tok {
+	case "host":
+		arg := p.next()
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q in the filter expression", arg)
+		}
+		return hostFilter(dir, ip), nil
+	case "port":
+		return p.parsePort(dir, []uint32{protoTCP, protoUDP})
+	}
+
+	return nil, fmt.Errorf("unknown %q in the filter expression", tok)
+}
+
+// direction consumes an optional src or dst qualifier
+func (p *filterParser) direction() string {
+	if tok := p.peek(); tok == "src" || tok == "dst" {
+		return p.next()
+	}
+	return ""
+}
+
+// parsePort parses the number of a port primitive of the transport protocols
+func (p *filterParser) parsePort(dir string, protos []uint32) (filterNode, error) {
+	arg := p.next()
+	port, err := strconv.ParseUint(arg, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in the filter expression", arg)
+	}
+
+	return portFilter(dir, protos, uint32(port)), nil
+}
+
+func etherType(t uint32) filterNode {
+	return &testNode{size: syscall.BPF_H, off: ethTypeOff, k: t}
+}
+
+// ipProto matches the transport protocol of ipv4 and ipv6 packets
+func ipProto(proto uint32) filterNode {
+	return &orNode{
+		&andNode{etherType(ethTypeIPv4), &testNode{size: syscall.BPF_B, off: ipv4ProtoOff, k: proto}},
+		&andNode{etherType(ethTypeIPv6), &testNode{size: syscall.BPF_B, off: ipv6NextOff, k: proto}},
+	}
+}
+
+// either matches the src test, the dst test or both for no direction
+func either(dir string, src, dst filterNode) filterNode {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return &orNode{src, dst}
+}
+
+func hostFilter(dir string, ip net.IP) filterNode {
+	if ip4 := ip.To4(); ip4 != nil {
+		k := binary.BigEndian.Uint32(ip4)
+		return &andNode{etherType(ethTypeIPv4), either(dir,
+			&testNode{size: syscall.BPF_W, off: ipv4SrcOff, k: k},
+			&testNode{size: syscall.BPF_W, off: ipv4DstOff, k: k})}
+	}
+	// compare the 4 words of the ipv6 address
+	match := func(off uint32) filterNode {
+		var node filterNode
+		for i := uint32(0); i < 4; i++ {
+			w := &testNode{size: syscall.BPF_W, off: off + 4*i, k: binary.BigEndian.Uint32(ip[4*i:])}
+			if node == nil {
+				node = w
+			} else {
+				node = &andNode{node, w}
+			}
+		}
+		return node
+	}
+	return &andNode{etherType(ethTypeIPv6), either(dir, match(ipv6SrcOff), match(ipv6DstOff))}
+}
+
+// portFilter matches the ports of the protocols in unfragmented ipv4 packets
+// and in ipv6 packets without extension headers
+func portFilter(dir string, protos []uint32, port uint32) filterNode {
+	transport := func(off uint32) filterNode {
+		var node filterNode
+		for _, proto := range protos {
+			t := &testNode{size: syscall.BPF_B, off: off, k: proto}
+			if node == nil {
+				node = t
+			} else {
+				node = &orNode{node, t}
+			}
+		}
+		return node
+	}
+	v4 := &andNode{&andNode{etherType(ethTypeIPv4), transport(ipv4ProtoOff)}, &andNode{
+		&notNode{&testNode{size: syscall.BPF_H, off: ipv4FragOff, jset: true, k: 0x1fff}},
+		either(dir,
+			&testNode{size: syscall.BPF_H, off: 0, indexed: true, k: port},
+			&testNode{size: syscall.BPF_H, off: 2, indexed: true, k: port}),
+	}}
+	v6 := &andNode{&andNode{etherType(ethTypeIPv6), transport(ipv6NextOff)}, either(dir,
+		&testNode{size: syscall.BPF_H, off: ethHdrLen + ipv6HdrLen, k: port},
+		&testNode{size: syscall.BPF_H, off: ethHdrLen + ipv6HdrLen + 2, k: port})}
+
+	return &orNode{v4, v6}
+}
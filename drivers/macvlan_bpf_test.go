@@ -0,0 +1,215 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileFilter(t *testing.T) {
+	insns, err := CompileFilter("", 96)
+	assert.Nil(t, err)
+	assert.Equal(t, []syscall.SockFilter{{Code: syscall.BPF_RET | syscall.BPF_K, K: 96}}, insns)
+
+	insns, err = CompileFilter("arp", 96)
+	assert.Nil(t, err)
+	assert.Equal(t, []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: ethTypeOff},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: ethTypeARP, Jt: 0, Jf: 1},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: 96},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+	}, insns)
+
+	insns, err = CompileFilter("not arp", 96)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(1), insns[1].Jt)
+	assert.Equal(t, uint8(0), insns[1].Jf)
+
+	for _, expr := range []string{"udp port 53", "src host 10.0.0.1 && !icmp", "(tcp or udp) and dst host fe80::1", "ip6 || dst port 80", "tcp dst port 443"} {
+		_, err := CompileFilter(expr, DefaultSnaplen)
+		assert.Nil(t, err, expr)
+	}
+
+	for _, c := range []struct {
+		expr string
+		err  string
+	}{
+		{"vlan", `unknown "vlan" in the filter expression`},
+		{"host 10.0.0", `invalid host "10.0.0" in the filter expression`},
+		{"port 70000", `invalid port "70000" in the filter expression`},
+		{"(tcp or udp", "missing ) in the filter expression"},
+		{"tcp and", "filter expression ends unexpectedly"},
+		{"tcp udp", `unexpected "udp" in the filter expression`},
+		{"udp src host 10.0.0.1", `expected port rather than "host" in the filter expression`},
+	} {
+		_, err := CompileFilter(c.expr, DefaultSnaplen)
+		assert.EqualError(t, err, c.err)
+	}
+}
+
+// runFilter interprets the classic BPF instructions the compiler emits and
+// returns the bytes of the frame the filter accepts
+func runFilter(t *testing.T, insns []syscall.SockFilter, frame []byte) uint32 {
+	var a, x uint32
+	load := func(size uint16, off uint32) (uint32, bool) {
+		n := map[uint16]uint32{syscall.BPF_B: 1, syscall.BPF_H: 2, syscall.BPF_W: 4}[size]
+		if off+n > uint32(len(frame)) {
+			return 0, false
+		}
+		switch size {
+		case syscall.BPF_B:
+			return uint32(frame[off]), true
+		case syscall.BPF_H:
+			return uint32(binary.BigEndian.Uint16(frame[off:])), true
+		}
+		return binary.BigEndian.Uint32(frame[off:]), true
+	}
+	for pc := 0; pc < len(insns); pc++ {
+		in := insns[pc]
+		switch code := in.Code; {
+		case code&^0x18 == syscall.BPF_LD|syscall.BPF_ABS, code&^0x18 == syscall.BPF_LD|syscall.BPF_IND:
+			off := in.K
+			if code&0xe0 == syscall.BPF_IND {
+				off += x
+			}
+			v, ok := load(code&0x18, off)
+			if !ok {
+				// the kernel drops the frame on a load past its end
+				return 0
+			}
+			a = v
+		case code == syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH:
+			if in.K >= uint32(len(frame)) {
+				return 0
+			}
+			x = 4 * uint32(frame[in.K]&0xf)
+		case code == syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, code == syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K:
+			match := a == in.K
+			if code&0xf0 == syscall.BPF_JSET {
+				match = a&in.K != 0
+			}
+			if match {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case code == syscall.BPF_RET|syscall.BPF_K:
+			return in.K
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", code, pc)
+		}
+	}
+	t.Fatalf("the filter ends without a return")
+	return 0
+}
+
+// testPacket builds an ethernet frame of the ether type around the payload
+func testPacket(etherType uint16, payload []byte) []byte {
+	frame := make([]byte, ethHdrLen, ethHdrLen+len(payload))
+	copy(frame, []byte{0x02, 0x42, 0, 0, 0, 1, 0x02, 0x42, 0, 0, 0, 2})
+	binary.BigEndian.PutUint16(frame[ethTypeOff:], etherType)
+	return append(frame, payload...)
+}
+
+// testPorts is the start of a tcp or udp header
+func testPorts(src, dst uint16) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, src)
+	binary.BigEndian.PutUint16(b[2:], dst)
+	return b
+}
+
+// testIPv4 builds an ipv4 frame with optWords words of options and the
+// fragment field frag
+func testIPv4(proto byte, src, dst string, optWords int, frag uint16, l4 []byte) []byte {
+	hdr := make([]byte, 20+4*optWords)
+	hdr[0] = 0x40 | byte(5+optWords)
+	binary.BigEndian.PutUint16(hdr[6:], frag)
+	hdr[8] = 64
+	hdr[9] = proto
+	copy(hdr[12:], net.ParseIP(src).To4())
+	copy(hdr[16:], net.ParseIP(dst).To4())
+	return testPacket(ethTypeIPv4, append(hdr, l4...))
+}
+
+func testIPv6(next byte, src, dst string, l4 []byte) []byte {
+	hdr := make([]byte, ipv6HdrLen)
+	hdr[0] = 0x60
+	hdr[6] = next
+	hdr[7] = 64
+	copy(hdr[8:], net.ParseIP(src))
+	copy(hdr[24:], net.ParseIP(dst))
+	return testPacket(ethTypeIPv6, append(hdr, l4...))
+}
+
+func TestCompileFilterMatches(t *testing.T) {
+	arp := testPacket(ethTypeARP, make([]byte, 28))
+	udp53 := testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 0, 0, testPorts(40000, 53))
+	// the options move the ports, a load at the fixed offset would read 53
+	// from the options of the second frame
+	udp53Opts := testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 1, 0, testPorts(40000, 53))
+	optsNot53 := testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 1, 0, testPorts(40000, 54))
+	binary.BigEndian.PutUint16(optsNot53[ethHdrLen+20+2:], 53)
+	// a later fragment carries no transport header
+	fragment := testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 0, 0x00b9, testPorts(40000, 53))
+	firstFragment := testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 0, 0x2000, testPorts(40000, 53))
+
+	for _, c := range []struct {
+		expr   string
+		frame  []byte
+		accept bool
+	}{
+		{"", arp, true},
+		{"arp", arp, true},
+		{"arp", udp53, false},
+		{"not arp", arp, false},
+		{"not arp", udp53, true},
+
+		{"udp port 53", udp53, true},
+		{"udp port 53", testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 0, 0, testPorts(53, 40000)), true},
+		{"udp port 53", testIPv4(protoUDP, "10.0.0.2", "10.0.0.3", 0, 0, testPorts(40000, 54)), false},
+		{"udp port 53", testIPv4(protoTCP, "10.0.0.2", "10.0.0.3", 0, 0, testPorts(40000, 53)), false},
+		{"udp port 53", udp53Opts, true},
+		{"udp port 53", optsNot53, false},
+		{"udp port 53", fragment, false},
+		{"udp port 53", firstFragment, true},
+		{"udp port 53", testIPv6(protoUDP, "fd00::2", "fd00::3", testPorts(40000, 53)), true},
+		{"udp port 53", testIPv6(protoTCP, "fd00::2", "fd00::3", testPorts(40000, 53)), false},
+		{"udp port 53", arp, false},
+		{"udp src port 53", udp53, false},
+		{"udp dst port 53", udp53Opts, true},
+		{"tcp dst port 443", testIPv4(protoTCP, "10.0.0.2", "10.0.0.3", 2, 0, testPorts(40000, 443)), true},
+		{"tcp dst port 443", testIPv4(protoTCP, "10.0.0.2", "10.0.0.3", 2, 0, testPorts(443, 40000)), false},
+		{"ip6 || dst port 80", testIPv6(protoICMPv6, "fd00::2", "fd00::3", nil), true},
+		{"ip6 || dst port 80", testIPv4(protoTCP, "10.0.0.2", "10.0.0.3", 0, 0, testPorts(40000, 80)), true},
+		{"ip6 || dst port 80", udp53, false},
+
+		{"src host 10.0.0.1 && !icmp", testIPv4(protoTCP, "10.0.0.1", "10.0.0.3", 0, 0, testPorts(40000, 80)), true},
+		{"src host 10.0.0.1 && !icmp", testIPv4(protoICMP, "10.0.0.1", "10.0.0.3", 0, 0, nil), false},
+		{"src host 10.0.0.1 && !icmp", testIPv4(protoTCP, "10.0.0.3", "10.0.0.1", 0, 0, testPorts(40000, 80)), false},
+		{"src host 10.0.0.1 && !icmp", testIPv6(protoTCP, "fd00::1", "fd00::3", testPorts(40000, 80)), false},
+		{"src host 10.0.0.1 && !icmp", arp, false},
+
+		{"host fd00::1", testIPv6(protoUDP, "fd00::1", "fd00::3", testPorts(40000, 53)), true},
+		{"host fd00::1", testIPv6(protoUDP, "fd00::3", "fd00::1", testPorts(40000, 53)), true},
+		{"host fd00::1", testIPv6(protoUDP, "fd00::3", "fd00:0:0:1::1", testPorts(40000, 53)), false},
+		{"host fd00::1", udp53, false},
+		{"dst host fd00::1", testIPv6(protoUDP, "fd00::1", "fd00::3", testPorts(40000, 53)), false},
+		{"(tcp or udp) and dst host fe80::1", testIPv6(protoTCP, "fe80::2", "fe80::1", testPorts(40000, 22)), true},
+		{"(tcp or udp) and dst host fe80::1", testIPv6(protoICMPv6, "fe80::2", "fe80::1", nil), false},
+		{"icmp6", testIPv6(protoICMPv6, "fe80::2", "fe80::1", nil), true},
+		{"icmp6", testIPv4(protoICMP, "10.0.0.2", "10.0.0.3", 0, 0, nil), false},
+	} {
+		insns, err := CompileFilter(c.expr, DefaultSnaplen)
+		assert.Nil(t, err, c.expr)
+		accepted := runFilter(t, insns, c.frame) == DefaultSnaplen
+		assert.Equal(t, c.accept, accepted, "%q on the frame %x", c.expr, c.frame)
+	}
+	// a frame shorter than the loads is rejected
+	insns, err := CompileFilter("udp port 53", DefaultSnaplen)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), runFilter(t, insns, udp53[:ethHdrLen+20+1]))
+}
@@ -0,0 +1,157 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	linkBridge   = "bridge" // a veth pair attached to a linux bridge enslaving the parent
+	bridgePrefix = "mb-"    // prefix of the bridges created by the driver
+	portPrefix   = "vbr"    // prefix of the host side of the veth pairs
+)
+
+// getBridgeName returns the name of the bridge the driver creates for the network
+func getBridgeName(netID string) string {
+	return fmt.Sprintf("%s%s", bridgePrefix, netID)
+}
+
+// setupBridge attaches the parent of a link_type=bridge network to a linux
+// bridge. A parent which is a bridge or already has a bridge master is
+// adopted, otherwise the driver creates a bridge and enslaves the parent.
+func (config *configuration) setupBridge() error {
+	parent, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		return fmt.Errorf("failed to find the parent link %s: %v", config.Parent, err)
+	}
+	if config.Bridge == "" {
+		if parent.Type() == linkBridge {
+			config.Bridge = config.Parent
+			return nil
+		}
+		if index := parent.Attrs().MasterIndex; index != 0 {
+			master, err := ns.NlHandle().LinkByIndex(index)
+			if err != nil {
+				return fmt.Errorf("failed to find the master of the parent link %s: %v", config.Parent, err)
+			}
+			if master.Type() != linkBridge {
+				return fmt.Errorf("parent link %s is enslaved to the %s link %s", config.Parent, master.Type(), master.Attrs().Name)
+			}
+			config.Bridge = master.Attrs().Name
+			logrus.Infof("Adopting the bridge %s of the parent link %s", config.Bridge, config.Parent)
+			return nil
+		}
+		config.Bridge = getBridgeName(stringid.TruncateID(config.ID))
+		config.CreatedBridge = true
+	}
+	if config.Bridge == config.Parent {
+		return nil
+	}
+
+	br, err := ns.NlHandle().LinkByName(config.Bridge)
+	if err != nil {
+		if !config.CreatedBridge {
+			return fmt.Errorf("bridge %s not found", config.Bridge)
+		}
+		br = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: config.Bridge}}
+		if err := ns.NlHandle().LinkAdd(br); err != nil {
+			return fmt.Errorf("failed to create the bridge %s: %v", config.Bridge, err)
+		}
+		logrus.Debugf("Added the bridge %s for the parent link %s", config.Bridge, config.Parent)
+	}
+	if parent.Attrs().MasterIndex != br.Attrs().Index {
+		if err := ns.NlHandle().LinkSetMasterByIndex(parent, br.Attrs().Index); err != nil {
+			return fmt.Errorf("failed to enslave the parent link %s to the bridge %s: %v", config.Parent, config.Bridge, err)
+		}
+	}
+	if err := ns.NlHandle().LinkSetUp(parent); err != nil {
+		return fmt.Errorf("failed to enable the parent link %s: %v", config.Parent, err)
+	}
+	if err := ns.NlHandle().LinkSetUp(br); err != nil {
+		return fmt.Errorf("failed to enable the bridge %s: %v", config.Bridge, err)
+	}
+
+	return nil
+}
+
+// delBridge deletes the bridge of the network when the driver created it,
+// which releases the parent
+func delBridge(config *configuration) error {
+	if !config.CreatedBridge {
+		return nil
+	}
+	br, err := ns.NlHandle().LinkByName(config.Bridge)
+	if err != nil {
+		return nil
+	}
+	if br.Type() != linkBridge {
+		return fmt.Errorf("link %s is not a bridge", config.Bridge)
+	}
+	if err := ns.NlHandle().LinkDel(br); err != nil {
+		return fmt.Errorf("failed to delete the bridge %s: %v", config.Bridge, err)
+	}
+	logrus.Debugf("Deleted the bridge %s", config.Bridge)
+
+	return nil
+}
+
+// createBridgePort creates the veth pair of an endpoint with the host side
+// attached to the bridge and returns the name of the container side
+func createBridgePort(containerIfName, bridge string, mac net.HardwareAddr, mtu int) (string, error) {
+	br, err := ns.NlHandle().LinkByName(bridge)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the bridge %s: %v", bridge, err)
+	}
+	hostIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), portPrefix, vethLen)
+	if err != nil {
+		return "", err
+	}
+	if err := netutils.CreateVethPair(hostIfName, containerIfName); err != nil {
+		return "", fmt.Errorf("failed to create the veth pair %s: %v", containerIfName, err)
+	}
+	if err := setupBridgePort(hostIfName, containerIfName, br, mac, mtu); err != nil {
+		netutils.DeleteVethPair(hostIfName, containerIfName)
+		return "", err
+	}
+
+	return containerIfName, nil
+}
+
+// setupBridgePort sets the mtu of both sides and the mac of the container
+// side, and brings the host side up on the bridge
+func setupBridgePort(hostIfName, containerIfName string, br netlink.Link, mac net.HardwareAddr, mtu int) error {
+	host, err := ns.NlHandle().LinkByName(hostIfName)
+	if err != nil {
+		return fmt.Errorf("failed to find the veth %s: %v", hostIfName, err)
+	}
+	container, err := ns.NlHandle().LinkByName(containerIfName)
+	if err != nil {
+		return fmt.Errorf("failed to find the veth %s: %v", containerIfName, err)
+	}
+	if mtu != 0 {
+		for _, link := range []netlink.Link{host, container} {
+			if err := ns.NlHandle().LinkSetMTU(link, mtu); err != nil {
+				return fmt.Errorf("failed to set the mtu of the veth %s: %v", link.Attrs().Name, err)
+			}
+		}
+	}
+	if mac != nil {
+		if err := ns.NlHandle().LinkSetHardwareAddr(container, mac); err != nil {
+			return fmt.Errorf("failed to set the mac of the veth %s: %v", containerIfName, err)
+		}
+	}
+	if err := ns.NlHandle().LinkSetMasterByIndex(host, br.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to attach the veth %s to the bridge %s: %v", hostIfName, br.Attrs().Name, err)
+	}
+	if err := ns.NlHandle().LinkSetUp(host); err != nil {
+		return fmt.Errorf("failed to enable the veth %s: %v", hostIfName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package drivers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink"
+)
+
+// initBridgeParent creates a veth pair standing for the parent nic
+func initBridgeParent(t *testing.T) func() {
+	assert.Nil(t, netutils.CreateVethPair("mbparent0", "mbparent1"))
+	return func() {
+		netutils.DeleteVethPair("mbparent0", "mbparent1")
+	}
+}
+
+func masterOf(t *testing.T, name string) string {
+	link, err := ns.NlHandle().LinkByName(name)
+	assert.Nil(t, err)
+	if link.Attrs().MasterIndex == 0 {
+		return ""
+	}
+	master, err := ns.NlHandle().LinkByIndex(link.Attrs().MasterIndex)
+	assert.Nil(t, err)
+	return master.Attrs().Name
+}
+
+func TestBridgeNetworkLifecycle(t *testing.T) {
+	defer initBridgeParent(t)()
+	ms, d, r, _ := initNetworkData()
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	ms.On("StoreDelete", mock.Anything).Return(nil)
+	r.Options[netlabel.GenericData] = map[string]string{parentOpt: "mbparent0", linkTypeOpt: linkBridge}
+	r.IPv4Data[0].Gateway = "192.168.1.1/24"
+	r.IPv6Data = nil
+	d.opts.DefaultMtu = 1400
+	assert.Nil(t, d.CreateNetwork(r))
+	defer func() {
+		if link, err := ns.NlHandle().LinkByName("mb-1"); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+	}()
+	config := d.networks[r.NetworkID].config
+	assert.Equal(t, "mb-1", config.Bridge)
+	assert.True(t, config.CreatedBridge)
+	assert.False(t, config.CreatedSlaveLink)
+	assert.Equal(t, "mb-1", masterOf(t, "mbparent0"))
+	assert.Nil(t, d.Revalidate())
+
+	// a retried create doesn't see the recorded bridge as a difference
+	assert.Nil(t, d.CreateNetwork(r))
+
+	res, err := d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: "1234567",
+		Interface:  &pluginNet.EndpointInterface{Address: "192.168.1.2/24"},
+	})
+	assert.Nil(t, err)
+	join, err := d.Join(&pluginNet.JoinRequest{NetworkID: r.NetworkID, EndpointID: "1234567"})
+	assert.Nil(t, err)
+	link, err := ns.NlHandle().LinkByName(join.InterfaceName.SrcName)
+	assert.Nil(t, err)
+	assert.Equal(t, "veth", link.Type())
+	assert.Equal(t, res.Interface.MacAddress, link.Attrs().HardwareAddr.String())
+	assert.Equal(t, 1400, link.Attrs().MTU)
+	peer, err := ns.NlHandle().LinkByIndex(link.Attrs().ParentIndex)
+	assert.Nil(t, err)
+	assert.Equal(t, "mb-1", masterOf(t, peer.Attrs().Name))
+
+	assert.Nil(t, d.DeleteNetwork(&pluginNet.DeleteNetworkRequest{NetworkID: r.NetworkID}))
+	_, err = ns.NlHandle().LinkByName(join.InterfaceName.SrcName)
+	assert.NotNil(t, err)
+	_, err = ns.NlHandle().LinkByName("mb-1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "", masterOf(t, "mbparent0"))
+}
+
+func TestBridgeNetworkAdoptsBridge(t *testing.T) {
+	defer initBridgeParent(t)()
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "mbtest"}}
+	assert.Nil(t, ns.NlHandle().LinkAdd(br))
+	defer ns.NlHandle().LinkDel(br)
+	parent, err := ns.NlHandle().LinkByName("mbparent0")
+	assert.Nil(t, err)
+	assert.Nil(t, ns.NlHandle().LinkSetMaster(parent, br))
+
+	for _, p := range []string{"mbparent0", "mbtest"} {
+		config := &configuration{ID: "1", Parent: p, LinkType: linkBridge}
+		assert.Nil(t, config.setupBridge())
+		assert.Equal(t, "mbtest", config.Bridge)
+		assert.False(t, config.CreatedBridge)
+		assert.Nil(t, delBridge(config))
+		_, err := ns.NlHandle().LinkByName("mbtest")
+		assert.Nil(t, err)
+	}
+}
+
+func TestBridgeNetworkRejectsOtherMaster(t *testing.T) {
+	defer initBridgeParent(t)()
+	bond := &netlink.Bond{LinkAttrs: netlink.LinkAttrs{Name: "mbbond"}, Mode: netlink.BOND_MODE_ACTIVE_BACKUP}
+	if err := ns.NlHandle().LinkAdd(bond); err != nil {
+		t.Skipf("bond links are not supported: %v", err)
+	}
+	defer ns.NlHandle().LinkDel(bond)
+	parent, err := ns.NlHandle().LinkByName("mbparent0")
+	assert.Nil(t, err)
+	assert.Nil(t, ns.NlHandle().LinkSetMasterByIndex(parent, bond.Attrs().Index))
+
+	config := &configuration{ID: "1", Parent: "mbparent0", LinkType: linkBridge}
+	assert.EqualError(t, config.setupBridge(), "parent link mbparent0 is enslaved to the bond link mbbond")
+}
+
+func TestCreateNetworkStoreFailureDeletesBridge(t *testing.T) {
+	defer initBridgeParent(t)()
+	ms, d, r, _ := initNetworkData()
+	ms.On("StoreUpdate", mock.Anything).Return(errors.New("store is unavailable"))
+	r.Options[netlabel.GenericData] = map[string]string{parentOpt: "mbparent0", linkTypeOpt: linkBridge}
+	r.IPv6Data = nil
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "CreateNetwork failed to store the network 1: store is unavailable")
+	assert.Empty(t, d.networks)
+	// the retry creates the bridge again rather than adopting it
+	_, err = ns.NlHandle().LinkByName("mb-1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "", masterOf(t, "mbparent0"))
+}
+
+func TestCreateNetworkBridgeFailureDeletesBridge(t *testing.T) {
+	defer initBridgeParent(t)()
+	parent, err := ns.NlHandle().LinkByName("mbparent0")
+	assert.Nil(t, err)
+	// a parent carrying a macvlan link can't be enslaved to a bridge
+	slave := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "mbmv0", ParentIndex: parent.Attrs().Index}}
+	assert.Nil(t, ns.NlHandle().LinkAdd(slave))
+	defer ns.NlHandle().LinkDel(slave)
+	ms, d, r, _ := initNetworkData()
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	r.Options[netlabel.GenericData] = map[string]string{parentOpt: "mbparent0", linkTypeOpt: linkBridge}
+	r.IPv6Data = nil
+	err = d.CreateNetwork(r)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to enslave the parent link mbparent0 to the bridge mb-1")
+	assert.Empty(t, d.networks)
+	// the retry creates the bridge again rather than adopting it
+	_, err = ns.NlHandle().LinkByName("mb-1")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,153 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapLinkEthernet = 1
+	ethPAll          = 0x0003 // ETH_P_ALL
+
+	// DefaultSnaplen captures whole frames
+	DefaultSnaplen = 65535
+)
+
+// captureWakeup is how often a blocked read checks for the end of the capture
+var captureWakeup = 200 * time.Millisecond
+
+// CaptureOptions selects the frames of a capture
+type CaptureOptions struct {
+	Filter  string // filter expression, see CompileFilter
+	Snaplen uint32 // bytes kept of each frame
+	Count   int    // frames to capture, 0 until Stop is closed
+	Stop    <-chan struct{}
+}
+
+// Capture writes the frames of the interface with the mac in the sandbox
+// to w as a pcap stream. The packet socket is opened in the sandbox, which
+// sees the traffic of the slave the host can't see on the parent.
+func Capture(sandboxKey, mac string, opts CaptureOptions, w io.Writer) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid mac address %s: %v", mac, err)
+	}
+	if opts.Snaplen == 0 {
+		opts.Snaplen = DefaultSnaplen
+	}
+	filter, err := CompileFilter(opts.Filter, opts.Snaplen)
+	if err != nil {
+		return err
+	}
+	var fd int
+	err = inSandbox(sandboxKey, func() error {
+		fd, err = openCapture(hw, filter)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return writePcap(fd, opts, w)
+}
+
+// openCapture opens a packet socket bound to the interface with the mac of
+// the current namespace
+func openCapture(mac net.HardwareAddr, filter []syscall.SockFilter) (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return -1, err
+	}
+	var link netlink.Link
+	for _, l := range links {
+		if l.Attrs().HardwareAddr.String() == mac.String() {
+			link = l
+			break
+		}
+	}
+	if link == nil {
+		return -1, fmt.Errorf("no interface with the mac %s in the sandbox", mac)
+	}
+	// no protocol until the bind, the socket doesn't receive the frames of
+	// the other interfaces meanwhile
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open a packet socket: %v", err)
+	}
+	tv := syscall.NsecToTimeval(captureWakeup.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to set the read timeout of the packet socket: %v", err)
+	}
+	if err := syscall.AttachLsf(fd, filter); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to attach the capture filter: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: link.Attrs().Index}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to bind the packet socket to %s: %v", link.Attrs().Name, err)
+	}
+
+	return fd, nil
+}
+
+// writePcap writes the pcap header and the frames read from the socket
+func writePcap(fd int, opts CaptureOptions, w io.Writer) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], opts.Snaplen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkEthernet)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	buf := make([]byte, opts.Snaplen)
+	rec := make([]byte, 16)
+	for i := 0; opts.Count == 0 || i < opts.Count; i++ {
+		// checked before every read, a steady flow of frames never times out
+		select {
+		case <-opts.Stop:
+			return nil
+		default:
+		}
+		// MSG_TRUNC returns the length of the frame rather than of the read
+		n, _, err := syscall.Recvfrom(fd, buf, syscall.MSG_TRUNC)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			i--
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the packet socket: %v", err)
+		}
+		now := time.Now()
+		caplen := n
+		if caplen > len(buf) {
+			caplen = len(buf)
+		}
+		binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(caplen))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(n))
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:caplen]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,138 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// testFrame builds an ethernet frame of the ethertype, an ipv4 udp packet
+// to the port for udp
+func testFrame(dst, src net.HardwareAddr, ethType uint16, port uint16) []byte {
+	frame := append(append([]byte{}, dst...), src...)
+	frame = append(frame, byte(ethType>>8), byte(ethType))
+	if ethType != ethTypeIPv4 {
+		return append(frame, make([]byte, 28)...)
+	}
+	ip := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, protoUDP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	udp := []byte{0x04, 0xd2, byte(port >> 8), byte(port), 0, 8, 0, 0}
+	return append(append(frame, ip...), udp...)
+}
+
+// recordWriter signals the records written after the pcap header
+type recordWriter struct {
+	writes  int
+	records chan struct{}
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if w.writes++; w.writes > 1 {
+		select {
+		case w.records <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func TestCapture(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	assert.Nil(t, netutils.CreateVethPair("mvcap0", "mvcap1"))
+	defer netutils.DeleteVethPair("mvcap0", "mvcap1")
+	host, err := ns.NlHandle().LinkByName("mvcap0")
+	assert.Nil(t, err)
+	peer, err := ns.NlHandle().LinkByName("mvcap1")
+	assert.Nil(t, err)
+	sbox, err := netns.GetFromPath(sandboxKey)
+	assert.Nil(t, err)
+	defer sbox.Close()
+	assert.Nil(t, ns.NlHandle().LinkSetNsFd(peer, int(sbox)))
+	h, err := netlink.NewHandleAt(sbox)
+	assert.Nil(t, err)
+	defer h.Delete()
+	peer, err = h.LinkByName("mvcap1")
+	assert.Nil(t, err)
+	assert.Nil(t, h.LinkSetUp(peer))
+	assert.Nil(t, ns.NlHandle().LinkSetUp(host))
+
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		opts := CaptureOptions{Filter: "udp port 53", Count: 1}
+		done <- Capture(sandboxKey, peer.Attrs().HardwareAddr.String(), opts, &out)
+	}()
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	assert.Nil(t, err)
+	defer syscall.Close(fd)
+	to := &syscall.SockaddrLinklayer{Ifindex: host.Attrs().Index, Halen: 6}
+	dst, src := peer.Attrs().HardwareAddr, host.Attrs().HardwareAddr
+	dns := testFrame(dst, src, ethTypeIPv4, 53)
+	// send until the capture is open, the frames not matching the filter first
+	deadline := time.After(10 * time.Second)
+	for captured := false; !captured; {
+		for _, frame := range [][]byte{testFrame(dst, src, ethTypeARP, 0), testFrame(dst, src, ethTypeIPv4, 80), dns} {
+			assert.Nil(t, syscall.Sendto(fd, frame, 0, to))
+		}
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+			captured = true
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no frame captured")
+		}
+	}
+
+	b := out.Bytes()
+	assert.Equal(t, 24+16+len(dns), len(b))
+	assert.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(b[0:]))
+	assert.Equal(t, uint32(DefaultSnaplen), binary.LittleEndian.Uint32(b[16:]))
+	assert.Equal(t, uint32(pcapLinkEthernet), binary.LittleEndian.Uint32(b[20:]))
+	assert.Equal(t, uint32(len(dns)), binary.LittleEndian.Uint32(b[32:]))
+	assert.Equal(t, dns, b[40:])
+
+	// a capture without count ends when stopped, also while frames keep coming
+	stop := make(chan struct{})
+	w := &recordWriter{records: make(chan struct{}, 1)}
+	go func() {
+		done <- Capture(sandboxKey, peer.Attrs().HardwareAddr.String(), CaptureOptions{Stop: stop}, w)
+	}()
+	sending := make(chan struct{})
+	defer close(sending)
+	go func() {
+		for {
+			select {
+			case <-sending:
+				return
+			default:
+			}
+			syscall.Sendto(fd, dns, 0, to)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-w.records:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no frame captured")
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture not stopped")
+	}
+
+	assert.Contains(t, Capture(sandboxKey, "02:00:00:00:00:01", CaptureOptions{}, &out).Error(), "no interface with the mac 02:00:00:00:00:01")
+}
@@ -0,0 +1,330 @@
+package drivers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/parsers/kernel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	capNetAdmin = 12 // CAP_NET_ADMIN bit of the capability sets
+)
+
+// paths read by the checks, variables so the tests can point them elsewhere
+var (
+	sysModuleDir   = "/sys/module"
+	libModulesDir  = "/lib/modules"
+	sysClassNetDir = "/sys/class/net"
+	procSelfStatus = "/proc/self/status"
+)
+
+// CheckStatus is the outcome of a preflight check
+type CheckStatus string
+
+// check outcomes, a warning does not fail the preflight and a check is
+// skipped when one it depends on failed
+const (
+	CheckPass CheckStatus = "PASS"
+	CheckWarn CheckStatus = "WARN"
+	CheckFail CheckStatus = "FAIL"
+	CheckSkip CheckStatus = "SKIP"
+)
+
+// CheckResult is a preflight check outcome with a hint to fix a failure
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+	Hint   string
+}
+
+func pass(name, detail string) *CheckResult {
+	return &CheckResult{Name: name, Status: CheckPass, Detail: detail}
+}
+
+func warn(name, detail, hint string) *CheckResult {
+	return &CheckResult{Name: name, Status: CheckWarn, Detail: detail, Hint: hint}
+}
+
+func fail(name, detail, hint string) *CheckResult {
+	return &CheckResult{Name: name, Status: CheckFail, Detail: detail, Hint: hint}
+}
+
+func skip(name, detail string) *CheckResult {
+	return &CheckResult{Name: name, Status: CheckSkip, Detail: detail}
+}
+
+// Preflight verifies the host can run the driver: kernel version, kernel
+// modules, capabilities, the local store and, for every parent given, its
+// state and conflicts. promisc toggles promiscuous mode on the parents to
+// verify they support it.
+func Preflight(opts Options, parents []string, promisc bool) []*CheckResult {
+	results := []*CheckResult{checkKernel()}
+	for _, m := range []string{"macvlan", "8021q", "dummy"} {
+		results = append(results, checkModule(m))
+	}
+	results = append(results, checkCapability(), checkStore(opts))
+	for _, p := range parents {
+		results = append(results, checkParent(p, promisc)...)
+	}
+
+	return results
+}
+
+// StoredParents returns the parents of the networks in the store, for the
+// preflight of a starting driver. The dummy links of internal networks are
+// left out, the driver recreates them when it restores the networks.
+func StoredParents(opts Options) ([]string, error) {
+	configs, _, err := readRecords(opts)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var parents []string
+	for _, config := range configs {
+		if (config.Internal && config.CreatedSlaveLink) || seen[config.Parent] {
+			continue
+		}
+		seen[config.Parent] = true
+		parents = append(parents, config.Parent)
+	}
+	sort.Strings(parents)
+
+	return parents, nil
+}
+
+// PreflightFailed returns whether a check failed
+func PreflightFailed(results []*CheckResult) bool {
+	for _, r := range results {
+		if r.Status == CheckFail {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkKernel() *CheckResult {
+	name := "kernel version"
+	v, err := kernel.GetKernelVersion()
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	if kernel.CompareKernelVersion(*v, kernel.VersionInfo{Kernel: macvlanKernelVer, Major: macvlanMajorVer}) < 0 {
+		return fail(name, fmt.Sprintf("%s is older than %d.%d", v, macvlanKernelVer, macvlanMajorVer),
+			fmt.Sprintf("upgrade to a kernel %d.%d or later", macvlanKernelVer, macvlanMajorVer))
+	}
+
+	return pass(name, fmt.Sprintf("%s >= %d.%d", v, macvlanKernelVer, macvlanMajorVer))
+}
+
+// checkModule looks for a loaded, builtin or loadable kernel module
+func checkModule(module string) *CheckResult {
+	name := "module " + module
+	if _, err := os.Stat(filepath.Join(sysModuleDir, module)); err == nil {
+		return pass(name, "loaded")
+	}
+	v, err := kernel.GetKernelVersion()
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	release := filepath.Join(libModulesDir, v.String())
+	if moduleListed(filepath.Join(release, "modules.builtin"), module) {
+		return pass(name, "builtin")
+	}
+	if moduleListed(filepath.Join(release, "modules.dep"), module) {
+		return warn(name, "not loaded, the kernel loads it on first use", "modprobe "+module)
+	}
+	if _, err := os.Stat(release); err != nil {
+		// no module tree, ex. in a container, the module may still be builtin
+		return warn(name, fmt.Sprintf("unknown, %s not found", release), "run the doctor on the host")
+	}
+
+	return fail(name, "not found", fmt.Sprintf("install the kernel modules package providing %s.ko", module))
+}
+
+// moduleListed returns whether a modules.builtin or modules.dep file lists
+// the module, ex. kernel/drivers/net/macvlan.ko: ...
+func moduleListed(path, module string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		entry := strings.SplitN(s.Text(), ":", 2)[0]
+		base := filepath.Base(entry)
+		base = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(base, ".xz"), ".gz"), ".ko")
+		if strings.Replace(base, "-", "_", -1) == module {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkCapability() *CheckResult {
+	name := "CAP_NET_ADMIN"
+	f, err := os.Open(procSelfStatus)
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+		caps, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return fail(name, fmt.Sprintf("invalid CapEff %s", fields[1]), "")
+		}
+		if caps&(1<<capNetAdmin) == 0 {
+			return fail(name, "not in the effective capabilities", "run as root or grant CAP_NET_ADMIN to the plugin")
+		}
+		return pass(name, "effective")
+	}
+
+	return fail(name, "CapEff not found in "+procSelfStatus, "")
+}
+
+func checkStore(opts Options) *CheckResult {
+	name := "local store"
+	if opts.storeBackend() != storeBoltDB {
+		name = opts.storeBackend() + " store"
+		ds, err := openStore(opts)
+		if err != nil {
+			return fail(name, err.Error(), "check the store address and that the servers are up")
+		}
+		ds.Close()
+		return pass(name, "reachable")
+	}
+	path := opts.StorePath
+	if path == "" {
+		path = DefaultStorePath()
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		dir := filepath.Dir(path)
+		if err := dirWritable(dir); err != nil {
+			return fail(name, fmt.Sprintf("%s does not exist and can't be created: %v", path, err),
+				fmt.Sprintf("create %s or set --store-path", dir))
+		}
+		return pass(name, path+" will be created")
+	}
+	if _, err := ReadStoreState(opts); err != nil {
+		return fail(name, err.Error(), "check the file permissions and that no other process holds the store")
+	}
+
+	return pass(name, path+" readable")
+}
+
+// dirWritable returns nil when the closest existing ancestor of dir can be written
+func dirWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			f, err := os.Create(filepath.Join(dir, ".macvlan-doctor"))
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
+
+// checkParent verifies a parent link exists with carrier, supports
+// promiscuous mode and has no ipvlan slaves, which can't share a parent with
+// macvlan slaves. For a vlan parent the driver creates, the checks apply to
+// the underlying link.
+func checkParent(parent string, promisc bool) []*CheckResult {
+	name := "parent " + parent
+	link, err := ns.NlHandle().LinkByName(parent)
+	if err != nil && strings.Contains(parent, ".") {
+		if base, _, verr := parseVlan(parent); verr == nil {
+			if link, err = ns.NlHandle().LinkByName(base); err == nil {
+				name = fmt.Sprintf("parent %s (vlan link created on %s)", parent, base)
+			}
+		}
+	}
+	if err != nil {
+		return []*CheckResult{fail(name, "not found", "check the -o parent of the network, ex. ip link show")}
+	}
+	attrs := link.Attrs()
+	results := []*CheckResult{pass(name, "exists")}
+
+	results = append(results, checkCarrier(name+" carrier", attrs))
+
+	if _, err := os.Stat(filepath.Join(sysClassNetDir, attrs.Name, "wireless")); err == nil {
+		results = append(results, fail(name+" promiscuous mode", "wireless links can't carry macvlan slaves", "use a wired parent"))
+	} else if promisc {
+		results = append(results, checkPromisc(name, link))
+	}
+
+	links, err := ns.NlHandle().LinkList()
+	if err != nil {
+		return append(results, fail(name+" ipvlan slaves", err.Error(), ""))
+	}
+	var slaves []string
+	for _, l := range links {
+		if l.Type() == "ipvlan" && l.Attrs().ParentIndex == attrs.Index {
+			slaves = append(slaves, l.Attrs().Name)
+		}
+	}
+	if len(slaves) > 0 {
+		results = append(results, fail(name+" ipvlan slaves", strings.Join(slaves, ", "),
+			"remove the ipvlan networks using "+attrs.Name+" or pick another parent"))
+	} else {
+		results = append(results, pass(name+" ipvlan slaves", "none"))
+	}
+
+	return results
+}
+
+// checkCarrier verifies a link is up with carrier
+func checkCarrier(name string, attrs *netlink.LinkAttrs) *CheckResult {
+	switch {
+	case attrs.Flags&net.FlagUp == 0:
+		return fail(name, "link is down", "ip link set "+attrs.Name+" up")
+	case attrs.OperState == netlink.OperDown || attrs.OperState == netlink.OperLowerLayerDown:
+		return fail(name, "no carrier", "check the cabling or the switch port of "+attrs.Name)
+	}
+
+	return pass(name, attrs.OperState.String())
+}
+
+// checkPromisc turns promiscuous mode on and restores the link, unless it
+// already is promiscuous
+func checkPromisc(name string, link netlink.Link) *CheckResult {
+	name += " promiscuous mode"
+	if link.Attrs().Promisc == 1 {
+		return pass(name, "enabled")
+	}
+	if err := ns.NlHandle().SetPromiscOn(link); err != nil {
+		return fail(name, err.Error(), "the parent driver must accept several unicast addresses")
+	}
+	if err := ns.NlHandle().SetPromiscOff(link); err != nil {
+		return warn(name, "supported but could not be turned back off: "+err.Error(), "ip link set "+link.Attrs().Name+" promisc off")
+	}
+
+	return pass(name, "supported")
+}
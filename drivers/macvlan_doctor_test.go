@@ -0,0 +1,92 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckKernel(t *testing.T) {
+	// the tests create macvlan links, the kernel running them is recent enough
+	assert.Equal(t, CheckPass, checkKernel().Status)
+}
+
+func TestModuleListed(t *testing.T) {
+	f, err := ioutil.TempFile("", "modules.dep")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("kernel/drivers/net/macvlan.ko.xz:\nkernel/net/8021q/8021q.ko: kernel/net/802/garp.ko\n")
+	f.Close()
+	assert.True(t, moduleListed(f.Name(), "macvlan"))
+	assert.True(t, moduleListed(f.Name(), "8021q"))
+	assert.False(t, moduleListed(f.Name(), "dummy"))
+	assert.False(t, moduleListed("/nonexistent", "dummy"))
+}
+
+func TestCheckModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmodule")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { sysModuleDir = d }(sysModuleDir)
+	sysModuleDir = dir
+	os.Mkdir(filepath.Join(dir, "macvlan"), 0755)
+	assert.Equal(t, pass("module macvlan", "loaded"), checkModule("macvlan"))
+}
+
+func TestCheckCapability(t *testing.T) {
+	f, err := ioutil.TempFile("", "status")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer func(p string) { procSelfStatus = p }(procSelfStatus)
+	procSelfStatus = f.Name()
+
+	ioutil.WriteFile(f.Name(), []byte("Name:\tdocker-macvlan\nCapEff:\t0000000000001000\n"), 0644)
+	assert.Equal(t, CheckPass, checkCapability().Status)
+	ioutil.WriteFile(f.Name(), []byte("Name:\tdocker-macvlan\nCapEff:\t0000000000000000\n"), 0644)
+	assert.Equal(t, fail("CAP_NET_ADMIN", "not in the effective capabilities", "run as root or grant CAP_NET_ADMIN to the plugin"), checkCapability())
+}
+
+func TestCheckStore(t *testing.T) {
+	dir, d := initStoreFile(t)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, CheckPass, checkStore(Options{StorePath: filepath.Join(dir, "new", "local-kv.db")}).Status)
+	_, _, _, ep := initEndpointData()
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	assert.Equal(t, pass("local store", d.opts.StorePath+" readable"), checkStore(d.opts))
+	assert.Nil(t, d.Close())
+}
+
+func TestCheckParent(t *testing.T) {
+	rs := checkParent("eth0", false)
+	assert.False(t, PreflightFailed(rs))
+	rs = checkParent("eth0.10", false)
+	assert.Equal(t, "parent eth0.10 (vlan link created on eth0)", rs[0].Name)
+	rs = checkParent("missing0", false)
+	assert.True(t, PreflightFailed(rs))
+	assert.Equal(t, "not found", rs[0].Detail)
+}
+
+func TestStoredParents(t *testing.T) {
+	opts := Options{StoreBackend: storeMemory, StoreAddress: "TestStoredParents"}
+	d := NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	for _, config := range []*configuration{
+		{ID: "1", Parent: "eth1"},
+		{ID: "2", Parent: "eth0.10", CreatedSlaveLink: true},
+		{ID: "3", Parent: "eth1"},
+		{ID: "4", Parent: "dm-4", Internal: true, CreatedSlaveLink: true},
+	} {
+		config.Ipv4Subnets = []*ipv4Subnet{{SubnetIP: "192.168.1.0/24", GwIP: "192.168.1.1/24"}}
+		assert.Nil(t, d.store.StoreUpdate(config))
+	}
+	assert.Nil(t, d.Close())
+
+	parents, err := StoredParents(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"eth0.10", "eth1"}, parents)
+	_, err = StoredParents(Options{StorePath: "/nonexistent/local-kv.db"})
+	assert.NotNil(t, err)
+}
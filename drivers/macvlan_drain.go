@@ -0,0 +1,208 @@
+package drivers
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+)
+
+// errDraining is returned for requests arriving once shutdown started, the
+// daemon may retry them against the restarted plugin
+var errDraining = types.NoServiceErrorf("%s plugin is shutting down", macvlanType)
+
+// Drainer wraps a driver and tracks the requests in flight so a shutdown
+// can let them complete before the store is closed
+type Drainer struct {
+	driver   pluginNet.Driver
+	inflight sync.WaitGroup
+	mu       sync.RWMutex
+	draining bool
+}
+
+// NewDrainer returns a Drainer forwarding requests to driver
+func NewDrainer(driver pluginNet.Driver) *Drainer {
+	return &Drainer{driver: driver}
+}
+
+func (dr *Drainer) enter() error {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	if dr.draining {
+		return errDraining
+	}
+	dr.inflight.Add(1)
+
+	return nil
+}
+
+// Drain rejects new requests and waits up to timeout for the ones in flight,
+// returning an error if they did not complete in time
+func (dr *Drainer) Drain(timeout time.Duration) error {
+	dr.mu.Lock()
+	dr.draining = true
+	dr.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		dr.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("requests still in flight after %s", timeout)
+	}
+}
+
+// GetCapabilities ...
+func (dr *Drainer) GetCapabilities() (*pluginNet.CapabilitiesResponse, error) {
+	if err := dr.enter(); err != nil {
+		return nil, err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.GetCapabilities()
+}
+
+// CreateNetwork ...
+func (dr *Drainer) CreateNetwork(r *pluginNet.CreateNetworkRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.CreateNetwork(r)
+}
+
+// AllocateNetwork ...
+func (dr *Drainer) AllocateNetwork(r *pluginNet.AllocateNetworkRequest) (*pluginNet.AllocateNetworkResponse, error) {
+	if err := dr.enter(); err != nil {
+		return nil, err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.AllocateNetwork(r)
+}
+
+// DeleteNetwork ...
+func (dr *Drainer) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.DeleteNetwork(r)
+}
+
+// FreeNetwork ...
+func (dr *Drainer) FreeNetwork(r *pluginNet.FreeNetworkRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.FreeNetwork(r)
+}
+
+// CreateEndpoint ...
+func (dr *Drainer) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.CreateEndpointResponse, error) {
+	if err := dr.enter(); err != nil {
+		return nil, err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.CreateEndpoint(r)
+}
+
+// DeleteEndpoint ...
+func (dr *Drainer) DeleteEndpoint(r *pluginNet.DeleteEndpointRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.DeleteEndpoint(r)
+}
+
+// EndpointInfo ...
+func (dr *Drainer) EndpointInfo(r *pluginNet.InfoRequest) (*pluginNet.InfoResponse, error) {
+	if err := dr.enter(); err != nil {
+		return nil, err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.EndpointInfo(r)
+}
+
+// Join ...
+func (dr *Drainer) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error) {
+	if err := dr.enter(); err != nil {
+		return nil, err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.Join(r)
+}
+
+// Leave ...
+func (dr *Drainer) Leave(r *pluginNet.LeaveRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.Leave(r)
+}
+
+// DiscoverNew ...
+func (dr *Drainer) DiscoverNew(r *pluginNet.DiscoveryNotification) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.DiscoverNew(r)
+}
+
+// DiscoverDelete ...
+func (dr *Drainer) DiscoverDelete(r *pluginNet.DiscoveryNotification) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.DiscoverDelete(r)
+}
+
+// ProgramExternalConnectivity ...
+func (dr *Drainer) ProgramExternalConnectivity(r *pluginNet.ProgramExternalConnectivityRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.ProgramExternalConnectivity(r)
+}
+
+// RevokeExternalConnectivity ...
+func (dr *Drainer) RevokeExternalConnectivity(r *pluginNet.RevokeExternalConnectivityRequest) error {
+	if err := dr.enter(); err != nil {
+		return err
+	}
+	defer dr.inflight.Done()
+
+	return dr.driver.RevokeExternalConnectivity(r)
+}
+
+// WriteMetrics forwards to the driver when it exports metrics, metrics stay
+// readable while draining
+func (dr *Drainer) WriteMetrics(w io.Writer) {
+	if m, ok := dr.driver.(MetricsWriter); ok {
+		m.WriteMetrics(w)
+	}
+}
@@ -0,0 +1,47 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingDriver holds Join requests until released
+type blockingDriver struct {
+	*Driver
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingDriver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error) {
+	close(b.entered)
+	<-b.release
+	return &pluginNet.JoinResponse{}, nil
+}
+
+func TestDrainWaitsForInflight(t *testing.T) {
+	_, d, _, _ := initEndpointData()
+	b := &blockingDriver{Driver: d, entered: make(chan struct{}), release: make(chan struct{})}
+	dr := NewDrainer(b)
+	go dr.Join(&pluginNet.JoinRequest{})
+	<-b.entered
+
+	assert.EqualError(t, dr.Drain(10*time.Millisecond), "requests still in flight after 10ms")
+	_, err := dr.GetCapabilities()
+	assert.Equal(t, errDraining, err)
+
+	close(b.release)
+	assert.Nil(t, dr.Drain(time.Second))
+}
+
+func TestDrainWithoutInflight(t *testing.T) {
+	_, d, _, _ := initEndpointData()
+	dr := NewDrainer(d)
+	res, err := dr.GetCapabilities()
+	assert.Nil(t, err)
+	assert.Equal(t, pluginNet.GlobalScope, res.Scope)
+	assert.Nil(t, dr.Drain(time.Second))
+	assert.Equal(t, errDraining, dr.Leave(&pluginNet.LeaveRequest{}))
+}
@@ -6,10 +6,10 @@ import (
 	"net"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
 	pluginNet "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/netlabel"
-	"github.com/docker/libnetwork/netutils"
 	"github.com/docker/libnetwork/ns"
 	"github.com/docker/libnetwork/osl"
 	"github.com/docker/libnetwork/types"
@@ -17,6 +17,7 @@ import (
 
 const (
 	macvlanPrefix         = "macvlan"
+	macvlanNetworkPrefix  = macvlanPrefix + "/network"
 	macvlanEndpointPrefix = macvlanPrefix + "/endpoint"
 )
 
@@ -27,6 +28,12 @@ type endpoint struct {
 	addr     *net.IPNet
 	addrv6   *net.IPNet
 	srcName  string
+	limits   *bandwidthLimits
+	routes   []*staticRoute
+	tap      *tapDevice
+	labels   map[string]string // container and service labels of the endpoint options
+	sandbox  *sandboxInfo      // the namespace the endpoint joined
+	tuning   *ifaceTuning      // container side settings overriding the network ones
 	dbIndex  uint64
 	dbExists bool
 }
@@ -39,26 +46,27 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 	if networkID == "" {
 		str := "invalid network id passed while create macvlan endpoint"
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
 	}
 	endpointID := r.EndpointID
 	if endpointID == "" {
 		str := "invalid endpoint id passed while create macvlan endpoint"
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
 	}
 	intf := r.Interface
 	if intf == nil {
 		str := "invalid interface passed while create macvlan endpoint"
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
 	}
-	n, ok := d.networks[networkID]
-	if !ok {
+	n, err := d.getNetwork(networkID)
+	if err != nil || !d.acquire(n) {
 		str := fmt.Sprintf("macvlan network with id %s not found", networkID)
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.NotFoundErrorf("%s", str)
 	}
+	defer n.release()
 	var addrNet, addrv6Net *net.IPNet
 	addr, mask, _ := net.ParseCIDR(intf.Address)
 	if addr != nil && mask != nil {
@@ -75,20 +83,66 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 		addr:   addrNet,
 		addrv6: addrv6Net,
 		mac:    mac,
+		labels: metadataLabels(r.Options),
 	}
 	if ep.addr == nil {
 		str := "create endpoint was not passed interface IP address"
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
 	}
 
+	// docker reserves the auxiliary addresses, an ip range bounds the container addresses
+	if err := n.checkEndpointAddresses(ep); err != nil {
+		str := fmt.Sprintf("create endpoint was passed an invalid address: %v", err)
+		logrus.Errorf(str)
+		if _, ok := err.(*auxAddressError); ok {
+			return nil, types.ForbiddenErrorf("%s", str)
+		}
+		return nil, types.BadRequestErrorf("%s", str)
+	}
+
+	// a retried create keeps the mac generated the first time
+	existing := n.endpoint(endpointID)
+	if ep.mac == nil && existing != nil {
+		ep.mac = existing.mac
+		intf.MacAddress = ep.mac.String()
+	}
+	// respect a user supplied mac, otherwise generate one from the -o mac_policy
 	if ep.mac == nil {
-		ep.mac = netutils.GenerateMACFromIP(ep.addr.IP)
+		ep.mac = n.config.generateMAC(ep)
 		intf.MacAddress = ep.mac.String()
-		logrus.Infof("CreateEndpoint: generate mac ip=%s,mac=%s,eth=%s", ep.addr.IP.String(), ep.mac.String())
+		logrus.Infof("CreateEndpoint: generate mac ip=%s,mac=%s,policy=%s", ep.addr.IP.String(), ep.mac.String(), n.config.MacPolicy)
 	}
 
 	epOptions := r.Options
+	// parse the tc rate limits -o macvlan.egress_rate/macvlan.ingress_rate
+	limits, err := parseBandwidthOptions(epOptions)
+	if err != nil {
+		str := fmt.Sprintf("create endpoint was passed invalid bandwidth options: %v", err)
+		logrus.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
+	}
+	ep.limits = limits
+	// parse the container side settings -o macvlan.txqueuelen, macvlan.gro...
+	if ep.tuning, err = parseTuningOptions(epOptions); err != nil {
+		str := fmt.Sprintf("create endpoint was passed invalid tuning options: %v", err)
+		logrus.Errorf(str)
+		return nil, types.BadRequestErrorf("%s", str)
+	}
+	// parse the container routes -o macvlan.routes
+	if v, ok := getEndpointOption(epOptions, epRoutesOpt); ok {
+		routes, err := parseRoutes(v)
+		if err == nil {
+			err = n.config.validateRoutes(routes)
+		}
+		if err != nil {
+			str := fmt.Sprintf("create endpoint was passed invalid %s option: %v", epRoutesOpt, err)
+			logrus.Errorf(str)
+			return nil, types.BadRequestErrorf("%s", str)
+		}
+		ep.routes = routes
+	}
+
 	// disallow portmapping -p
 	if opt, ok := epOptions[netlabel.PortMap]; ok {
 		if _, ok := opt.([]types.PortBinding); ok {
@@ -107,16 +161,29 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 		}
 	}
 
+	epResponse := &pluginNet.CreateEndpointResponse{Interface: &pluginNet.EndpointInterface{"", "", intf.MacAddress}}
+	if existing != nil {
+		ep.srcName = existing.srcName
+		ep.tap = existing.tap
+		ep.sandbox = existing.sandbox
+		if !sameRecord(existing, ep) {
+			str := fmt.Sprintf("macvlan endpoint %s already exists with a different configuration", stringid.TruncateID(ep.id))
+			logrus.Errorf(str)
+			return nil, types.ForbiddenErrorf("%s", str)
+		}
+		logrus.Infof("CreateEndpoint: endpoint eid=%s already exists", ep.id)
+		return epResponse, nil
+	}
+
 	if err := d.store.StoreUpdate(ep); err != nil {
 		str := fmt.Sprintf("failed to save macvlan endpoint %s to store: %v", ep.id[0:7], err)
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.RetryErrorf("%s", str)
 	}
 
 	n.addEndpoint(ep)
 	logrus.Infof("CreateEndpoint: add endpoint eid=%s", ep.id)
 
-	epResponse := &pluginNet.CreateEndpointResponse{Interface: &pluginNet.EndpointInterface{"", "", intf.MacAddress}}
 	return epResponse, nil
 }
 
@@ -129,24 +196,24 @@ func (d *Driver) DeleteEndpoint(r *pluginNet.DeleteEndpointRequest) error {
 	if nid == "" {
 		str := "invalid network id"
 		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		return types.BadRequestErrorf("%s", str)
 	}
 	if eid == "" {
 		str := "invalid endpoint id"
 		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		return types.BadRequestErrorf("%s", str)
 	}
-	n := d.networks[nid]
-	if n == nil {
-		str := fmt.Sprintf("network id %q not found", nid)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
+	// the network or the endpoint is already gone when the daemon retries the delete
+	n, err := d.getNetwork(nid)
+	if err != nil || !d.acquire(n) {
+		logrus.Infof("DeleteEndpoint: network nid=%s not found, nothing to delete", nid)
+		return nil
 	}
-	ep := n.endpoints[eid]
+	defer n.release()
+	ep := n.endpoint(eid)
 	if ep == nil {
-		str := fmt.Sprintf("endpoint id %q not found", eid)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		logrus.Infof("DeleteEndpoint: endpoint eid=%s not found, nothing to delete", eid)
+		return nil
 	}
 	if err := d.deleteEndpoint(n, ep); err != nil {
 		return err
@@ -164,69 +231,102 @@ func (d *Driver) deleteEndpoint(n *network, ep *endpoint) error {
 	if err := d.store.StoreDelete(ep); err != nil {
 		str := fmt.Sprintf("failed to remove macvlan endpoint %s to store: %v", ep.id[0:7], err)
 		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		return types.RetryErrorf("%s", str)
 	}
 	n.deleteEndpoint(ep.id)
 
 	return nil
 }
 
-// EndpointInfo ...
+// EndpointInfo returns the character device of a macvtap endpoint and the
+// status of the container side tuning
 func (d *Driver) EndpointInfo(r *pluginNet.InfoRequest) (*pluginNet.InfoResponse, error) {
 	logrus.Debugf("EndpointInfo macvlan")
 	res := &pluginNet.InfoResponse{
 		Value: make(map[string]string),
 	}
+	if n, err := d.getNetwork(r.NetworkID); err == nil {
+		if ep := n.endpoint(r.EndpointID); ep != nil && ep.tap != nil {
+			res.Value = ep.tap.info()
+		}
+	}
+	if status, ok := d.tuningStatus(r.EndpointID); ok {
+		res.Value[tuningInfo] = status
+	}
 	return res, nil
 }
 
 func (ep *endpoint) MarshalJSON() ([]byte, error) {
-	epMap := make(map[string]interface{})
-	epMap["id"] = ep.id
-	epMap["nid"] = ep.nid
-	epMap["SrcName"] = ep.srcName
+	r := &endpointRecord{
+		Version:      storeVersion,
+		ID:           ep.id,
+		NetworkID:    ep.nid,
+		SrcName:      ep.srcName,
+		Bandwidth:    ep.limits,
+		StaticRoutes: ep.routes,
+		Tap:          ep.tap,
+		Labels:       ep.labels,
+		Sandbox:      ep.sandbox,
+		Tuning:       ep.tuning,
+	}
 	if len(ep.mac) != 0 {
-		epMap["MacAddress"] = ep.mac.String()
+		r.MacAddress = ep.mac.String()
 	}
 	if ep.addr != nil {
-		epMap["Addr"] = ep.addr.String()
+		r.Addr = ep.addr.String()
 	}
 	if ep.addrv6 != nil {
-		epMap["Addrv6"] = ep.addrv6.String()
+		r.Addrv6 = ep.addrv6.String()
 	}
-	return json.Marshal(epMap)
+	return json.Marshal(r)
 }
 
 func (ep *endpoint) UnmarshalJSON(b []byte) error {
-	var (
-		err   error
-		epMap map[string]interface{}
-	)
+	_, err := ep.decode(b)
+	return err
+}
 
-	if err = json.Unmarshal(b, &epMap); err != nil {
-		return fmt.Errorf("Failed to unmarshal to macvlan endpoint: %v", err)
+// decode sets the endpoint from a stored record of any version and returns
+// the version it was stored with
+func (ep *endpoint) decode(b []byte) (int, error) {
+	var r endpointRecord
+	version, err := decodeRecord(b, endpointMigrations, &r)
+	if _, ok := err.(*newerRecordError); ok {
+		return version, err
+	}
+	if err != nil {
+		return version, fmt.Errorf("Failed to unmarshal to macvlan endpoint: %v", err)
+	}
+	if r.ID == "" || r.NetworkID == "" {
+		return version, types.InternalErrorf("macvlan endpoint record misses its endpoint or network id")
 	}
 
-	if v, ok := epMap["MacAddress"]; ok {
-		if ep.mac, err = net.ParseMAC(v.(string)); err != nil {
-			return types.InternalErrorf("failed to decode macvlan endpoint MAC address (%s) after json unmarshal: %v", v.(string), err)
+	if r.MacAddress != "" {
+		if ep.mac, err = net.ParseMAC(r.MacAddress); err != nil {
+			return version, types.InternalErrorf("failed to decode macvlan endpoint MAC address (%s) after json unmarshal: %v", r.MacAddress, err)
 		}
 	}
-	if v, ok := epMap["Addr"]; ok {
-		if ep.addr, err = types.ParseCIDR(v.(string)); err != nil {
-			return types.InternalErrorf("failed to decode macvlan endpoint IPv4 address (%s) after json unmarshal: %v", v.(string), err)
+	if r.Addr != "" {
+		if ep.addr, err = types.ParseCIDR(r.Addr); err != nil {
+			return version, types.InternalErrorf("failed to decode macvlan endpoint IPv4 address (%s) after json unmarshal: %v", r.Addr, err)
 		}
 	}
-	if v, ok := epMap["Addrv6"]; ok {
-		if ep.addrv6, err = types.ParseCIDR(v.(string)); err != nil {
-			return types.InternalErrorf("failed to decode macvlan endpoint IPv6 address (%s) after json unmarshal: %v", v.(string), err)
+	if r.Addrv6 != "" {
+		if ep.addrv6, err = types.ParseCIDR(r.Addrv6); err != nil {
+			return version, types.InternalErrorf("failed to decode macvlan endpoint IPv6 address (%s) after json unmarshal: %v", r.Addrv6, err)
 		}
 	}
-	ep.id = epMap["id"].(string)
-	ep.nid = epMap["nid"].(string)
-	ep.srcName = epMap["SrcName"].(string)
-
-	return nil
+	ep.limits = r.Bandwidth
+	ep.routes = r.StaticRoutes
+	ep.tap = r.Tap
+	ep.labels = r.Labels
+	ep.sandbox = r.Sandbox
+	ep.tuning = r.Tuning
+	ep.id = r.ID
+	ep.nid = r.NetworkID
+	ep.srcName = r.SrcName
+
+	return version, nil
 }
 
 func (ep *endpoint) Key() []string {
@@ -6,7 +6,9 @@ import (
 	"testing"
 
 	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func initEndpointData() (*MacStore, *Driver, *pluginNet.CreateEndpointRequest, *endpoint) {
@@ -162,6 +164,56 @@ func TestDeleteEndpointWithErr(t *testing.T) {
 	assert.NotEmpty(t, d.networks[r.NetworkID].endpoints[r.EndpointID])
 }
 
+func TestCreateEndpointReplay(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	res1, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	assert.Equal(t, res, res1)
+	ms.AssertNumberOfCalls(t, "StoreUpdate", 1)
+
+	// a different address for the same endpoint id conflicts
+	r.Interface = &pluginNet.EndpointInterface{Address: "192.168.2.3/24"}
+	res, err = d.CreateEndpoint(r)
+	assert.Nil(t, res)
+	assert.EqualError(t, err, "macvlan endpoint 1234567 already exists with a different configuration")
+	_, ok := err.(types.ForbiddenError)
+	assert.True(t, ok)
+	assert.EqualValues(t, ep, d.networks[ep.nid].endpoints[ep.id])
+}
+
+func TestCreateEndpointReplayGeneratedMac(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	d.networks[r.NetworkID].config.MacPolicy = macPolicyRandom
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	r.Interface.MacAddress = ""
+	res1, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	assert.Equal(t, res, res1)
+	assert.Equal(t, res.Interface.MacAddress, d.networks[ep.nid].endpoints[ep.id].mac.String())
+}
+
+func TestDeleteEndpointReplay(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreDelete", ep).Return(nil)
+	der := &pluginNet.DeleteEndpointRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	assert.Nil(t, d.DeleteEndpoint(der))
+	assert.Nil(t, d.DeleteEndpoint(der))
+	ms.AssertNumberOfCalls(t, "StoreDelete", 1)
+
+	// the network is gone too
+	der.NetworkID = "2"
+	assert.Nil(t, d.DeleteEndpoint(der))
+}
+
 func TestEndpointInfo(t *testing.T) {
 	_, d, r, _ := initEndpointData()
 	ir := &pluginNet.InfoRequest{
@@ -0,0 +1,269 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// stateVersion is the version of the exported state document, the records
+// it holds carry their own store version
+const stateVersion = 1
+
+// State is the document exported from a local store to be imported on
+// another host
+type State struct {
+	Version   int
+	Networks  []*configuration
+	Endpoints []*endpoint
+}
+
+// ImportAction is what an import does with a record
+type ImportAction string
+
+// import actions, any conflict aborts the import
+const (
+	ImportAdd       ImportAction = "+"
+	ImportUnchanged ImportAction = "="
+	ImportConflict  ImportAction = "!"
+)
+
+// ImportChange is the outcome of importing a network or an endpoint
+type ImportChange struct {
+	Action ImportAction
+	Kind   string
+	ID     string
+	Detail string
+}
+
+func (c *ImportChange) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Action, c.Kind, stringid.TruncateID(c.ID))
+	if c.Detail != "" {
+		s += " " + c.Detail
+	}
+	return s
+}
+
+type byConfigID []*configuration
+
+func (s byConfigID) Len() int           { return len(s) }
+func (s byConfigID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byConfigID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type byEndpoint []*endpoint
+
+func (s byEndpoint) Len() int           { return len(s) }
+func (s byEndpoint) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEndpoint) Less(i, j int) bool { return s[i].id < s[j].id }
+
+// ExportState reads all the network and endpoint records of the local store
+func ExportState(opts Options) (*State, error) {
+	configs, endpoints, err := readRecords(opts)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byConfigID(configs))
+	sort.Sort(byEndpoint(endpoints))
+
+	return &State{Version: stateVersion, Networks: configs, Endpoints: endpoints}, nil
+}
+
+// DecodeState parses an exported state document
+func DecodeState(b []byte) (*State, error) {
+	s := &State{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("invalid state document: %v", err)
+	}
+	if s.Version < 1 || s.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state document version %d, expected 1 to %d", s.Version, stateVersion)
+	}
+	for _, config := range s.Networks {
+		if config == nil {
+			return nil, fmt.Errorf("invalid state document: null network")
+		}
+	}
+	for _, ep := range s.Endpoints {
+		if ep == nil {
+			return nil, fmt.Errorf("invalid state document: null endpoint")
+		}
+	}
+
+	return s, nil
+}
+
+// PlanImport compares the state with the records of the local store. A
+// record conflicts when a stored one has the same id but differs, when a
+// network reuses the parent of another network and when an endpoint reuses
+// the address of another endpoint of its network or belongs to no network.
+func PlanImport(opts Options, s *State) ([]*ImportChange, error) {
+	var (
+		configs   []*configuration
+		endpoints []*endpoint
+	)
+	if !newBoltStore(opts) {
+		var err error
+		if configs, endpoints, err = readRecords(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []*ImportChange
+	networks := make(map[string]*configuration)
+	parents := make(map[string]string)
+	for _, config := range configs {
+		networks[config.ID] = config
+		parents[config.Parent] = config.ID
+	}
+	for _, config := range s.Networks {
+		c := &ImportChange{Action: ImportAdd, Kind: "network", ID: config.ID, Detail: "parent " + config.Parent}
+		if stored, ok := networks[config.ID]; ok {
+			if sameRecord(stored, config) {
+				c.Action, c.Detail = ImportUnchanged, ""
+			} else {
+				c.Action, c.Detail = ImportConflict, "differs from the stored network"
+			}
+		} else if other, ok := parents[config.Parent]; ok {
+			c.Action, c.Detail = ImportConflict, fmt.Sprintf("parent %s already used by network %s", config.Parent, stringid.TruncateID(other))
+		} else {
+			networks[config.ID] = config
+			parents[config.Parent] = config.ID
+		}
+		changes = append(changes, c)
+	}
+
+	stored := make(map[string]*endpoint)
+	addrs := make(map[string]string)
+	for _, ep := range endpoints {
+		stored[ep.id] = ep
+		for _, a := range ep.addresses() {
+			addrs[ep.nid+"/"+a] = ep.id
+		}
+	}
+	for _, ep := range s.Endpoints {
+		c := &ImportChange{Action: ImportAdd, Kind: "endpoint", ID: ep.id, Detail: "network " + stringid.TruncateID(ep.nid)}
+		if old, ok := stored[ep.id]; ok {
+			if sameRecord(old, ep) {
+				c.Action, c.Detail = ImportUnchanged, ""
+			} else {
+				c.Action, c.Detail = ImportConflict, "differs from the stored endpoint"
+			}
+			changes = append(changes, c)
+			continue
+		}
+		if _, ok := networks[ep.nid]; !ok {
+			c.Action, c.Detail = ImportConflict, fmt.Sprintf("network %s is neither stored nor imported", stringid.TruncateID(ep.nid))
+			changes = append(changes, c)
+			continue
+		}
+		for _, a := range ep.addresses() {
+			if other, ok := addrs[ep.nid+"/"+a]; ok {
+				c.Action, c.Detail = ImportConflict, fmt.Sprintf("%s already used by endpoint %s", a, stringid.TruncateID(other))
+				break
+			}
+		}
+		if c.Action == ImportAdd {
+			stored[ep.id] = ep
+			for _, a := range ep.addresses() {
+				addrs[ep.nid+"/"+a] = ep.id
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+// ImportState writes the networks and endpoints of the state missing from
+// the local store. Nothing is written when a record conflicts. The plugin
+// restores the imported records on its next start.
+func ImportState(opts Options, s *State) ([]*ImportChange, error) {
+	changes, err := PlanImport(opts, s)
+	if err != nil {
+		return nil, err
+	}
+	if ImportConflicts(changes) {
+		return changes, fmt.Errorf("import aborted, the state conflicts with the local store")
+	}
+
+	ds, err := openStore(opts)
+	if err != nil {
+		return changes, err
+	}
+	defer ds.Close()
+	added := make(map[string]bool)
+	for _, c := range changes {
+		if c.Action == ImportAdd {
+			added[c.Kind+"/"+c.ID] = true
+		}
+	}
+	for _, config := range s.Networks {
+		if !added["network/"+config.ID] {
+			continue
+		}
+		if err := ds.PutObjectAtomic(config); err != nil {
+			return changes, fmt.Errorf("failed to import network %s: %v", config.ID, err)
+		}
+	}
+	for _, ep := range s.Endpoints {
+		if !added["endpoint/"+ep.id] {
+			continue
+		}
+		if err := ds.PutObjectAtomic(ep); err != nil {
+			return changes, fmt.Errorf("failed to import endpoint %s: %v", ep.id, err)
+		}
+	}
+
+	return changes, nil
+}
+
+// newBoltStore returns whether the boltdb file is yet to be created, as on
+// a new host
+func newBoltStore(opts Options) bool {
+	if opts.storeBackend() != storeBoltDB {
+		return false
+	}
+	path := opts.StorePath
+	if path == "" {
+		path = DefaultStorePath()
+	}
+	_, err := os.Stat(path)
+
+	return os.IsNotExist(err)
+}
+
+// ImportConflicts returns whether a change conflicts
+func ImportConflicts(changes []*ImportChange) bool {
+	for _, c := range changes {
+		if c.Action == ImportConflict {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameRecord compares two records by their stored form
+func sameRecord(a, b json.Marshaler) bool {
+	ba, erra := a.MarshalJSON()
+	bb, errb := b.MarshalJSON()
+	return erra == nil && errb == nil && bytes.Equal(ba, bb)
+}
+
+// addresses returns the addresses identifying the endpoint on its network
+func (ep *endpoint) addresses() []string {
+	var addrs []string
+	if len(ep.mac) != 0 {
+		addrs = append(addrs, "mac "+ep.mac.String())
+	}
+	if ep.addr != nil {
+		addrs = append(addrs, "address "+ep.addr.IP.String())
+	}
+	if ep.addrv6 != nil {
+		addrs = append(addrs, "address "+ep.addrv6.IP.String())
+	}
+	return addrs
+}
@@ -0,0 +1,123 @@
+package drivers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initExportStore stores the network and endpoint of initEndpointData in a
+// boltdb file and returns the directory and the store options
+func initExportStore(t *testing.T) (string, Options) {
+	dir, d := initStoreFile(t)
+	_, d1, r, ep := initEndpointData()
+	assert.Nil(t, d.store.StoreUpdate(d1.networks[r.NetworkID].config))
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	assert.Nil(t, d.Close())
+	return dir, d.opts
+}
+
+func TestExportState(t *testing.T) {
+	dir, opts := initExportStore(t)
+	defer os.RemoveAll(dir)
+	s, err := ExportState(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stateVersion, s.Version)
+	assert.Len(t, s.Networks, 1)
+	assert.Len(t, s.Endpoints, 1)
+
+	b, err := json.Marshal(s)
+	assert.Nil(t, err)
+	s1, err := DecodeState(b)
+	assert.Nil(t, err)
+	_, d, r, ep := initEndpointData()
+	assert.True(t, sameRecord(d.networks[r.NetworkID].config, s1.Networks[0]))
+	assert.True(t, sameRecord(ep, s1.Endpoints[0]))
+}
+
+func TestDecodeStateWithErr(t *testing.T) {
+	for _, b := range []string{`{`, `{"Version":0}`, `{"Version":2}`, `{"Version":1,"Networks":[null]}`,
+		`{"Version":1,"Endpoints":[{"id":"1"}]}`} {
+		_, err := DecodeState([]byte(b))
+		assert.NotNil(t, err, b)
+	}
+}
+
+func TestImportState(t *testing.T) {
+	dir, opts := initExportStore(t)
+	defer os.RemoveAll(dir)
+	s, err := ExportState(opts)
+	assert.Nil(t, err)
+
+	// into a new host
+	opts1 := Options{StorePath: filepath.Join(dir, "new-kv.db")}
+	changes, err := PlanImport(opts1, s)
+	assert.Nil(t, err)
+	assert.Equal(t, "+ network 1 parent eth0", changes[0].String())
+	assert.Equal(t, "+ endpoint 1234567 network 1", changes[1].String())
+	_, err = os.Stat(opts1.StorePath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = ImportState(opts1, s)
+	assert.Nil(t, err)
+	s1, err := ExportState(opts1)
+	assert.Nil(t, err)
+	assert.True(t, sameRecord(s.Networks[0], s1.Networks[0]))
+	assert.True(t, sameRecord(s.Endpoints[0], s1.Endpoints[0]))
+
+	// importing again changes nothing
+	changes, err = ImportState(opts1, s)
+	assert.Nil(t, err)
+	assert.Equal(t, ImportUnchanged, changes[0].Action)
+	assert.Equal(t, ImportUnchanged, changes[1].Action)
+}
+
+func TestPlanImportConflicts(t *testing.T) {
+	dir, opts := initExportStore(t)
+	defer os.RemoveAll(dir)
+	s, err := ExportState(opts)
+	assert.Nil(t, err)
+	_, _, _, ep := initEndpointData()
+
+	// same ids, different records
+	s.Networks[0].Mtu = 9000
+	s.Endpoints[0].srcName = "veth0000001"
+	changes, err := PlanImport(opts, s)
+	assert.Nil(t, err)
+	assert.Equal(t, "! network 1 differs from the stored network", changes[0].String())
+	assert.Equal(t, "! endpoint 1234567 differs from the stored endpoint", changes[1].String())
+
+	// new network on a used parent, new endpoint reusing an address or without network
+	s.Networks[0].ID = "2"
+	ep.id = "7654321"
+	ep2 := &endpoint{id: "0abcdef", nid: "3", srcName: "veth0000002"}
+	s.Endpoints = []*endpoint{ep, ep2}
+	changes, err = PlanImport(opts, s)
+	assert.Nil(t, err)
+	assert.Equal(t, "! network 2 parent eth0 already used by network 1", changes[0].String())
+	assert.Equal(t, "! endpoint 7654321 mac 02:42:c0:a8:02:02 already used by endpoint 1234567", changes[1].String())
+	assert.Equal(t, "! endpoint 0abcdef network 3 is neither stored nor imported", changes[2].String())
+	assert.True(t, ImportConflicts(changes))
+
+	_, err = ImportState(opts, s)
+	assert.NotNil(t, err)
+	s1, err := ExportState(opts)
+	assert.Nil(t, err)
+	assert.Len(t, s1.Networks, 1)
+	assert.Len(t, s1.Endpoints, 1)
+}
+
+func TestPopulateNetworks(t *testing.T) {
+	dir, opts := initExportStore(t)
+	defer os.RemoveAll(dir)
+	d := NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	n := d.networks["1"]
+	assert.NotNil(t, n)
+	assert.Equal(t, "eth0", n.config.Parent)
+	assert.NotNil(t, n.endpoints["1234567"])
+	assert.Nil(t, d.Close())
+}
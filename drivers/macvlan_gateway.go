@@ -0,0 +1,451 @@
+package drivers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	gatewayCheckOpt     = "gateway_check" // -o gateway_check=true fails the create of a network whose gateways don't answer
+	gatewayProbePrefix  = "mg-"
+	gatewayCheckTimeout = 5 * time.Second // bounds the check of a create, well under the plugin timeout
+	gatewayCheckProbes  = 2
+)
+
+// gatewayProbe is the probe link of a network, created by the first probe
+// and kept until the network is deleted
+type gatewayProbe struct {
+	name   string
+	sem    chan struct{} // held by the probe in progress, a create check waits for it a bounded time
+	link   netlink.Link  // guarded by sem
+	closed bool          // the network is deleted
+	sync.Mutex
+}
+
+// GatewayStatus is the reachability of a network gateway tracked by the monitor
+type GatewayStatus struct {
+	NetworkID  string
+	Gateway    string
+	Reachable  bool
+	MacAddress string `json:",omitempty"` // the last mac the gateway answered from
+	Error      string `json:",omitempty"`
+	LastProbe  time.Time
+	Probes     uint64
+	Failures   uint64
+	MacChanges uint64
+}
+
+// MetricsWriter is implemented by the drivers exporting metrics, the handler
+// serves them on /metrics
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer)
+}
+
+// gatewayResult is the outcome of the probe of a gateway
+type gatewayResult struct {
+	gateway net.IP
+	mac     net.HardwareAddr
+	err     error
+}
+
+func parseGatewayCheck(v string) error {
+	if _, err := strconv.ParseBool(v); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+
+	return nil
+}
+
+// validateGatewayCheck verifies -o gateway_check applies to a network whose
+// parent can carry the probe link
+func (config *configuration) validateGatewayCheck() error {
+	if !config.GatewayCheck {
+		return nil
+	}
+	if config.Internal {
+		return fmt.Errorf("-o %s can't be used on internal networks", gatewayCheckOpt)
+	}
+	if config.MacvlanMode == modePassthru {
+		return fmt.Errorf("-o %s can't be used in passthru mode, the parent carries a single slave", gatewayCheckOpt)
+	}
+
+	return nil
+}
+
+// gateways returns the gateways of the subnets of the network
+func (config *configuration) gateways() []net.IP {
+	var gws []net.IP
+	add := func(gwIP string) {
+		if gw, _, err := net.ParseCIDR(gwIP); err == nil {
+			gws = append(gws, gw)
+		}
+	}
+	for _, s := range config.Ipv4Subnets {
+		add(s.GwIP)
+	}
+	for _, s := range config.Ipv6Subnets {
+		add(s.GwIP)
+	}
+
+	return gws
+}
+
+// monitored returns whether the monitor probes the gateways of the network
+func (config *configuration) monitored() bool {
+	return !config.Internal && config.MacvlanMode != modePassthru && len(config.gateways()) > 0
+}
+
+func getGatewayProbeName(nid string) string {
+	return gatewayProbePrefix + stringid.TruncateID(nid)
+}
+
+// gatewayProbeMac derives the mac of the probe link from the network id, a
+// stable address keeps the switch tables from filling with probe macs
+func gatewayProbeMac(nid string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(nid))
+	return append(net.HardwareAddr{0x02}, sum[:5]...)
+}
+
+// createGatewayProbe adds the probe link of the network on its parent, or
+// on its bridge for the bridge link type, in the vrf of the network. The link
+// has no address and never answers arp, it only resolves the gateways.
+func createGatewayProbe(config *configuration, v6 bool) (netlink.Link, error) {
+	lower := config.Parent
+	if config.LinkType == linkBridge && config.Bridge != "" {
+		lower = config.Bridge
+	}
+	parent, err := ns.NlHandle().LinkByName(lower)
+	if err != nil {
+		return nil, fmt.Errorf("parent link %s not found: %v", lower, err)
+	}
+	name := getGatewayProbeName(config.ID)
+	// left by a previous run of the plugin
+	if stale, err := ns.NlHandle().LinkByName(name); err == nil {
+		ns.NlHandle().LinkDel(stale)
+	}
+	probe := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index, HardwareAddr: gatewayProbeMac(config.ID)},
+		Mode:      netlink.MACVLAN_MODE_PRIVATE,
+	}
+	if err := ns.NlHandle().LinkAdd(probe); err != nil {
+		return nil, fmt.Errorf("failed to create the gateway probe link on %s: %v", lower, err)
+	}
+	t := &ifaceTuning{ArpIgnore: "8"}
+	if v6 {
+		// no router advertisement is applied to the host through the probe
+		t.AcceptRA = "0"
+	}
+	err = t.apply(name)
+	if err == nil && v6 {
+		// the link-local address is usable right away to send solicitations
+		err = ioutil.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/accept_dad", []byte("0"), 0644)
+	} else if err == nil {
+		ioutil.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/disable_ipv6", []byte("1"), 0644)
+	}
+	if err == nil && config.Vrf != "" {
+		err = setVrfMaster(probe, config.Vrf)
+	}
+	if err == nil {
+		err = ns.NlHandle().LinkSetUp(probe)
+	}
+	if err != nil {
+		ns.NlHandle().LinkDel(probe)
+		return nil, fmt.Errorf("failed to set up the gateway probe link %s: %v", name, err)
+	}
+
+	return ns.NlHandle().LinkByName(name)
+}
+
+// gatewayProbe returns the probe of the network
+func (n *network) gatewayProbe() *gatewayProbe {
+	n.Lock()
+	defer n.Unlock()
+	if n.probe == nil {
+		n.probe = &gatewayProbe{name: getGatewayProbeName(n.id), sem: make(chan struct{}, 1)}
+	}
+
+	return n.probe
+}
+
+// acquire waits for the probe in progress, at most timeout unless it is zero,
+// and returns whether the probe can run
+func (p *gatewayProbe) acquire(timeout time.Duration) bool {
+	if timeout <= 0 {
+		p.sem <- struct{}{}
+		return true
+	}
+	select {
+	case p.sem <- struct{}{}:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// release ends a probe, the link of a network deleted meanwhile is removed
+func (p *gatewayProbe) release() {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		p.delete()
+	}
+	<-p.sem
+}
+
+func (p *gatewayProbe) delete() {
+	if link, err := ns.NlHandle().LinkByName(p.name); err == nil {
+		ns.NlHandle().LinkDel(link)
+	}
+	p.link = nil
+}
+
+// closeGatewayProbe removes the probe link of the network being deleted, or
+// leaves it to the probe in progress which removes it once done
+func (n *network) closeGatewayProbe() {
+	p := n.gatewayProbe()
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	select {
+	case p.sem <- struct{}{}:
+		p.delete()
+		<-p.sem
+	default:
+	}
+}
+
+// probeGateways resolves the gateways of the network with arp probes or
+// neighbor solicitations sent from the probe link of the network. A timeout
+// bounds the wait for the probe in progress and the probes, the gateways
+// left when it expires are reported as not probed.
+func (n *network) probeGateways(popts ProbeOptions, timeout time.Duration) ([]*gatewayResult, error) {
+	n.Lock()
+	config := n.config
+	n.Unlock()
+	gws := config.gateways()
+	if len(gws) == 0 {
+		return nil, nil
+	}
+	v6 := false
+	for _, gw := range gws {
+		v6 = v6 || gw.To4() == nil
+	}
+	if popts.Count <= 0 {
+		popts.Count = defaultProbes
+	}
+	if popts.Timeout <= 0 {
+		popts.Timeout = defaultProbeTTL
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	p := n.gatewayProbe()
+	if !p.acquire(timeout) {
+		return nil, fmt.Errorf("timed out after %s waiting for the probe in progress", timeout)
+	}
+	defer p.release()
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	if closed {
+		return nil, nil
+	}
+	if p.link != nil {
+		// the link goes with its lower link, a repaired parent needs a new one
+		if link, err := ns.NlHandle().LinkByName(p.name); err != nil || link.Attrs().Index != p.link.Attrs().Index {
+			p.link = nil
+		}
+	}
+	if p.link == nil {
+		link, err := createGatewayProbe(config, v6)
+		if err != nil {
+			return nil, err
+		}
+		p.link = link
+	}
+
+	var results []*gatewayResult
+	for _, gw := range gws {
+		r := &gatewayResult{gateway: gw}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			r.err = fmt.Errorf("not probed within %s", timeout)
+		} else if gw.To4() != nil {
+			// an arp probe, the probe link has no address to announce
+			r.mac, r.err = arpResolve(p.link, net.IPv4zero, gw, popts)
+		} else {
+			r.mac, r.err = ndpResolve(p.link, nil, gw, popts)
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// checkGateways returns an error naming the gateways of the network that
+// did not answer, within gatewayCheckTimeout
+func (n *network) checkGateways() error {
+	results, err := n.probeGateways(ProbeOptions{Count: gatewayCheckProbes}, gatewayCheckTimeout)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", r.gateway, r.err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("gateway unreachable on %s: %s", n.config.Parent, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// startGatewayMonitor probes the gateways of the networks every interval
+// until the driver is closed
+func (d *Driver) startGatewayMonitor(interval time.Duration) {
+	d.Lock()
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+	}
+	stop := d.stop
+	d.Unlock()
+	logrus.Infof("Monitoring the network gateways every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			d.monitorGateways()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// monitorGateways probes the gateways of every network once
+func (d *Driver) monitorGateways() {
+	seen := make(map[string]bool)
+	for _, n := range d.getnetworks() {
+		n.Lock()
+		config, allocated := n.config, n.allocated
+		n.Unlock()
+		if allocated || !config.monitored() {
+			continue
+		}
+		seen[n.id] = true
+		results, err := n.probeGateways(ProbeOptions{}, 0)
+		if err != nil {
+			for _, gw := range config.gateways() {
+				results = append(results, &gatewayResult{gateway: gw, err: err})
+			}
+		}
+		for _, r := range results {
+			d.updateGateway(config, r)
+		}
+	}
+	// forget the deleted networks
+	d.Lock()
+	for key, s := range d.gateways {
+		if !seen[s.NetworkID] {
+			delete(d.gateways, key)
+		}
+	}
+	d.Unlock()
+}
+
+// updateGateway records a probe and logs the loss, the recovery and the
+// mac changes of the gateway
+func (d *Driver) updateGateway(config *configuration, r *gatewayResult) {
+	d.Lock()
+	defer d.Unlock()
+	if d.gateways == nil {
+		d.gateways = make(map[string]*GatewayStatus)
+	}
+	key := config.ID + "/" + r.gateway.String()
+	s, ok := d.gateways[key]
+	if !ok {
+		s = &GatewayStatus{NetworkID: config.ID, Gateway: r.gateway.String()}
+		d.gateways[key] = s
+	}
+	nid := stringid.TruncateID(config.ID)
+	s.Probes++
+	s.LastProbe = time.Now().UTC()
+	if r.err != nil {
+		s.Failures++
+		s.Error = r.err.Error()
+		if s.Reachable || s.Probes == 1 {
+			logrus.Errorf("Gateway %s of network %s is unreachable on %s: %v", s.Gateway, nid, config.Parent, r.err)
+		}
+		s.Reachable = false
+		return
+	}
+	mac := r.mac.String()
+	if s.MacAddress != "" && s.MacAddress != mac {
+		s.MacChanges++
+		logrus.Warnf("Gateway %s of network %s answered from %s instead of %s, the gateway changed or is spoofed", s.Gateway, nid, mac, s.MacAddress)
+	}
+	if !s.Reachable && s.Probes > 1 {
+		logrus.Infof("Gateway %s of network %s is reachable again at %s", s.Gateway, nid, mac)
+	}
+	s.Reachable, s.MacAddress, s.Error = true, mac, ""
+}
+
+// GatewayStatuses returns the gateways tracked by the monitor
+func (d *Driver) GatewayStatuses() []*GatewayStatus {
+	d.Lock()
+	defer d.Unlock()
+	keys := make([]string, 0, len(d.gateways))
+	for key := range d.gateways {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ls := make([]*GatewayStatus, 0, len(keys))
+	for _, key := range keys {
+		s := *d.gateways[key]
+		ls = append(ls, &s)
+	}
+
+	return ls
+}
+
+// WriteMetrics writes the gateway metrics in the prometheus text format
+func (d *Driver) WriteMetrics(w io.Writer) {
+	statuses := d.GatewayStatuses()
+	for _, m := range []struct {
+		name, kind, help string
+		value            func(s *GatewayStatus) uint64
+	}{
+		{"macvlan_gateway_reachable", "gauge", "Whether the gateway answered the last probe.", func(s *GatewayStatus) uint64 {
+			if s.Reachable {
+				return 1
+			}
+			return 0
+		}},
+		{"macvlan_gateway_probes_total", "counter", "Probes of the gateway.", func(s *GatewayStatus) uint64 { return s.Probes }},
+		{"macvlan_gateway_probe_failures_total", "counter", "Probes of the gateway left unanswered.", func(s *GatewayStatus) uint64 { return s.Failures }},
+		{"macvlan_gateway_mac_changes_total", "counter", "Changes of the mac the gateway answers from.", func(s *GatewayStatus) uint64 { return s.MacChanges }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%s{network=%q,gateway=%q} %d\n", m.name, s.NetworkID, s.Gateway, m.value(s))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package drivers
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestParseGatewayCheckOption(t *testing.T) {
+	config, err := parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]interface{}{parentOpt: "eth0", gatewayCheckOpt: "true"},
+	}, phaseCreate)
+	assert.Nil(t, err)
+	assert.True(t, config.GatewayCheck)
+
+	_, err = parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]interface{}{gatewayCheckOpt: "yes"},
+	}, phaseCreate)
+	assert.EqualError(t, err, "invalid -o gateway_check=yes: must be true or false")
+
+	d := NewDriver(Options{})
+	ipv4 := []*pluginNet.IPAMData{{Pool: "192.168.1.0/24", Gateway: "192.168.1.1/24"}}
+	_, err = d.networkConfig("1", map[string]interface{}{
+		netlabel.GenericData: map[string]string{parentOpt: "eth0", driverModeOpt: modePassthru, gatewayCheckOpt: "true"},
+	}, ipv4, nil, phaseCreate)
+	assert.EqualError(t, err, "-o gateway_check can't be used in passthru mode, the parent carries a single slave")
+	_, err = d.networkConfig("1", map[string]interface{}{
+		netlabel.GenericData: map[string]string{parentOpt: "eth0", gatewayCheckOpt: "true"},
+		netlabel.Internal:    true,
+	}, ipv4, nil, phaseCreate)
+	assert.EqualError(t, err, "-o gateway_check can't be used on internal networks")
+}
+
+func TestGatewayProbeLink(t *testing.T) {
+	config := &configuration{
+		ID:          "0123456789abcdef",
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "10.98.0.0/24", GwIP: "10.98.0.1/24"}, {SubnetIP: "10.97.0.0/24"}},
+		Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "fd98::/64", GwIP: "fd98::1/64"}},
+	}
+	assert.Equal(t, []net.IP{net.ParseIP("10.98.0.1"), net.ParseIP("fd98::1")}, config.gateways())
+	assert.True(t, config.monitored())
+	assert.False(t, (&configuration{Internal: true, Ipv4Subnets: config.Ipv4Subnets}).monitored())
+	assert.False(t, (&configuration{Ipv4Subnets: config.Ipv4Subnets[1:]}).monitored())
+
+	assert.Equal(t, "mg-0123456789ab", getGatewayProbeName(config.ID))
+	mac := gatewayProbeMac(config.ID)
+	assert.Equal(t, 6, len(mac))
+	assert.Equal(t, byte(0x02), mac[0])
+	assert.Equal(t, mac, gatewayProbeMac(config.ID))
+}
+
+func TestUpdateGateway(t *testing.T) {
+	d := NewDriver(Options{})
+	config := &configuration{ID: "1", Parent: "eth0"}
+	gw := net.ParseIP("10.98.0.1")
+	mac1, _ := net.ParseMAC("02:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	d.updateGateway(config, &gatewayResult{gateway: gw, err: errors.New("no arp reply to 3 requests")})
+	d.updateGateway(config, &gatewayResult{gateway: gw, mac: mac1})
+	d.updateGateway(config, &gatewayResult{gateway: gw, mac: mac1})
+	d.updateGateway(config, &gatewayResult{gateway: gw, mac: mac2})
+	statuses := d.GatewayStatuses()
+	assert.Equal(t, 1, len(statuses))
+	s := statuses[0]
+	assert.True(t, s.Reachable)
+	assert.Equal(t, "02:00:00:00:00:02", s.MacAddress)
+	assert.Equal(t, "", s.Error)
+	assert.Equal(t, uint64(4), s.Probes)
+	assert.Equal(t, uint64(1), s.Failures)
+	assert.Equal(t, uint64(1), s.MacChanges)
+
+	d.updateGateway(config, &gatewayResult{gateway: gw, err: errors.New("no arp reply to 3 requests")})
+	s = d.GatewayStatuses()[0]
+	assert.False(t, s.Reachable)
+	assert.Equal(t, "no arp reply to 3 requests", s.Error)
+	// the last mac is kept to detect a change once the gateway answers again
+	assert.Equal(t, "02:00:00:00:00:02", s.MacAddress)
+
+	var b bytes.Buffer
+	NewDrainer(d).WriteMetrics(&b)
+	out := b.String()
+	assert.Contains(t, out, "# TYPE macvlan_gateway_reachable gauge\n")
+	assert.Contains(t, out, `macvlan_gateway_reachable{network="1",gateway="10.98.0.1"} 0`+"\n")
+	assert.Contains(t, out, `macvlan_gateway_probes_total{network="1",gateway="10.98.0.1"} 5`+"\n")
+	assert.Contains(t, out, `macvlan_gateway_probe_failures_total{network="1",gateway="10.98.0.1"} 2`+"\n")
+	assert.Contains(t, out, `macvlan_gateway_mac_changes_total{network="1",gateway="10.98.0.1"} 1`+"\n")
+
+	// the statuses of the deleted networks are dropped
+	d.monitorGateways()
+	assert.Equal(t, 0, len(d.GatewayStatuses()))
+}
+
+func TestProbeGateways(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	assert.Nil(t, netutils.CreateVethPair("mvgw0", "mvgw1"))
+	defer netutils.DeleteVethPair("mvgw0", "mvgw1")
+	peer, err := ns.NlHandle().LinkByName("mvgw1")
+	assert.Nil(t, err)
+	sbox, err := netns.GetFromPath(sandboxKey)
+	assert.Nil(t, err)
+	defer sbox.Close()
+	// the gateway is the end of the veth in the sandbox
+	assert.Nil(t, ns.NlHandle().LinkSetNsFd(peer, int(sbox)))
+	h, err := netlink.NewHandleAt(sbox)
+	assert.Nil(t, err)
+	defer h.Delete()
+	peer, err = h.LinkByName("mvgw1")
+	assert.Nil(t, err)
+	assert.Nil(t, addTestAddr(h, peer, "10.98.0.1/24"))
+	v6 := addTestAddr(h, peer, "fd98::1/64") == nil
+	assert.Nil(t, h.LinkSetUp(peer))
+	assert.Nil(t, ns.NlHandle().LinkSetUp(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "mvgw0"}}))
+	assert.Nil(t, waitCarrier(h, "mvgw1"))
+
+	config := &configuration{
+		ID:          "0123456789abcdef",
+		Parent:      "mvgw0",
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "10.98.0.0/24", GwIP: "10.98.0.1/24"}},
+	}
+	if v6 {
+		config.Ipv6Subnets = []*ipv6Subnet{{SubnetIP: "fd98::/64", GwIP: "fd98::1/64"}}
+	}
+	n := &network{id: config.ID, endpoints: endpointTable{}, config: config}
+	popts := ProbeOptions{Count: 2, Timeout: 300 * time.Millisecond}
+	results, err := n.probeGateways(popts, 0)
+	assert.Nil(t, err)
+	for _, r := range results {
+		assert.Nil(t, r.err, r.gateway.String())
+		assert.Equal(t, peer.Attrs().HardwareAddr, r.mac, r.gateway.String())
+	}
+	if v6 {
+		assert.Equal(t, 2, len(results))
+	}
+	// the probe link is kept for the next probes
+	probe, err := ns.NlHandle().LinkByName(getGatewayProbeName(config.ID))
+	assert.Nil(t, err)
+
+	// the gateway is gone
+	config.Ipv6Subnets = nil
+	addr, _ := netlink.ParseAddr("10.98.0.1/24")
+	assert.Nil(t, h.AddrDel(peer, addr))
+	results, err = n.probeGateways(popts, 0)
+	assert.Nil(t, err)
+	assert.EqualError(t, results[0].err, "no arp reply to 2 requests")
+	link, err := ns.NlHandle().LinkByName(getGatewayProbeName(config.ID))
+	assert.Nil(t, err)
+	assert.Equal(t, probe.Attrs().Index, link.Attrs().Index)
+
+	// a create check doesn't wait past its timeout for the probe in progress
+	p := n.gatewayProbe()
+	assert.True(t, p.acquire(0))
+	_, err = n.probeGateways(popts, 100*time.Millisecond)
+	assert.EqualError(t, err, "timed out after 100ms waiting for the probe in progress")
+	// the link of a network deleted during a probe goes when the probe ends
+	n.closeGatewayProbe()
+	_, err = ns.NlHandle().LinkByName(getGatewayProbeName(config.ID))
+	assert.Nil(t, err)
+	p.release()
+	_, err = ns.NlHandle().LinkByName(getGatewayProbeName(config.ID))
+	assert.NotNil(t, err)
+	results, err = n.probeGateways(popts, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+
+	n = &network{id: config.ID, endpoints: endpointTable{}, config: config}
+	config.Parent = "mvgwnone"
+	_, err = n.probeGateways(popts, 0)
+	assert.EqualError(t, err, "parent link mvgwnone not found: Link not found")
+	assert.EqualError(t, n.checkGateways(), "parent link mvgwnone not found: Link not found")
+}
+
+func TestMarshaJSONForConfigWithGatewayCheck(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	c := d.networks[r.NetworkID].config
+	c.GatewayCheck = true
+	b, err := c.MarshalJSON()
+	assert.Nil(t, err)
+	c1 := &configuration{}
+	assert.Nil(t, c1.UnmarshalJSON(b))
+	assert.EqualValues(t, c, c1)
+}
@@ -0,0 +1,243 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/docker/libkv/store"
+	"github.com/docker/libnetwork/datastore"
+)
+
+const (
+	storeBucket      = "libnetwork"    // bucket of the libnetwork local store
+	storeMetadataLen = 8               // libkv prefixes values with their index
+	storeOpenTimeout = 5 * time.Second // the plugin only locks the file during an operation
+)
+
+// EndpointState is a stored endpoint as printed by the inspect commands
+type EndpointState struct {
+	ID          string
+	NetworkID   string
+	SrcName     string
+	MacAddress  string
+	Address     string
+	AddressIPv6 string
+	LinkExists  bool
+	SandboxKey  string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+}
+
+// NetworkState groups the stored endpoints of a network with its parent and
+// mode, which are empty when the network configuration is not stored
+type NetworkState struct {
+	ID          string
+	Parent      string              `json:",omitempty"`
+	MacvlanMode string              `json:",omitempty"`
+	LinkType    string              `json:",omitempty"`
+	Bridge      string              `json:",omitempty"`
+	Vrf         string              `json:",omitempty"`
+	Reserved    map[string][]net.IP `json:",omitempty"` // the auxiliary addresses by name
+	Endpoints   []*EndpointState
+}
+
+type byNetworkID []*NetworkState
+
+func (s byNetworkID) Len() int           { return len(s) }
+func (s byNetworkID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNetworkID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type byEndpointID []*EndpointState
+
+func (s byEndpointID) Len() int           { return len(s) }
+func (s byEndpointID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEndpointID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// DefaultStorePath returns libnetwork's default boltdb file
+func DefaultStorePath() string {
+	return datastore.DefaultScopes("")[datastore.LocalScope].Client.Address
+}
+
+// ReadStoreState reads the networks and endpoints of the store without going
+// through the plugin
+func ReadStoreState(opts Options) ([]*NetworkState, error) {
+	configs, endpoints, err := readRecords(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	networks := make(map[string]*NetworkState)
+	for _, config := range configs {
+		n := &NetworkState{ID: config.ID, Parent: config.Parent, MacvlanMode: config.MacvlanMode, LinkType: config.LinkType, Bridge: config.Bridge, Vrf: config.Vrf}
+		if reserved := config.reservedAddresses(); len(reserved) > 0 {
+			n.Reserved = reserved
+		}
+		networks[config.ID] = n
+	}
+	for _, ep := range endpoints {
+		n, ok := networks[ep.nid]
+		if !ok {
+			n = &NetworkState{ID: ep.nid}
+			networks[ep.nid] = n
+		}
+		n.Endpoints = append(n.Endpoints, ep.state())
+	}
+
+	ls := make([]*NetworkState, 0, len(networks))
+	for _, n := range networks {
+		sort.Sort(byEndpointID(n.Endpoints))
+		ls = append(ls, n)
+	}
+	sort.Sort(byNetworkID(ls))
+
+	return ls, nil
+}
+
+// readRecords decodes the network and endpoint records of the store. A
+// boltdb file is opened read-only so it can be read while the plugin runs.
+// Malformed records are skipped, the plugin quarantines them on restore.
+func readRecords(opts Options) ([]*configuration, []*endpoint, error) {
+	if opts.storeBackend() != storeBoltDB {
+		return readKVRecords(opts)
+	}
+	path := opts.StorePath
+	if path == "" {
+		path = DefaultStorePath()
+	}
+	// bolt would create a missing file even when read-only
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("could not open the local store: %v", err)
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true, Timeout: storeOpenTimeout})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open the local store %s: %v", path, err)
+	}
+	defer db.Close()
+
+	var (
+		configs   []*configuration
+		endpoints []*endpoint
+	)
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(opts.storeBucket()))
+		if bucket == nil {
+			return nil
+		}
+		scan(bucket, datastore.Key(macvlanNetworkPrefix), func(k, b []byte) {
+			if config := decodeConfig(k, b); config != nil {
+				configs = append(configs, config)
+			}
+		})
+		scan(bucket, datastore.Key(macvlanEndpointPrefix), func(k, b []byte) {
+			if ep := decodeEndpoint(k, b); ep != nil {
+				endpoints = append(endpoints, ep)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the local store %s: %v", path, err)
+	}
+
+	return configs, endpoints, nil
+}
+
+// readKVRecords lists the network and endpoint records of a libkv store
+func readKVRecords(opts Options) ([]*configuration, []*endpoint, error) {
+	ds, err := openStore(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ds.Close()
+
+	var (
+		configs   []*configuration
+		endpoints []*endpoint
+	)
+	kvs, err := ds.KVStore().List(datastore.Key(macvlanNetworkPrefix))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, nil, fmt.Errorf("could not read the networks of the store: %v", err)
+	}
+	for _, kv := range kvs {
+		if config := decodeConfig([]byte(kv.Key), kv.Value); config != nil {
+			configs = append(configs, config)
+		}
+	}
+	kvs, err = ds.KVStore().List(datastore.Key(macvlanEndpointPrefix))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, nil, fmt.Errorf("could not read the endpoints of the store: %v", err)
+	}
+	for _, kv := range kvs {
+		if ep := decodeEndpoint([]byte(kv.Key), kv.Value); ep != nil {
+			endpoints = append(endpoints, ep)
+		}
+	}
+
+	return configs, endpoints, nil
+}
+
+// decodeConfig decodes a network record, warning when it is malformed
+func decodeConfig(k, b []byte) *configuration {
+	config := &configuration{}
+	if err := config.UnmarshalJSON(b); err != nil {
+		logrus.Warnf("Skipping record %s: %v", k, err)
+		return nil
+	}
+
+	return config
+}
+
+// decodeEndpoint decodes an endpoint record, warning when it is malformed
+func decodeEndpoint(k, b []byte) *endpoint {
+	ep := &endpoint{}
+	if err := ep.UnmarshalJSON(b); err != nil {
+		logrus.Warnf("Skipping record %s: %v", k, err)
+		return nil
+	}
+
+	return ep
+}
+
+// scan passes the values under prefix to decode, without the libkv index
+func scan(bucket *bolt.Bucket, prefix string, decode func(k, b []byte)) {
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		if len(v) < storeMetadataLen {
+			logrus.Warnf("Skipping truncated record %s", k)
+			continue
+		}
+		decode(k, v[storeMetadataLen:])
+	}
+}
+
+// state returns the printable view of the endpoint
+func (ep *endpoint) state() *EndpointState {
+	s := &EndpointState{
+		ID:        ep.id,
+		NetworkID: ep.nid,
+		SrcName:   ep.srcName,
+	}
+	if len(ep.mac) != 0 {
+		s.MacAddress = ep.mac.String()
+	}
+	if ep.addr != nil {
+		s.Address = ep.addr.String()
+	}
+	if ep.addrv6 != nil {
+		s.AddressIPv6 = ep.addrv6.String()
+	}
+	if ep.srcName != "" {
+		s.LinkExists = parentExists(ep.srcName)
+	}
+	if ep.sandbox != nil {
+		s.SandboxKey = ep.sandbox.Key
+	}
+	s.Labels = ep.labels
+
+	return s
+}
@@ -0,0 +1,65 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initStoreFile returns a driver backed by a boltdb file in a temporary directory
+func initStoreFile(t *testing.T) (string, *Driver) {
+	dir, err := ioutil.TempDir("", "macvlan-store")
+	assert.Nil(t, err)
+	d := NewDriver(Options{StorePath: filepath.Join(dir, "local-kv.db")})
+	assert.Nil(t, d.store.InitStore(d))
+	return dir, d
+}
+
+func TestReadStoreState(t *testing.T) {
+	dir, d := initStoreFile(t)
+	defer os.RemoveAll(dir)
+	_, _, _, ep := initEndpointData()
+	ep.srcName = "lo"
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	ep2 := &endpoint{id: "0abcdef", nid: "2", srcName: "veth0000001"}
+	assert.Nil(t, d.store.StoreUpdate(ep2))
+	config := &configuration{ID: "2", Parent: "eth0", MacvlanMode: modeBridge, Ipv4Subnets: []*ipv4Subnet{{
+		SubnetIP:     "192.168.3.0/24",
+		AuxAddresses: map[string]string{"router": "192.168.3.5"},
+	}}}
+	assert.Nil(t, d.store.StoreUpdate(config))
+
+	ns, err := ReadStoreState(d.opts)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []*NetworkState{
+		{
+			ID: "1",
+			Endpoints: []*EndpointState{{
+				ID:          "1234567",
+				NetworkID:   "1",
+				SrcName:     "lo",
+				MacAddress:  "02:42:c0:a8:02:02",
+				Address:     "192.168.2.2/24",
+				AddressIPv6: "fe80::c0a8:202/120",
+				LinkExists:  true,
+			}},
+		},
+		{
+			ID:          "2",
+			Parent:      "eth0",
+			MacvlanMode: modeBridge,
+			Reserved:    map[string][]net.IP{"router": {net.ParseIP("192.168.3.5")}},
+			Endpoints:   []*EndpointState{{ID: "0abcdef", NetworkID: "2", SrcName: "veth0000001"}},
+		},
+	}, ns)
+	assert.Nil(t, d.Close())
+}
+
+func TestReadStoreStateWithErr(t *testing.T) {
+	_, err := ReadStoreState(Options{StorePath: "/nonexistent/local-kv.db"})
+	assert.NotNil(t, err)
+}
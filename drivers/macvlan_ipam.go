@@ -0,0 +1,164 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// auxAddresses parses the auxiliary addresses docker reserves in the subnet,
+// the daemon passes them in CIDR notation and swarm as plain addresses
+func auxAddresses(subnet string, aux map[string]interface{}) (map[string]string, error) {
+	if len(aux) == 0 {
+		return nil, nil
+	}
+	_, pool, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	addrs := make(map[string]string, len(aux))
+	for name, v := range aux {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("auxiliary address %s must be a string, received %v", name, v)
+		}
+		ip := parseAddress(s)
+		if ip == nil {
+			return nil, fmt.Errorf("auxiliary address %s=%s is not a valid address", name, s)
+		}
+		if !pool.Contains(ip) {
+			return nil, fmt.Errorf("auxiliary address %s=%s is outside the subnet %s", name, s, subnet)
+		}
+		addrs[name] = ip.String()
+	}
+
+	return addrs, nil
+}
+
+// parseAddress parses an address with or without a prefix length
+func parseAddress(s string) net.IP {
+	if ip, _, err := net.ParseCIDR(s); err == nil {
+		return ip
+	}
+
+	return net.ParseIP(s)
+}
+
+// parseIPRange verifies the ip range of a swarm network lies in its subnet
+func parseIPRange(subnet, ipRange string) error {
+	if ipRange == "" {
+		return nil
+	}
+	_, pool, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+	_, r, err := net.ParseCIDR(ipRange)
+	if err != nil {
+		return fmt.Errorf("invalid ip range %s: %v", ipRange, err)
+	}
+	poolOnes, _ := pool.Mask.Size()
+	rangeOnes, _ := r.Mask.Size()
+	if !pool.Contains(r.IP) || rangeOnes < poolOnes {
+		return fmt.Errorf("ip range %s is outside the subnet %s", ipRange, subnet)
+	}
+
+	return nil
+}
+
+// swarmIPRanges sets the ip ranges of the subnets from the network inspected
+// through swarm, docker passes the pools and auxiliary addresses of a network
+// to remote drivers but not its ip ranges. Without a swarm connection, or
+// before docker has stored the network, the subnets have no range.
+func (d *Driver) swarmIPRanges(config *configuration) error {
+	if d.Degraded() {
+		return nil
+	}
+	nw, err := d.swarmNetworkInfo(config.ID)
+	if err != nil {
+		logrus.Debugf("Network (%s) ip ranges not found from swarm: %v", config.ID, err)
+		return nil
+	}
+	for _, ipd := range nw.IPAM.Config {
+		if err := parseIPRange(ipd.Subnet, ipd.IPRange); err != nil {
+			return err
+		}
+		for _, s := range config.Ipv4Subnets {
+			if s.SubnetIP == ipd.Subnet {
+				s.IPRange = ipd.IPRange
+			}
+		}
+		for _, s := range config.Ipv6Subnets {
+			if s.SubnetIP == ipd.Subnet {
+				s.IPRange = ipd.IPRange
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkSubnetAddress verifies an endpoint address of the subnet lies in its
+// ip range and isn't one of its auxiliary addresses
+func checkSubnetAddress(ip net.IP, ipRange string, aux map[string]string) error {
+	if ipRange != "" {
+		if _, r, err := net.ParseCIDR(ipRange); err == nil && !r.Contains(ip) {
+			return fmt.Errorf("address %s is outside the ip range %s", ip, ipRange)
+		}
+	}
+	for name, a := range aux {
+		if ip.Equal(net.ParseIP(a)) {
+			return &auxAddressError{ip: ip, name: name}
+		}
+	}
+
+	return nil
+}
+
+// auxAddressError is returned for an endpoint address reserved by docker
+type auxAddressError struct {
+	ip   net.IP
+	name string
+}
+
+func (e *auxAddressError) Error() string {
+	return fmt.Sprintf("address %s is reserved as the auxiliary address %s", e.ip, e.name)
+}
+
+// checkEndpointAddresses verifies the endpoint addresses against the ip
+// ranges and auxiliary addresses of their subnets
+func (n *network) checkEndpointAddresses(ep *endpoint) error {
+	if s := n.getSubnetforIPv4(ep.addr); s != nil {
+		if err := checkSubnetAddress(ep.addr.IP, s.IPRange, s.AuxAddresses); err != nil {
+			return err
+		}
+	}
+	if s := n.getSubnetforIPv6(ep.addrv6); s != nil {
+		if err := checkSubnetAddress(ep.addrv6.IP, s.IPRange, s.AuxAddresses); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reservedAddresses returns the auxiliary addresses of the network by name,
+// docker never assigns them to containers, inspect lists them with the
+// network
+func (config *configuration) reservedAddresses() map[string][]net.IP {
+	reserved := make(map[string][]net.IP)
+	add := func(aux map[string]string) {
+		for name, a := range aux {
+			reserved[name] = append(reserved[name], net.ParseIP(a))
+		}
+	}
+	for _, s := range config.Ipv4Subnets {
+		add(s.AuxAddresses)
+	}
+	for _, s := range config.Ipv6Subnets {
+		add(s.AuxAddresses)
+	}
+
+	return reserved
+}
@@ -0,0 +1,134 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProcessIPAMAuxAddresses(t *testing.T) {
+	config := &configuration{}
+	err := config.processIPAM("1", []*pluginNet.IPAMData{{
+		Pool:         "192.168.1.0/24",
+		Gateway:      "192.168.1.1/24",
+		AuxAddresses: map[string]interface{}{"router": "192.168.1.5/24"},
+	}}, []*pluginNet.IPAMData{{
+		Pool:         "fd00::/64",
+		Gateway:      "fd00::1/64",
+		AuxAddresses: map[string]interface{}{"router": "fd00::5/64"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"router": "192.168.1.5"}, config.Ipv4Subnets[0].AuxAddresses)
+	assert.Equal(t, map[string][]net.IP{"router": {net.ParseIP("192.168.1.5"), net.ParseIP("fd00::5")}}, config.reservedAddresses())
+
+	for _, c := range []struct {
+		aux map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{"router": "192.168.2.5/24"}, "auxiliary address router=192.168.2.5/24 is outside the subnet 192.168.1.0/24"},
+		{map[string]interface{}{"router": "router"}, "auxiliary address router=router is not a valid address"},
+		{map[string]interface{}{"router": 5.0}, "auxiliary address router must be a string, received 5"},
+	} {
+		err := (&configuration{}).processIPAM("1", []*pluginNet.IPAMData{{Pool: "192.168.1.0/24", AuxAddresses: c.aux}}, nil)
+		assert.EqualError(t, err, c.err)
+	}
+}
+
+func TestProcessIPAMFromSwarmRange(t *testing.T) {
+	config := &configuration{ID: "1"}
+	err := config.processIPAMFromSwarm("1", []docker.IPAMConfig{{
+		Subnet:     "192.168.1.0/24",
+		Gateway:    "192.168.1.1",
+		IPRange:    "192.168.1.128/25",
+		AuxAddress: map[string]string{"host": "192.168.1.2"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, &ipv4Subnet{
+		SubnetIP:     "192.168.1.0/24",
+		GwIP:         "192.168.1.1",
+		IPRange:      "192.168.1.128/25",
+		AuxAddresses: map[string]string{"host": "192.168.1.2"},
+	}, config.Ipv4Subnets[0])
+
+	// the range and the reserved addresses survive a restart
+	b, err := config.MarshalJSON()
+	assert.Nil(t, err)
+	config1 := &configuration{}
+	assert.Nil(t, config1.UnmarshalJSON(b))
+	assert.Equal(t, config.Ipv4Subnets, config1.Ipv4Subnets)
+
+	err = (&configuration{}).processIPAMFromSwarm("1", []docker.IPAMConfig{{Subnet: "192.168.1.0/24", IPRange: "192.168.0.0/16"}})
+	assert.EqualError(t, err, "ip range 192.168.0.0/16 is outside the subnet 192.168.1.0/24")
+}
+
+func TestCreateEndpointWithReservedAddress(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	s := d.networks[r.NetworkID].config.Ipv4Subnets[0]
+	s.AuxAddresses = map[string]string{"host": "192.168.2.2"}
+	_, err := d.CreateEndpoint(r)
+	assert.EqualError(t, err, "create endpoint was passed an invalid address: address 192.168.2.2 is reserved as the auxiliary address host")
+	_, ok := err.(types.ForbiddenError)
+	assert.True(t, ok)
+
+	s.AuxAddresses = nil
+	ms.On("StoreUpdate", ep).Return(nil)
+	_, err = d.CreateEndpoint(r)
+	assert.Nil(t, err)
+}
+
+func TestCreateNetworkWithSwarmIPRange(t *testing.T) {
+	ipRange := "192.168.1.128/25"
+	manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_ping":
+			fmt.Fprint(w, "OK")
+		case "/networks/1":
+			fmt.Fprintf(w, `{"Id": "1", "Driver": "macvlan_swarm", "IPAM": {"Config": [{"Subnet": "192.168.1.0/24", "IPRange": "%s"}]}}`, ipRange)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer manager.Close()
+	ms, d, r, _ := initNetworkData()
+	assert.Nil(t, d.SetSwarm(manager.URL, "", "", ""))
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	assert.Nil(t, d.CreateNetwork(r))
+	assert.Equal(t, ipRange, d.networks["1"].config.Ipv4Subnets[0].IPRange)
+	assert.Empty(t, d.networks["1"].config.Ipv6Subnets[0].IPRange)
+
+	er := &pluginNet.CreateEndpointRequest{
+		NetworkID:  "1",
+		EndpointID: "1234567",
+		Interface:  &pluginNet.EndpointInterface{Address: "192.168.1.2/24"},
+	}
+	_, err := d.CreateEndpoint(er)
+	assert.EqualError(t, err, "create endpoint was passed an invalid address: address 192.168.1.2 is outside the ip range 192.168.1.128/25")
+	_, ok := err.(types.BadRequestError)
+	assert.True(t, ok)
+	er.Interface.Address = "192.168.1.130/24"
+	_, err = d.CreateEndpoint(er)
+	assert.Nil(t, err)
+
+	// a range outside the subnet fails the create
+	ipRange = "10.0.0.0/25"
+	_, d, r, _ = initNetworkData()
+	assert.Nil(t, d.SetSwarm(manager.URL, "", "", ""))
+	err = d.CreateNetwork(r)
+	assert.EqualError(t, err, "ip range 10.0.0.0/25 is outside the subnet 192.168.1.0/24")
+	_, ok = err.(types.BadRequestError)
+	assert.True(t, ok)
+
+	// without a swarm connection the subnets have no range
+	ms, d, r, _ = initNetworkData()
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	assert.Nil(t, d.CreateNetwork(r))
+	assert.Empty(t, d.networks["1"].config.Ipv4Subnets[0].IPRange)
+}
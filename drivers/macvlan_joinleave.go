@@ -9,6 +9,7 @@ import (
 	pluginNet "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/ns"
 	"github.com/docker/libnetwork/osl"
+	"github.com/docker/libnetwork/types"
 )
 
 // Join method is invoked when a Sandbox is attached to an endpoint.
@@ -21,11 +22,15 @@ func (d *Driver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error)
 	if err != nil {
 		return nil, err
 	}
+	if !d.acquire(n) {
+		return nil, types.NotFoundErrorf("network not found: %s", nid)
+	}
+	defer n.release()
 	ep := n.endpoint(eid)
 	if ep == nil {
 		str := fmt.Sprintf("could not find endpoint with id %s", eid)
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.NotFoundErrorf("%s", str)
 	}
 
 	// parse and match the endpoint address with the available v4 subnets
@@ -35,13 +40,13 @@ func (d *Driver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error)
 		if s == nil {
 			str := fmt.Sprintf("could not find a valid ipv4 subnet for endpoint %s", eid)
 			logrus.Errorf(str)
-			return nil, fmt.Errorf(str)
+			return nil, types.InternalErrorf("%s", str)
 		}
 		v4gw, _, err := net.ParseCIDR(s.GwIP)
 		if err != nil {
 			str := fmt.Sprintf("gatway %s is not a valid ipv4 address: %v", s.GwIP, err)
 			logrus.Errorf(str)
-			return nil, fmt.Errorf(str)
+			return nil, types.InternalErrorf("%s", str)
 		}
 		v4gwStr = v4gw.String()
 		logrus.Infof("Macvlan Endpoint Joined with IPv4_Addr: %s, Gateway: %s, MacVlan_Mode: %s, Parent: %s",
@@ -51,36 +56,78 @@ func (d *Driver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error)
 	if len(n.config.Ipv6Subnets) > 0 {
 		s := n.getSubnetforIPv6(ep.addrv6)
 		if s == nil {
-			return nil, fmt.Errorf("could not find a valid ipv6 subnet for endpoint %s", eid)
+			return nil, types.InternalErrorf("could not find a valid ipv6 subnet for endpoint %s", eid)
 		}
 		v6gw, _, err := net.ParseCIDR(s.GwIP)
 		if err != nil {
-			return nil, fmt.Errorf("gatway %s is not a valid ipv6 address: %v", s.GwIP, err)
+			return nil, types.InternalErrorf("gatway %s is not a valid ipv6 address: %v", s.GwIP, err)
 		}
 		v6gwStr = v6gw.String()
 		logrus.Infof("Macvlan Endpoint Joined with IPv6_Addr: %s Gateway: %s MacVlan_Mode: %s, Parent: %s",
 			ep.addrv6.IP.String(), v6gw.String(), n.config.MacvlanMode, n.config.Parent)
 	}
 
-	// generate a name for the iface that will be renamed to eth0 in the sbox
-	containerIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
-	if err != nil {
-		str := fmt.Sprintf("error generating an interface name: %s", err)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
-	}
-	// create the netlink macvlan interface
-	vethName, err := createMacVlan(containerIfName, n.config.Parent, n.config.MacvlanMode)
-	if err != nil {
-		str := fmt.Sprintf("Join: createMacVlan error: %s", err)
-		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+	// a retried join reuses the slave not yet moved into the sandbox
+	vethName := ep.srcName
+	if _, err := ns.NlHandle().LinkByName(vethName); vethName != "" && err == nil {
+		logrus.Infof("Join: reuse macvlan link %s of endpoint eid=%s", vethName, eid)
+	} else {
+		// generate a name for the iface that will be renamed to eth0 in the sbox
+		containerIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+		if err != nil {
+			str := fmt.Sprintf("error generating an interface name: %s", err)
+			logrus.Errorf(str)
+			return nil, types.InternalErrorf("%s", str)
+		}
+		if n.config.LinkType == linkBridge {
+			// create the veth pair attached to the bridge of the network
+			vethName, err = createBridgePort(containerIfName, n.config.Bridge, ep.mac, d.mtu(n.config))
+			if err != nil {
+				str := fmt.Sprintf("Join: createBridgePort error: %s", err)
+				logrus.Errorf(str)
+				return nil, types.InternalErrorf("%s", str)
+			}
+		} else {
+			// create the netlink macvlan interface
+			vethName, err = createMacVlan(containerIfName, n.config.Parent, n.config.MacvlanMode, n.config.LinkType, ep.mac, d.mtu(n.config))
+			if err != nil {
+				str := fmt.Sprintf("Join: createMacVlan error: %s", err)
+				logrus.Errorf(str)
+				return nil, types.InternalErrorf("%s", str)
+			}
+		}
+		// program the tc rate limits and dscp mark before the slave is moved into the sandbox
+		if err := setEndpointQos(vethName, ep.limits, n.config.Dscp); err != nil {
+			if link, lerr := ns.NlHandle().LinkByName(vethName); lerr == nil {
+				ns.NlHandle().LinkDel(link)
+			}
+			str := fmt.Sprintf("Join: %v", err)
+			logrus.Errorf(str)
+			return nil, types.InternalErrorf("%s", str)
+		}
+		// a VM opens the character device of a macvtap slave, record it for EndpointInfo
+		if n.config.LinkType == linkMacvtap {
+			tap, err := macvtapDevice(vethName)
+			if err != nil {
+				if link, lerr := ns.NlHandle().LinkByName(vethName); lerr == nil {
+					ns.NlHandle().LinkDel(link)
+				}
+				str := fmt.Sprintf("Join: %v", err)
+				logrus.Errorf(str)
+				return nil, types.InternalErrorf("%s", str)
+			}
+			ep.tap = tap
+		}
 	}
 
+	// record the sandbox for the operations inside the container namespace
+	prev := ep.sandbox
+	ep.sandbox = ep.joinSandbox(r.SandboxKey, r.Options)
 	if err := d.store.StoreUpdate(ep); err != nil {
+		ep.sandbox = prev
 		str := fmt.Sprintf("failed to save macvlan endpoint %s to store: %v", ep.id[0:7], err)
 		logrus.Errorf(str)
-		return nil, fmt.Errorf(str)
+		return nil, types.RetryErrorf("%s", str)
 	}
 	// bind the generated iface name to the endpoint
 	ep.srcName = vethName
@@ -90,8 +137,23 @@ func (d *Driver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error)
 			SrcName:   ep.srcName,
 			DstPrefix: containerVethPrefix,
 		},
-		Gateway:     v4gwStr,
-		GatewayIPv6: v6gwStr,
+		Gateway:      v4gwStr,
+		GatewayIPv6:  v6gwStr,
+		StaticRoutes: joinRoutes(n.config.StaticRoutes, ep.routes),
+	}
+	// an internal network has no way out, leave the default route to the
+	// other networks of the container
+	if n.config.Internal {
+		res.Gateway = ""
+		res.GatewayIPv6 = ""
+		res.DisableGatewayService = true
+	}
+	// tune the interface once the daemon moved it into the sandbox
+	if t := n.config.Tuning.merge(ep.tuning); t != nil && r.SandboxKey != "" {
+		if link, err := ns.NlHandle().LinkByName(vethName); err == nil {
+			d.setTuningStatus(eid, tuningPending)
+			go d.tuneEndpoint(eid, r.SandboxKey, vethName, link.Attrs().HardwareAddr, t, tuneTimeout)
+		}
 	}
 	return res, nil
 }
@@ -102,21 +164,35 @@ func (d *Driver) Leave(r *pluginNet.LeaveRequest) error {
 	eid := r.EndpointID
 	logrus.Infof("Leave macvlan nid=%s,eid=%s", nid, eid)
 	if nid == "" {
-		return fmt.Errorf("invalid network id")
+		return types.BadRequestErrorf("invalid network id")
 	}
 	if eid == "" {
-		return fmt.Errorf("invalid endpoint id")
+		return types.BadRequestErrorf("invalid endpoint id")
 	}
+	// nothing is left to detach when the network or the endpoint is gone
 	n, err := d.getNetwork(nid)
-	if err != nil {
-		return err
-	}
-	ep, err := n.getEndpoint(eid)
-	if err != nil {
-		return err
+	if err != nil || !d.acquire(n) {
+		logrus.Infof("Leave: network nid=%s not found", nid)
+		return nil
 	}
+	defer n.release()
+	ep := n.endpoint(eid)
 	if ep == nil {
-		return fmt.Errorf("could not find endpoint with id %s", eid)
+		logrus.Infof("Leave: endpoint eid=%s not found", eid)
+		return nil
+	}
+	d.setTuningStatus(eid, "")
+	// forget the sandbox, a retried leave finds it already cleared
+	if ep.sandbox == nil {
+		return nil
+	}
+	prev := ep.sandbox
+	ep.sandbox = nil
+	if err := d.store.StoreUpdate(ep); err != nil {
+		ep.sandbox = prev
+		str := fmt.Sprintf("failed to save macvlan endpoint %s to store: %v", ep.id[0:7], err)
+		logrus.Errorf(str)
+		return types.RetryErrorf("%s", str)
 	}
 
 	return nil
@@ -139,3 +139,35 @@ func TestLeaveWithInvalidEndpointId(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, "invalid endpoint id")
 }
+
+func TestJoinReplay(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	jr := &pluginNet.JoinRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	res, err := d.Join(jr)
+	assert.Nil(t, err)
+	defer func() {
+		if link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+	}()
+	// the slave is still in the host namespace, the retry reuses it
+	res1, err := d.Join(jr)
+	assert.Nil(t, err)
+	assert.Equal(t, res, res1)
+}
+
+func TestLeaveReplay(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	lr := &pluginNet.LeaveRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	assert.Nil(t, d.Leave(lr))
+	lr.NetworkID = "2"
+	assert.Nil(t, d.Leave(lr))
+}
@@ -0,0 +1,91 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// Revalidate re-checks the networks known to the driver against the host. A
+// slave link the driver created and that went away is recreated, any other
+// problem is reported.
+func (d *Driver) Revalidate() error {
+	var invalid []string
+	for _, n := range d.getnetworks() {
+		// the links are set up again under the lock of the network, a network
+		// deleted meanwhile is skipped
+		if !d.acquire(n) {
+			continue
+		}
+		err := n.revalidate()
+		n.release()
+		if err != nil {
+			logrus.Errorf("Network (%s) failed revalidation: %v", n.id, err)
+			invalid = append(invalid, n.id)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("networks failed revalidation: %s", strings.Join(invalid, ", "))
+	}
+
+	return nil
+}
+
+func (n *network) revalidate() error {
+	n.Lock()
+	config := n.config
+	n.Unlock()
+	if err := config.validateQosOptions(); err != nil {
+		return err
+	}
+	if err := config.validateRoutes(config.StaticRoutes); err != nil {
+		return err
+	}
+	if _, err := parseMacPolicy(config.MacPolicy); err != nil {
+		return err
+	}
+	if !parentExists(config.Parent) {
+		if !config.CreatedSlaveLink {
+			return fmt.Errorf("parent link %s not found", config.Parent)
+		}
+		logrus.Warnf("Recreating missing parent link %s of network (%s)", config.Parent, n.id)
+		var err error
+		if config.Internal {
+			err = createDummyLink(config.Parent, getDummyName(stringid.TruncateID(config.ID)))
+		} else {
+			err = createVlanLink(config.Parent, config.EgressQosMap, config.IngressQosMap)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a recreated parent, bridge or vrf is attached again
+	if config.LinkType == linkBridge {
+		if err := config.setupBridge(); err != nil {
+			return err
+		}
+	}
+	if config.Vrf != "" {
+		return n.driver.setupVrf(config)
+	}
+
+	return nil
+}
+
+// Close stops the swarm reconnections and releases the local store, the
+// driver must not serve requests afterwards
+func (d *Driver) Close() error {
+	d.Lock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	d.Unlock()
+	if d.store == nil {
+		return nil
+	}
+
+	return d.store.Close()
+}
@@ -0,0 +1,27 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidate(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	assert.Nil(t, d.Revalidate())
+
+	c := d.networks[r.NetworkID].config
+	c.Parent = "missing0"
+	assert.EqualError(t, d.Revalidate(), "networks failed revalidation: 1")
+
+	c.Parent = "eth0"
+	c.MacPolicy = "vendor"
+	assert.EqualError(t, d.Revalidate(), "networks failed revalidation: 1")
+}
+
+func TestClose(t *testing.T) {
+	ms, d, _, _ := initEndpointData()
+	ms.On("Close").Return(nil)
+	assert.Nil(t, d.Close())
+	ms.AssertCalled(t, "Close")
+}
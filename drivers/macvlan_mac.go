@@ -0,0 +1,71 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+)
+
+const (
+	macPolicyOpt    = "mac_policy" // -o mac_policy=ip|random|hash|oui:<prefix>
+	macPolicyIP     = "ip"         // 02:42 followed by the ipv4 address, the default
+	macPolicyRandom = "random"     // random locally administered address
+	macPolicyHash   = "hash"       // locally administered address hashed from the network and endpoint ids
+	macPolicyOUI    = "oui"        // vendor prefix followed by a hash of the network and endpoint ids
+)
+
+// parseMacPolicy validates a -o mac_policy value, returning the vendor
+// prefix of an oui:<prefix> policy
+func parseMacPolicy(policy string) (net.HardwareAddr, error) {
+	switch policy {
+	case "", macPolicyIP, macPolicyRandom, macPolicyHash:
+		return nil, nil
+	}
+	if !strings.HasPrefix(policy, macPolicyOUI+":") {
+		return nil, fmt.Errorf("unknown mac policy %s, use one of ip, random, hash or oui:<prefix>", policy)
+	}
+	prefix := strings.TrimPrefix(policy, macPolicyOUI+":")
+	var oui net.HardwareAddr
+	for _, part := range strings.FieldsFunc(prefix, func(r rune) bool {
+		return r == ':' || r == '-'
+	}) {
+		var b byte
+		if len(part) != 2 {
+			return nil, fmt.Errorf("invalid oui prefix %s, ex. oui:00:16:3e", prefix)
+		}
+		if _, err := fmt.Sscanf(part, "%02x", &b); err != nil {
+			return nil, fmt.Errorf("invalid oui prefix %s, ex. oui:00:16:3e", prefix)
+		}
+		oui = append(oui, b)
+	}
+	if len(oui) == 0 || len(oui) > 5 {
+		return nil, fmt.Errorf("oui prefix %s must be between 1 and 5 bytes long", prefix)
+	}
+	if oui[0]&0x01 != 0 {
+		return nil, fmt.Errorf("oui prefix %s is a multicast address", prefix)
+	}
+
+	return oui, nil
+}
+
+// generateMAC returns the MAC of an endpoint created without one according
+// to the -o mac_policy of the network
+func (config *configuration) generateMAC(ep *endpoint) net.HardwareAddr {
+	seed := []byte(ep.nid + "/" + ep.id)
+	switch config.MacPolicy {
+	case macPolicyRandom:
+		return netutils.GenerateMACFromSeed(nil)
+	case macPolicyHash:
+		return netutils.GenerateMACFromSeed(seed)
+	case "", macPolicyIP:
+		return netutils.GenerateMACFromIP(ep.addr.IP)
+	}
+	oui, err := parseMacPolicy(config.MacPolicy)
+	if err != nil || oui == nil {
+		return netutils.GenerateMACFromSeed(seed)
+	}
+
+	return netutils.GenerateMACWithPrefix(oui, seed)
+}
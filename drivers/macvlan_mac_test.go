@@ -0,0 +1,84 @@
+package drivers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMacPolicy(t *testing.T) {
+	for _, p := range []string{"", "ip", "random", "hash"} {
+		oui, err := parseMacPolicy(p)
+		assert.Nil(t, err)
+		assert.Nil(t, oui)
+	}
+	oui, err := parseMacPolicy("oui:00:16:3e")
+	assert.Nil(t, err)
+	assert.EqualValues(t, net.HardwareAddr{0x00, 0x16, 0x3e}, oui)
+	oui, err = parseMacPolicy("oui:52-54-00")
+	assert.Nil(t, err)
+	assert.EqualValues(t, net.HardwareAddr{0x52, 0x54, 0x00}, oui)
+
+	_, err = parseMacPolicy("vendor")
+	assert.EqualError(t, err, "unknown mac policy vendor, use one of ip, random, hash or oui:<prefix>")
+	_, err = parseMacPolicy("oui:0:16:3e")
+	assert.EqualError(t, err, "invalid oui prefix 0:16:3e, ex. oui:00:16:3e")
+	_, err = parseMacPolicy("oui:")
+	assert.EqualError(t, err, "oui prefix  must be between 1 and 5 bytes long")
+	_, err = parseMacPolicy("oui:01:00:5e")
+	assert.EqualError(t, err, "oui prefix 01:00:5e is a multicast address")
+}
+
+func TestGenerateMAC(t *testing.T) {
+	_, d, r, ep := initEndpointData()
+	c := d.networks[r.NetworkID].config
+
+	assert.Equal(t, "02:42:c0:a8:02:02", c.generateMAC(ep).String())
+
+	c.MacPolicy = macPolicyHash
+	mac := c.generateMAC(ep)
+	assert.EqualValues(t, mac, c.generateMAC(ep))
+	assert.Equal(t, byte(0x02), mac[0]&0x03)
+
+	c.MacPolicy = macPolicyRandom
+	mac = c.generateMAC(ep)
+	assert.Equal(t, byte(0x02), mac[0]&0x03)
+
+	c.MacPolicy = "oui:00:16:3e"
+	mac = c.generateMAC(ep)
+	assert.EqualValues(t, net.HardwareAddr{0x00, 0x16, 0x3e}, mac[:3])
+	assert.EqualValues(t, mac, c.generateMAC(ep))
+}
+
+func TestCreateEndpointWithMacPolicy(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].config.MacPolicy = "oui:00:16:3e"
+	ep.mac = d.networks[r.NetworkID].config.generateMAC(ep)
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	assert.Equal(t, ep.mac.String(), res.Interface.MacAddress)
+	assert.EqualValues(t, ep, d.networks[ep.nid].endpoints[ep.id])
+}
+
+func TestCreateNetworkWithInvalidMacPolicy(t *testing.T) {
+	_, d, r, _ := initNetworkData()
+	opts := r.Options[netlabel.GenericData].(map[string]string)
+	opts[macPolicyOpt] = "oui:ff:ff:ff"
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "invalid -o mac_policy=oui:ff:ff:ff: oui prefix ff:ff:ff is a multicast address")
+	assert.Empty(t, d.networks[r.NetworkID])
+}
+
+func TestMarshaJSONForConfigWithMacPolicy(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	c := d.networks[r.NetworkID].config
+	c.MacPolicy = macPolicyHash
+	b, err := c.MarshalJSON()
+	assert.Nil(t, err)
+	c1 := &configuration{}
+	assert.Nil(t, c1.UnmarshalJSON(b))
+	assert.EqualValues(t, c, c1)
+}
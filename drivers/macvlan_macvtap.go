@@ -0,0 +1,77 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/libnetwork/ns"
+)
+
+const (
+	linkTypeOpt = "link_type" // -o link_type=macvlan|macvtap|bridge
+	linkMacvlan = "macvlan"   // a macvlan netdev, the default
+	linkMacvtap = "macvtap"   // a macvtap netdev with a /dev/tapN character device for VMs
+
+	// endpoint info of a macvtap endpoint
+	tapDeviceInfo = "macvtap.device" // /dev/tapN
+	tapDevInfo    = "macvtap.dev"    // major:minor of the character device
+)
+
+// sysClassNet is where the kernel exposes the net devices
+var sysClassNet = "/sys/class/net"
+
+// tapDevice is the character device of a macvtap slave, udev names it
+// /dev/tapN after the ifindex of the slave
+type tapDevice struct {
+	Path  string
+	Major uint32
+	Minor uint32
+}
+
+// parseLinkType verifies the -o link_type option
+func parseLinkType(linkType string) error {
+	switch linkType {
+	case "", linkMacvlan, linkMacvtap, linkBridge:
+		return nil
+	}
+
+	return fmt.Errorf("link type is not valid, use one of macvlan, macvtap or bridge")
+}
+
+// macvtapDevice returns the character device of the macvtap slave name. It
+// is read before the slave is moved into the sandbox, where the host sysfs
+// no longer shows it.
+func macvtapDevice(name string) (*tapDevice, error) {
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the macvtap link %s: %v", name, err)
+	}
+
+	return readTapDevice(name, link.Attrs().Index)
+}
+
+// readTapDevice reads the major:minor of the character device of the macvtap
+// slave name with the ifindex index
+func readTapDevice(name string, index int) (*tapDevice, error) {
+	tap := fmt.Sprintf("tap%d", index)
+	b, err := ioutil.ReadFile(filepath.Join(sysClassNet, name, "macvtap", tap, "dev"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the character device of the macvtap link %s: %v", name, err)
+	}
+	dev := &tapDevice{Path: "/dev/" + tap}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &dev.Major, &dev.Minor); err != nil {
+		return nil, fmt.Errorf("invalid character device %q of the macvtap link %s", strings.TrimSpace(string(b)), name)
+	}
+
+	return dev, nil
+}
+
+// info returns the endpoint info describing the device
+func (tap *tapDevice) info() map[string]string {
+	return map[string]string{
+		tapDeviceInfo: tap.Path,
+		tapDevInfo:    fmt.Sprintf("%d:%d", tap.Major, tap.Minor),
+	}
+}
@@ -0,0 +1,67 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTapDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(path string) { sysClassNet = path }(sysClassNet)
+	sysClassNet = dir
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "veth1", "macvtap", "tap12"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "veth1", "macvtap", "tap12", "dev"), []byte("246:3\n"), 0644))
+	tap, err := readTapDevice("veth1", 12)
+	assert.Nil(t, err)
+	assert.Equal(t, &tapDevice{Path: "/dev/tap12", Major: 246, Minor: 3}, tap)
+	assert.Equal(t, map[string]string{tapDeviceInfo: "/dev/tap12", tapDevInfo: "246:3"}, tap.info())
+
+	_, err = readTapDevice("veth1", 13)
+	assert.NotNil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "veth1", "macvtap", "tap12", "dev"), []byte("246\n"), 0644))
+	_, err = readTapDevice("veth1", 12)
+	assert.EqualError(t, err, `invalid character device "246" of the macvtap link veth1`)
+}
+
+func TestJoinWithMacvtap(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].config.LinkType = linkMacvtap
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.Join(&pluginNet.JoinRequest{NetworkID: r.NetworkID, EndpointID: r.EndpointID})
+	assert.Nil(t, err)
+	link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName)
+	assert.Nil(t, err)
+	defer ns.NlHandle().LinkDel(link)
+	assert.Equal(t, linkMacvtap, link.Type())
+
+	info, err := d.EndpointInfo(&pluginNet.InfoRequest{NetworkID: r.NetworkID, EndpointID: r.EndpointID})
+	assert.Nil(t, err)
+	assert.NotNil(t, ep.tap)
+	assert.Equal(t, ep.tap.info(), info.Value)
+	assert.Regexp(t, `^/dev/tap[0-9]+$`, info.Value[tapDeviceInfo])
+
+	// the device survives a restart
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	ep1 := &endpoint{}
+	assert.Nil(t, ep1.UnmarshalJSON(b))
+	assert.Equal(t, ep.tap, ep1.tap)
+}
+
+func TestEndpointInfoWithMacvlan(t *testing.T) {
+	_, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	info, err := d.EndpointInfo(&pluginNet.InfoRequest{NetworkID: r.NetworkID, EndpointID: r.EndpointID})
+	assert.Nil(t, err)
+	assert.Empty(t, info.Value)
+}
@@ -0,0 +1,356 @@
+package drivers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/options"
+)
+
+// optionPhase is the request a network configuration is built for
+type optionPhase uint8
+
+const (
+	phaseAllocate optionPhase = 1 << iota // AllocateNetwork on the swarm manager
+	phaseCreate                           // CreateNetwork on each node
+	phaseRestore                          // a network restored from swarm
+
+	phaseAll = phaseAllocate | phaseCreate | phaseRestore
+)
+
+// optionKind is the type of the value of a network option
+type optionKind int
+
+const (
+	optString optionKind = iota
+	optUint
+)
+
+// networkOption is the schema of a -o network option
+type networkOption struct {
+	name   string
+	kind   optionKind
+	phases optionPhase                            // requests the default applies to
+	set    func(c *configuration, v string) error // validates and binds the value
+	def    func(d *Driver, c *configuration)      // fills the option when it is not set
+}
+
+// networkOptions are the -o options accepted by macvlan networks
+var networkOptions = []*networkOption{
+	{
+		name:   parentOpt,
+		phases: phaseCreate | phaseRestore,
+		set: func(c *configuration, v string) error {
+			if v == "lo" {
+				return fmt.Errorf("loopback interface is not a valid %s parent link", macvlanType)
+			}
+			c.Parent = v
+			return nil
+		},
+		def: func(d *Driver, c *configuration) {
+			// if parent interface not specified, create a dummy type link to use named dummy+net_id
+			if c.Parent == "" {
+				c.Parent = getDummyName(stringid.TruncateID(c.ID))
+				// empty parent and --internal are handled the same. Set here to update k/v
+				c.Internal = true
+			}
+		},
+	},
+	{
+		name:   driverModeOpt,
+		phases: phaseAll,
+		set: func(c *configuration, v string) error {
+			switch v {
+			case modeBridge, modePrivate, modePassthru, modeVepa:
+				c.MacvlanMode = v
+				return nil
+			}
+			return fmt.Errorf("macvlan mode is not valid, use one of bridge, private, vepa or passthru")
+		},
+		def: func(d *Driver, c *configuration) {
+			// default to the daemon default mode, bridge unless configured
+			if c.MacvlanMode == "" {
+				c.MacvlanMode = d.defaultMode()
+			}
+		},
+	},
+	{
+		name: linkTypeOpt,
+		set: func(c *configuration, v string) error {
+			c.LinkType = v
+			return parseLinkType(v)
+		},
+	},
+	{
+		name: vrfOpt,
+		set: func(c *configuration, v string) error {
+			c.Vrf = v
+			return parseVrfName(v)
+		},
+	},
+	{
+		name: vrfTableOpt,
+		kind: optUint,
+		set: func(c *configuration, v string) error {
+			_, err := parseVrfTable(v)
+			c.VrfTable = v
+			return err
+		},
+	},
+	{
+		name: egressQosOpt,
+		set: func(c *configuration, v string) error {
+			_, err := parseEgressQosMap(v)
+			c.EgressQosMap = v
+			return err
+		},
+	},
+	{
+		name: ingressQosOpt,
+		set: func(c *configuration, v string) error {
+			_, err := parseIngressQosMap(v)
+			c.IngressQosMap = v
+			return err
+		},
+	},
+	{
+		name: dscpOpt,
+		kind: optUint,
+		set: func(c *configuration, v string) error {
+			_, err := parseDscp(v)
+			c.Dscp = v
+			return err
+		},
+	},
+	{
+		name: routesOpt,
+		set: func(c *configuration, v string) (err error) {
+			c.StaticRoutes, err = parseRoutes(v)
+			return err
+		},
+	},
+	{
+		name: macPolicyOpt,
+		set: func(c *configuration, v string) error {
+			_, err := parseMacPolicy(v)
+			c.MacPolicy = v
+			return err
+		},
+	},
+	{
+		name: gatewayCheckOpt,
+		set: func(c *configuration, v string) error {
+			c.GatewayCheck, _ = strconv.ParseBool(v)
+			return parseGatewayCheck(v)
+		},
+	},
+}
+
+// lookupNetworkOption returns the schema of the option name
+func lookupNetworkOption(name string) *networkOption {
+	for _, o := range networkOptions {
+		if o.name == name {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// optionValue returns the value of the option as a string after checking its type
+func (o *networkOption) optionValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if o.kind == optUint {
+			if _, err := strconv.ParseUint(v, 0, 64); err != nil {
+				return "", fmt.Errorf("-o %s must be an unsigned integer, received %q", o.name, v)
+			}
+		}
+		return v, nil
+	case float64:
+		// json numbers
+		if o.kind == optUint && v >= 0 && v == float64(uint64(v)) {
+			return strconv.FormatUint(uint64(v), 10), nil
+		}
+	}
+	kind := "a string"
+	if o.kind == optUint {
+		kind = "an unsigned integer"
+	}
+
+	return "", fmt.Errorf("-o %s must be %s, received %v", o.name, kind, value)
+}
+
+// unknownOption returns the error of an unknown option, suggesting the
+// closest known one
+func unknownOption(name string) error {
+	best, dist := "", 3
+	for _, o := range networkOptions {
+		if d := editDistance(name, o.name); d < dist {
+			best, dist = o.name, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown option -o %s, did you mean -o %s", name, best)
+	}
+
+	return fmt.Errorf("unknown option -o %s", name)
+}
+
+// editDistance is the levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// parseNetworkOptions parses docker network options. Unknown options are
+// rejected, except the namespaced labels of other components and the
+// options of networks restored from swarm which are only logged.
+func parseNetworkOptions(id string, option map[string]interface{}, phase optionPhase) (*configuration, error) {
+	config := &configuration{ID: id}
+	// parse generic labels first
+	if genData, ok := option[netlabel.GenericData]; ok && genData != nil {
+		labels, err := genericOptions(genData)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.fromOptions(labels, phase); err != nil {
+			return nil, err
+		}
+	}
+	// setting the parent to "" will trigger an isolated network dummy parent link
+	if _, ok := option[netlabel.Internal]; ok {
+		config.Internal = true
+		// empty --parent= and --internal are handled the same.
+		config.Parent = ""
+	}
+
+	return config, nil
+}
+
+// genericOptions returns the generic driver docker network options as a map
+func genericOptions(data interface{}) (map[string]interface{}, error) {
+	switch opt := data.(type) {
+	case map[string]interface{}:
+		return opt, nil
+	case map[string]string:
+		labels := make(map[string]interface{}, len(opt))
+		for k, v := range opt {
+			labels[k] = v
+		}
+		return labels, nil
+	case options.Generic:
+		return opt, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized network configuration format: %v", data)
+}
+
+// fromOptions binds the generic options to the configuration
+func (config *configuration) fromOptions(labels map[string]interface{}, phase optionPhase) error {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := lookupNetworkOption(name)
+		if o == nil {
+			if strings.Contains(name, ".") || phase == phaseRestore {
+				logrus.Warnf("Ignoring unknown option -o %s of network %s", name, stringid.TruncateID(config.ID))
+				continue
+			}
+			return unknownOption(name)
+		}
+		v, err := o.optionValue(labels[name])
+		if err != nil {
+			return err
+		}
+		if err := o.set(config, v); err != nil {
+			return fmt.Errorf("invalid -o %s=%s: %v", name, v, err)
+		}
+	}
+
+	return nil
+}
+
+// complete fills the options left unset for the phase and verifies the
+// options depending on each other or on the network subnets
+func (config *configuration) complete(d *Driver, phase optionPhase) error {
+	for _, o := range networkOptions {
+		if o.def != nil && o.phases&phase != 0 {
+			o.def(d, config)
+		}
+	}
+	// verify the 802.1p maps have a vlan parent
+	if err := config.validateQosOptions(); err != nil {
+		return err
+	}
+	// verify the vrf table names a vrf
+	if err := config.validateVrfOptions(); err != nil {
+		return err
+	}
+	// verify the network can carry the gateway probe
+	if err := config.validateGatewayCheck(); err != nil {
+		return err
+	}
+	// verify the -o routes next hops are on the network subnets
+	if err := config.validateRoutes(config.StaticRoutes); err != nil {
+		return fmt.Errorf("invalid -o %s: %v", routesOpt, err)
+	}
+
+	return nil
+}
+
+// networkConfig builds the configuration of a network allocated or created
+// by the daemon from the request options and ipam data
+func (d *Driver) networkConfig(id string, option map[string]interface{}, ipV4Data, ipV6Data []*pluginNet.IPAMData, phase optionPhase) (*configuration, error) {
+	// reject a null v4 network
+	if len(ipV4Data) == 0 || ipV4Data[0].Pool == "0.0.0.0/0" {
+		return nil, fmt.Errorf("ipv4 pool is empty")
+	}
+	config, err := parseNetworkOptions(id, option, phase)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.processIPAM(id, ipV4Data, ipV6Data); err != nil {
+		return nil, err
+	}
+	if err := config.complete(d, phase); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
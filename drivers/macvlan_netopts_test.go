@@ -0,0 +1,86 @@
+package drivers
+
+import (
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetworkOptions(t *testing.T) {
+	config, err := parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]interface{}{
+			parentOpt:     "eth0.10",
+			driverModeOpt: modeVepa,
+			dscpOpt:       float64(46),
+			egressQosOpt:  "0:5",
+			linkTypeOpt:   linkMacvtap,
+			// labels of other components are ignored
+			"com.docker.network.driver.mtu": "1400",
+		},
+	}, phaseCreate)
+	assert.Nil(t, err)
+	assert.Equal(t, &configuration{ID: "1", Parent: "eth0.10", MacvlanMode: modeVepa, Dscp: "46", EgressQosMap: "0:5", LinkType: linkMacvtap}, config)
+
+	for _, c := range []struct {
+		opts map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{"macvlan_mod": "private"}, "unknown option -o macvlan_mod, did you mean -o macvlan_mode"},
+		{map[string]interface{}{"vlan": "10"}, "unknown option -o vlan"},
+		{map[string]interface{}{parentOpt: 10.0}, "-o parent must be a string, received 10"},
+		{map[string]interface{}{dscpOpt: "af41"}, `-o dscp must be an unsigned integer, received "af41"`},
+		{map[string]interface{}{dscpOpt: 4.5}, "-o dscp must be an unsigned integer, received 4.5"},
+		{map[string]interface{}{driverModeOpt: "macvtap"}, "invalid -o macvlan_mode=macvtap: macvlan mode is not valid, use one of bridge, private, vepa or passthru"},
+		{map[string]interface{}{linkTypeOpt: "ipvlan"}, "invalid -o link_type=ipvlan: link type is not valid, use one of macvlan, macvtap or bridge"},
+		{map[string]interface{}{routesOpt: "10.0.0.0 via 10.1.1.1"}, "invalid -o routes=10.0.0.0 via 10.1.1.1: route destination 10.0.0.0 is not a valid CIDR"},
+	} {
+		_, err := parseNetworkOptions("1", map[string]interface{}{netlabel.GenericData: c.opts}, phaseCreate)
+		assert.EqualError(t, err, c.err)
+	}
+
+	// a network restored from swarm keeps working with an unknown option
+	config, err = parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]string{parentOpt: "eth0", "vlan": "10"},
+	}, phaseRestore)
+	assert.Nil(t, err)
+	assert.Equal(t, "eth0", config.Parent)
+}
+
+func TestNetworkConfigPhases(t *testing.T) {
+	d := NewDriver(Options{DefaultMode: modePrivate})
+	ipv4 := []*pluginNet.IPAMData{{Pool: "192.168.1.0/24", Gateway: "192.168.1.1"}}
+
+	// the dummy parent of a network without parent is only created on the nodes
+	config, err := d.networkConfig("1", map[string]interface{}{}, ipv4, nil, phaseAllocate)
+	assert.Nil(t, err)
+	assert.Equal(t, "", config.Parent)
+	assert.Equal(t, modePrivate, config.MacvlanMode)
+	config, err = d.networkConfig("1", map[string]interface{}{}, ipv4, nil, phaseCreate)
+	assert.Nil(t, err)
+	assert.Equal(t, "dm-1", config.Parent)
+	assert.True(t, config.Internal)
+	assert.Equal(t, modePrivate, config.MacvlanMode)
+
+	_, err = d.networkConfig("1", map[string]interface{}{
+		netlabel.GenericData: map[string]string{parentOpt: "eth0", egressQosOpt: "0:5"},
+	}, ipv4, nil, phaseCreate)
+	assert.EqualError(t, err, "-o egress_qos_map and -o ingress_qos_map require a vlan sub-interface parent, ex. eth0.10")
+	_, err = d.networkConfig("1", map[string]interface{}{}, []*pluginNet.IPAMData{{Pool: "0.0.0.0/0"}}, nil, phaseCreate)
+	assert.EqualError(t, err, "ipv4 pool is empty")
+}
+
+func TestAllocateAndCreateNetworkRejectTypos(t *testing.T) {
+	_, d, r, _ := initData()
+	r.Options["macvlan_mod"] = modePrivate
+	_, err := d.AllocateNetwork(r)
+	assert.EqualError(t, err, "unknown option -o macvlan_mod, did you mean -o macvlan_mode")
+	assert.Empty(t, d.networks)
+
+	_, d, rc, _ := initNetworkData()
+	rc.Options[netlabel.GenericData].(map[string]string)["macvlan_mod"] = modePrivate
+	err = d.CreateNetwork(rc)
+	assert.EqualError(t, err, "unknown option -o macvlan_mod, did you mean -o macvlan_mode")
+	assert.Empty(t, d.networks)
+}
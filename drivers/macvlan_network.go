@@ -7,9 +7,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/stringid"
 	pluginNet "github.com/docker/go-plugins-helpers/network"
-	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/ns"
-	"github.com/docker/libnetwork/options"
 	"github.com/docker/libnetwork/osl"
 	"github.com/docker/libnetwork/types"
 	docker "github.com/fsouza/go-dockerclient"
@@ -26,63 +24,61 @@ func (d *Driver) CreateNetwork(r *pluginNet.CreateNetworkRequest) error {
 	logrus.Infof("CreateNetwork macvlan with networkID=%s,opts=%s", id, opts)
 
 	if id == "" {
-		return fmt.Errorf("invalid network id")
-	}
-
-	// reject a null v4 network
-	if len(ipV4Data) == 0 || ipV4Data[0].Pool == "0.0.0.0/0" {
-		return fmt.Errorf("ipv4 pool is empty")
+		return types.BadRequestErrorf("invalid network id")
 	}
 
 	// parse and validate the config and bind to networkConfiguration
-	config, err := parseNetworkOptions(id, opts)
-	if err != nil {
-		str := fmt.Sprintf("CreateNetwork opts is invalid %s", opts)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
-	}
-
-	config.ID = id
-	err = config.processIPAM(id, ipV4Data, ipV6Data)
+	config, err := d.networkConfig(id, opts, ipV4Data, ipV6Data, phaseCreate)
 	if err != nil {
-		str := fmt.Sprintf("CreateNetwork ipV4Data is invalid %s", ipV4Data)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		logrus.Errorf("CreateNetwork %v", err)
+		return types.BadRequestErrorf("%v", err)
 	}
-	// verify the macvlan mode from -o macvlan_mode option
-	switch config.MacvlanMode {
-	case "", modeBridge:
-		// default to macvlan bridge mode if -o macvlan_mode is empty
-		config.MacvlanMode = modeBridge
-	case modePrivate:
-		config.MacvlanMode = modePrivate
-	case modePassthru:
-		config.MacvlanMode = modePassthru
-	case modeVepa:
-		config.MacvlanMode = modeVepa
-	default:
-		str := fmt.Sprintf("requested macvlan mode '%s' is not valid, 'bridge' mode is the macvlan driver default", config.MacvlanMode)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
+	if err := d.swarmIPRanges(config); err != nil {
+		logrus.Errorf("CreateNetwork %v", err)
+		return types.BadRequestErrorf("%v", err)
 	}
-	// loopback is not a valid parent link
-	if config.Parent == "lo" {
-		str := fmt.Sprintf("loopback interface is not a valid %s parent link", macvlanType)
-		logrus.Errorf(str)
-		return fmt.Errorf(str)
-	}
-	// if parent interface not specified, create a dummy type link to use named dummy+net_id
-	if config.Parent == "" {
-		config.Parent = getDummyName(stringid.TruncateID(config.ID))
-		// empty parent and --internal are handled the same. Set here to update k/v
-		config.Internal = true
+
+	// a retried create of the same network succeeds, a different one conflicts
+	if n, err := d.getNetwork(id); err == nil && !n.allocated {
+		if !n.config.sameNetwork(config) {
+			str := fmt.Sprintf("CreateNetwork network %s already exists with a different configuration", id)
+			logrus.Errorf(str)
+			return types.ForbiddenErrorf("%s", str)
+		}
+		logrus.Infof("CreateNetwork network %s already exists", id)
+		return nil
 	}
 
 	err = d.createNetwork(config)
 	if err != nil {
 		str := fmt.Sprintf("CreateNetwork is failed %v", err)
 		logrus.Errorf(str)
-		return fmt.Errorf(str)
+		return types.InternalErrorf("%s", str)
+	}
+	n, err := d.getNetwork(id)
+	if err != nil {
+		return err
+	}
+	// -o gateway_check fails the create of a network cut from its gateways
+	if config.GatewayCheck {
+		if err := n.checkGateways(); err != nil {
+			n.closeGatewayProbe()
+			d.teardownNetwork(config)
+			d.deleteNetwork(config.ID)
+			str := fmt.Sprintf("CreateNetwork gateway check of network %s failed: %v", stringid.TruncateID(id), err)
+			logrus.Errorf(str)
+			return types.InternalErrorf("%s", str)
+		}
+	}
+	// persist the configuration so the network survives a restart and can be exported
+	if err := d.store.StoreUpdate(config); err != nil {
+		// a retry must not find the links and adopt them as the user's
+		n.closeGatewayProbe()
+		d.teardownNetwork(config)
+		d.deleteNetwork(config.ID)
+		str := fmt.Sprintf("CreateNetwork failed to store the network %s: %v", config.ID, err)
+		logrus.Errorf(str)
+		return types.RetryErrorf("%s", str)
 	}
 
 	return nil
@@ -90,6 +86,8 @@ func (d *Driver) CreateNetwork(r *pluginNet.CreateNetworkRequest) error {
 
 // createNetwork is used by new network callbacks and persistent network cache
 func (d *Driver) createNetwork(config *configuration) error {
+	// the links recorded before the call are not undone on a failure
+	before := *config
 	if !parentExists(config.Parent) {
 		// if the --internal flag is set, create a dummy link
 		if config.Internal {
@@ -106,13 +104,32 @@ func (d *Driver) createNetwork(config *configuration) error {
 		} else {
 			// if the subinterface parent_iface.vlan_id checks do not pass, return err.
 			//  a valid example is 'eth0.10' for a parent iface 'eth0' with a vlan id '10'
-			err := createVlanLink(config.Parent)
+			err := createVlanLink(config.Parent, config.EgressQosMap, config.IngressQosMap)
 			if err != nil {
 				return err
 			}
 			// if driver created the networks slave link, record it for future deletion
 			config.CreatedSlaveLink = true
 		}
+	} else if !config.CreatedSlaveLink {
+		// an existing vlan parent gets the qos maps the driver would have set
+		if err := config.setParentQosMaps(); err != nil {
+			return err
+		}
+	}
+	// attach the parent to the bridge of the veth pairs
+	if config.LinkType == linkBridge {
+		if err := config.setupBridge(); err != nil {
+			d.rollbackNetwork(&before, config)
+			return err
+		}
+	}
+	// route the host side links in the vrf
+	if config.Vrf != "" {
+		if err := d.setupVrf(config); err != nil {
+			d.rollbackNetwork(&before, config)
+			return err
+		}
 	}
 	n := &network{
 		id:        config.ID,
@@ -132,35 +149,17 @@ func (d *Driver) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) error {
 	nid := r.NetworkID
 	logrus.Infof("DeleteNetwork macvlan nid=%s", nid)
 	if nid == "" {
-		return fmt.Errorf("invalid network id")
+		return types.BadRequestErrorf("invalid network id")
 	}
 
+	// the network is already gone when the daemon retries the delete
 	n := d.network(nid)
-	if n == nil {
-		return fmt.Errorf("network id %s not found", nid)
-	}
-	// if the driver created the slave interface, delete it, otherwise leave it
-	if ok := n.config.CreatedSlaveLink; ok {
-		// if the interface exists, only delete if it matches iface.vlan or dummy.net_id naming
-		if ok := parentExists(n.config.Parent); ok {
-			// only delete the link if it is named the net_id
-			if n.config.Parent == getDummyName(stringid.TruncateID(nid)) {
-				err := delDummyLink(n.config.Parent)
-				if err != nil {
-					logrus.Errorf("link %s was not deleted, continuing the delete network operation: %v",
-						n.config.Parent, err)
-				}
-			} else {
-				// only delete the link if it matches iface.vlan naming
-				err := delVlanLink(n.config.Parent)
-				if err != nil {
-					logrus.Errorf("link %s was not deleted, continuing the delete network operation: %v",
-						n.config.Parent, err)
-				}
-			}
-		}
+	if n == nil || !d.acquire(n) {
+		logrus.Infof("DeleteNetwork network %s not found, nothing to delete", nid)
+		return nil
 	}
-	for _, ep := range n.endpoints {
+	defer n.release()
+	for _, ep := range n.getEndpoints() {
 		if link, err := ns.NlHandle().LinkByName(ep.srcName); err == nil {
 			ns.NlHandle().LinkDel(link)
 			logrus.Infof("DeleteNetwork delete macvlan link %s", ep.srcName)
@@ -170,107 +169,97 @@ func (d *Driver) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) error {
 			logrus.Warnf("Failed to remove macvlan endpoint %s from store: %v", ep.id[0:7], err)
 		}
 	}
+	n.closeGatewayProbe()
+	d.teardownNetwork(n.config)
+	if err := d.store.StoreDelete(n.config); err != nil {
+		logrus.Warnf("Failed to remove macvlan network %s from store: %v", stringid.TruncateID(nid), err)
+	}
 	// delete the *network
 	d.deleteNetwork(nid)
 	return nil
 }
 
-// parseNetworkOptions parses docker network options
-func parseNetworkOptions(id string, option map[string]interface{}) (*configuration, error) {
-	var (
-		err    error
-		config = &configuration{}
-	)
-	// parse generic labels first
-	if genData, ok := option[netlabel.GenericData]; ok && genData != nil {
-		if config, err = parseNetworkGenericOptions(genData); err != nil {
-			return nil, err
-		}
+// teardownNetwork deletes the host links the driver created for the
+// network, links it adopted are left in place
+func (d *Driver) teardownNetwork(config *configuration) {
+	// delete the bridge before the parent it enslaves
+	if err := delBridge(config); err != nil {
+		logrus.Errorf("bridge %s was not deleted, continuing the delete network operation: %v", config.Bridge, err)
 	}
-	// setting the parent to "" will trigger an isolated network dummy parent link
-	if _, ok := option[netlabel.Internal]; ok {
-		config.Internal = true
-		// empty --parent= and --internal are handled the same.
-		config.Parent = ""
-	}
-
-	return config, nil
-}
-
-// parseNetworkGenericOptions parses generic driver docker network options
-func parseNetworkGenericOptions(data interface{}) (*configuration, error) {
-	var (
-		err    error
-		config *configuration
-	)
-	switch opt := data.(type) {
-	case *configuration:
-		config = opt
-	case map[string]string:
-		config = &configuration{}
-		err = config.fromOptions(opt)
-	case map[string]interface{}:
-		config = &configuration{}
-		err = config.fromOptions2(opt)
-	case options.Generic:
-		var opaqueConfig interface{}
-		if opaqueConfig, err = options.GenerateFromModel(opt, config); err == nil {
-			config = opaqueConfig.(*configuration)
+	// if the driver created the slave interface, delete it, otherwise leave it
+	if config.CreatedSlaveLink && parentExists(config.Parent) {
+		var err error
+		// only delete the link if it is named the net_id or matches iface.vlan naming
+		if config.Parent == getDummyName(stringid.TruncateID(config.ID)) {
+			err = delDummyLink(config.Parent)
+		} else {
+			err = delVlanLink(config.Parent)
 		}
-	default:
-		err = types.BadRequestErrorf("unrecognized network configuration format: %v", opt)
-	}
-
-	return config, err
-}
-
-// fromOptions binds the generic options to networkConfiguration to cache
-func (config *configuration) fromOptions(labels map[string]string) error {
-	for label, value := range labels {
-		switch label {
-		case parentOpt:
-			// parse driver option '-o parent'
-			config.Parent = value
-		case driverModeOpt:
-			// parse driver option '-o macvlan_mode'
-			config.MacvlanMode = value
+		if err != nil {
+			logrus.Errorf("link %s was not deleted, continuing the delete network operation: %v", config.Parent, err)
 		}
 	}
-
-	return nil
+	// the vrf goes once the links it enslaves are deleted
+	if err := d.delVrf(config); err != nil {
+		logrus.Errorf("vrf %s was not deleted, continuing the delete network operation: %v", config.Vrf, err)
+	}
 }
 
-func (config *configuration) fromOptions2(labels map[string]interface{}) error {
-	for label, value := range labels {
-		switch label {
-		case parentOpt:
-			// parse driver option '-o parent'
-			config.Parent = value.(string)
-		case driverModeOpt:
-			// parse driver option '-o macvlan_mode'
-			config.MacvlanMode = value.(string)
-		}
+// rollbackNetwork deletes the links a failed createNetwork created in the
+// reverse order, so a retry doesn't find them and adopt them as the user's
+func (d *Driver) rollbackNetwork(before, config *configuration) {
+	undo := *config
+	undo.CreatedSlaveLink = config.CreatedSlaveLink && !before.CreatedSlaveLink
+	undo.CreatedBridge = config.CreatedBridge && !before.CreatedBridge
+	undo.CreatedVrf = config.CreatedVrf && !before.CreatedVrf
+	// the vrf first, which releases the links it enslaved
+	if err := d.delVrf(&undo); err != nil {
+		logrus.Errorf("vrf %s was not deleted, continuing the rollback of network %s: %v", config.Vrf, stringid.TruncateID(config.ID), err)
 	}
+	undo.CreatedVrf = false
+	d.teardownNetwork(&undo)
+	config.CreatedSlaveLink = before.CreatedSlaveLink
+	config.Bridge, config.CreatedBridge = before.Bridge, before.CreatedBridge
+	config.CreatedVrf = before.CreatedVrf
+}
 
-	return nil
+// sameNetwork compares the network configurations a create request asks
+// for, ignoring what the driver records while creating the network
+func (config *configuration) sameNetwork(other *configuration) bool {
+	a, b := *config, *other
+	a.CreatedSlaveLink, b.CreatedSlaveLink = false, false
+	a.Bridge, b.Bridge = "", ""
+	a.CreatedBridge, b.CreatedBridge = false, false
+	a.CreatedVrf, b.CreatedVrf = false, false
+	return sameRecord(&a, &b)
 }
 
 // processIPAM parses v4 and v6 IP information and binds it to the network configuration
 func (config *configuration) processIPAM(id string, ipamV4Data, ipamV6Data []*pluginNet.IPAMData) error {
 	if len(ipamV4Data) > 0 {
 		for _, ipd := range ipamV4Data {
+			aux, err := auxAddresses(ipd.Pool, ipd.AuxAddresses)
+			if err != nil {
+				return err
+			}
 			s := &ipv4Subnet{
-				SubnetIP: ipd.Pool,
-				GwIP:     ipd.Gateway,
+				SubnetIP:     ipd.Pool,
+				GwIP:         ipd.Gateway,
+				AuxAddresses: aux,
 			}
 			config.Ipv4Subnets = append(config.Ipv4Subnets, s)
 		}
 	}
 	if len(ipamV6Data) > 0 {
 		for _, ipd := range ipamV6Data {
+			aux, err := auxAddresses(ipd.Pool, ipd.AuxAddresses)
+			if err != nil {
+				return err
+			}
 			s := &ipv6Subnet{
-				SubnetIP: ipd.Pool,
-				GwIP:     ipd.Gateway,
+				SubnetIP:     ipd.Pool,
+				GwIP:         ipd.Gateway,
+				AuxAddresses: aux,
 			}
 			config.Ipv6Subnets = append(config.Ipv6Subnets, s)
 		}
@@ -285,16 +274,31 @@ func (config *configuration) processIPAMFromSwarm(id string, ipam []docker.IPAMC
 		for _, ipd := range ipam {
 			logrus.Debugf("Load from swarm ,sub=%s", ipd)
 			_, subnetIP, _ := net.ParseCIDR(ipd.Subnet)
+			if err := parseIPRange(ipd.Subnet, ipd.IPRange); err != nil {
+				return err
+			}
+			aux := make(map[string]interface{}, len(ipd.AuxAddress))
+			for name, a := range ipd.AuxAddress {
+				aux[name] = a
+			}
+			auxAddrs, err := auxAddresses(ipd.Subnet, aux)
+			if err != nil {
+				return err
+			}
 			if subnetIP.IP.To4() != nil {
 				s := &ipv4Subnet{
-					SubnetIP: ipd.Subnet,
-					GwIP:     ipd.Gateway,
+					SubnetIP:     ipd.Subnet,
+					GwIP:         ipd.Gateway,
+					IPRange:      ipd.IPRange,
+					AuxAddresses: auxAddrs,
 				}
 				config.Ipv4Subnets = append(config.Ipv4Subnets, s)
 			} else {
 				s := &ipv6Subnet{
-					SubnetIP: ipd.Subnet,
-					GwIP:     ipd.Gateway,
+					SubnetIP:     ipd.Subnet,
+					GwIP:         ipd.Gateway,
+					IPRange:      ipd.IPRange,
+					AuxAddresses: auxAddrs,
 				}
 				config.Ipv6Subnets = append(config.Ipv6Subnets, s)
 			}
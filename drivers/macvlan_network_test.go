@@ -1,12 +1,14 @@
 package drivers
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/docker/docker/pkg/stringid"
 	pluginNet "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,15 +66,25 @@ func initNetworkData() (*MacStore, *Driver, *pluginNet.CreateNetworkRequest, *ne
 }
 
 func TestCreateNetworkWithOK(t *testing.T) {
-	_, d, r, n := initNetworkData()
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(nil)
 	err := d.CreateNetwork(r)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, d.networks[r.NetworkID])
 	assert.EqualValues(t, n, d.networks[r.NetworkID])
 }
 
+func TestCreateNetworkWithStoreFailure(t *testing.T) {
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(errors.New("store is unavailable"))
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "CreateNetwork failed to store the network 1: store is unavailable")
+	assert.Empty(t, d.networks)
+}
+
 func TestCreateNetworkWithVlan(t *testing.T) {
-	_, d, r, n := initNetworkData()
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(nil)
 	opts := r.Options[netlabel.GenericData].(map[string]string)
 	opts["parent"] = "eth0.10"
 	n.config.CreatedSlaveLink = true
@@ -89,7 +101,8 @@ func TestCreateNetworkWithVlan(t *testing.T) {
 }
 
 func TestCreateNetworkWithInternal(t *testing.T) {
-	_, d, r, n := initNetworkData()
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(nil)
 	r.Options[netlabel.Internal] = map[string]string{
 		"internal": "true",
 	}
@@ -123,15 +136,55 @@ func TestCreateNetworkWithInvalidSubnet(t *testing.T) {
 	assert.EqualError(t, err, "ipv4 pool is empty")
 }
 
+func TestCreateNetworkReplay(t *testing.T) {
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(nil)
+	assert.Nil(t, d.CreateNetwork(r))
+	assert.Nil(t, d.CreateNetwork(r))
+	ms.AssertNumberOfCalls(t, "StoreUpdate", 1)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+
+	opts := r.Options[netlabel.GenericData].(map[string]string)
+	opts["macvlan_mode"] = "private"
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "CreateNetwork network 1 already exists with a different configuration")
+	_, ok := err.(types.ForbiddenError)
+	assert.True(t, ok)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestCreateNetworkAfterAllocate(t *testing.T) {
+	ms, d, r, n := initNetworkData()
+	ms.On("StoreUpdate", n.config).Return(nil)
+	d.addNetwork(&network{id: r.NetworkID, driver: d, config: n.config, allocated: true})
+	assert.Nil(t, d.CreateNetwork(r))
+	ms.AssertNumberOfCalls(t, "StoreUpdate", 1)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestDeleteNetworkReplay(t *testing.T) {
+	ms, d, r, _ := initEndpointData()
+	c := d.networks[r.NetworkID].config
+	ms.On("StoreDelete", c).Return(nil)
+	dr := &pluginNet.DeleteNetworkRequest{
+		NetworkID: r.NetworkID,
+	}
+	assert.Nil(t, d.DeleteNetwork(dr))
+	assert.Nil(t, d.DeleteNetwork(dr))
+	ms.AssertNumberOfCalls(t, "StoreDelete", 1)
+	assert.Empty(t, d.networks)
+}
+
 func TestDeleteNetworkWithVlan(t *testing.T) {
 	ms, d, r, ep := initEndpointData()
 	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
 	c := d.networks[r.NetworkID].config
 	c.CreatedSlaveLink = true
 	c.Parent = "eth0.10"
-	err := createVlanLink(c.Parent)
+	err := createVlanLink(c.Parent, "", "")
 	assert.Nil(t, err)
 	ms.On("StoreDelete", ep).Return(nil)
+	ms.On("StoreDelete", c).Return(nil)
 	dr := &pluginNet.DeleteNetworkRequest{
 		NetworkID: r.NetworkID,
 	}
@@ -150,6 +203,7 @@ func TestDeleteNetworkWithInternal(t *testing.T) {
 	err := createDummyLink(c.Parent, getDummyName(stringid.TruncateID(c.ID)))
 	assert.Nil(t, err)
 	ms.On("StoreDelete", ep).Return(nil)
+	ms.On("StoreDelete", c).Return(nil)
 	dr := &pluginNet.DeleteNetworkRequest{
 		NetworkID: r.NetworkID,
 	}
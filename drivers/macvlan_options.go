@@ -0,0 +1,81 @@
+package drivers
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	minMtu = 68    // smallest mtu an ipv4 link accepts
+	maxMtu = 65535 // largest mtu of a macvlan slave
+)
+
+// Options are the daemon level settings of the driver
+type Options struct {
+	SwarmHost   string // docker/swarm endpoint, $SWARM_HOST or the default when empty
+	TLSCACert   string // CA used to verify the swarm endpoint
+	TLSCert     string // client certificate presented to the swarm endpoint
+	TLSKey      string // key of the client certificate
+	StorePath   string // boltdb file of the local store, libnetwork's default when empty
+	DefaultMode string // macvlan mode of networks created without -o macvlan_mode
+	DefaultMtu  int    // mtu of the slaves of networks without an mtu, the parent's when 0
+
+	StoreBackend string        // boltdb when empty, memory, consul, etcd or zk
+	StoreAddress string        // comma separated host:port of the consul, etcd or zk servers, the name of a memory store
+	StoreBucket  string        // boltdb bucket, libnetwork's when empty
+	StorePrefix  string        // key prefix on consul, etcd or zk
+	StoreTimeout time.Duration // connection timeout of the store, a minute when 0
+	StoreRetries int           // attempts to open the store again before failing the start
+
+	GatewayMonitor time.Duration // interval of the gateway probes of the networks, 0 disables them
+}
+
+// Validate verifies the options before the driver starts
+func (o *Options) Validate() error {
+	switch o.DefaultMode {
+	case "", modeBridge, modePrivate, modeVepa, modePassthru:
+	default:
+		return fmt.Errorf("default macvlan mode %s is not valid, use one of bridge, private, vepa or passthru", o.DefaultMode)
+	}
+	if o.DefaultMtu != 0 && (o.DefaultMtu < minMtu || o.DefaultMtu > maxMtu) {
+		return fmt.Errorf("default mtu %d must be between %d and %d", o.DefaultMtu, minMtu, maxMtu)
+	}
+	if o.GatewayMonitor < 0 {
+		return fmt.Errorf("gateway monitor interval %s must not be negative", o.GatewayMonitor)
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return fmt.Errorf("a tls certificate and key must be set together")
+	}
+	if o.TLSCACert != "" && o.TLSCert == "" {
+		return fmt.Errorf("a tls CA certificate requires a client certificate and key")
+	}
+
+	return o.validateStore()
+}
+
+// NewDriver returns a driver using the options, to be passed to Init
+func NewDriver(opts Options) *Driver {
+	return &Driver{
+		networks: networkTable{},
+		store:    &MacvlanStore{},
+		opts:     opts,
+	}
+}
+
+// defaultMode returns the macvlan mode of a network created without one
+func (d *Driver) defaultMode() string {
+	if d.opts.DefaultMode == "" {
+		return modeBridge
+	}
+
+	return d.opts.DefaultMode
+}
+
+// mtu returns the mtu of the slaves of a network, 0 keeps the parent's
+func (d *Driver) mtu(config *configuration) int {
+	if config.Mtu != 0 {
+		return config.Mtu
+	}
+
+	return d.opts.DefaultMtu
+}
@@ -0,0 +1,75 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOptions(t *testing.T) {
+	assert.Nil(t, (&Options{}).Validate())
+	assert.Nil(t, (&Options{DefaultMode: modeVepa, DefaultMtu: 9000, TLSCert: "cert.pem", TLSKey: "key.pem"}).Validate())
+
+	assert.EqualError(t, (&Options{DefaultMode: "macvtap"}).Validate(),
+		"default macvlan mode macvtap is not valid, use one of bridge, private, vepa or passthru")
+	assert.EqualError(t, (&Options{DefaultMtu: 70000}).Validate(), "default mtu 70000 must be between 68 and 65535")
+	assert.EqualError(t, (&Options{TLSCert: "cert.pem"}).Validate(), "a tls certificate and key must be set together")
+	assert.EqualError(t, (&Options{TLSCACert: "ca.pem"}).Validate(), "a tls CA certificate requires a client certificate and key")
+	assert.EqualError(t, (&Options{GatewayMonitor: -time.Second}).Validate(), "gateway monitor interval -1s must not be negative")
+}
+
+func TestAllocateNetworkWithDefaultMode(t *testing.T) {
+	_, d, r, n := initData()
+	d.opts.DefaultMode = modePrivate
+	n.config.MacvlanMode = modePrivate
+	res, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestMtu(t *testing.T) {
+	d := NewDriver(Options{DefaultMtu: 1400})
+	assert.Equal(t, 1400, d.mtu(&configuration{}))
+	assert.Equal(t, 9000, d.mtu(&configuration{Mtu: 9000}))
+}
+
+func TestStoreScope(t *testing.T) {
+	scope, s := (&Options{}).storeScope()
+	assert.Equal(t, datastore.LocalScope, scope)
+	assert.True(t, s.IsValid())
+	assert.Equal(t, DefaultStorePath(), s.Client.Address)
+	assert.Equal(t, "libnetwork", s.Client.Config.Bucket)
+	assert.Equal(t, time.Minute, s.Client.Config.ConnectionTimeout)
+
+	_, s = (&Options{StorePath: "/tmp/macvlan.db", StoreBucket: "macvlan", StoreTimeout: time.Second}).storeScope()
+	assert.Equal(t, "/tmp/macvlan.db", s.Client.Address)
+	assert.Equal(t, "macvlan", s.Client.Config.Bucket)
+	assert.Equal(t, time.Second, s.Client.Config.ConnectionTimeout)
+
+	scope, s = (&Options{StoreBackend: storeConsul, StoreAddress: "10.0.0.1:8500,10.0.0.2:8500", StorePrefix: "/macvlan/"}).storeScope()
+	assert.Equal(t, datastore.GlobalScope, scope)
+	assert.Equal(t, "consul", s.Client.Provider)
+	assert.Equal(t, "10.0.0.1:8500,10.0.0.2:8500/macvlan", s.Client.Address)
+
+	_, s = (&Options{StoreBackend: storeMemory}).storeScope()
+	assert.Equal(t, "default", s.Client.Address)
+}
+
+func TestValidateStore(t *testing.T) {
+	assert.Nil(t, (&Options{StoreBackend: storeBoltDB, StorePath: "/tmp/macvlan.db", StoreRetries: 3}).Validate())
+	assert.Nil(t, (&Options{StoreBackend: storeEtcd, StoreAddress: "10.0.0.1:2379", StorePrefix: "macvlan"}).Validate())
+	assert.Nil(t, (&Options{StoreBackend: storeMemory}).Validate())
+	assert.EqualError(t, (&Options{StoreBackend: "redis"}).Validate(),
+		"store backend redis is not valid, use one of boltdb, memory, consul, etcd or zk")
+	assert.EqualError(t, (&Options{StoreBackend: storeZK}).Validate(), "the zk store requires a store address")
+	assert.EqualError(t, (&Options{StoreBackend: storeZK, StoreAddress: "zk:2181", StorePath: "/tmp/macvlan.db"}).Validate(),
+		"the zk store takes an address and prefix, not a store path or bucket")
+	assert.EqualError(t, (&Options{StorePrefix: "macvlan"}).Validate(),
+		"the boltdb store takes a store path and bucket, not an address or prefix")
+	assert.EqualError(t, (&Options{StoreBackend: storeConsul, StoreAddress: "consul:8500/macvlan"}).Validate(),
+		"store address consul:8500/macvlan must be a host:port list, set the key prefix with store_prefix")
+	assert.EqualError(t, (&Options{StoreRetries: -1}).Validate(), "store retries -1 must not be negative")
+}
@@ -0,0 +1,532 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ipv4HdrLen      = 20
+	icmpHdrLen      = 8
+	minIPv6Mtu      = 1280
+	ipv6DontFrag    = 62 // IPV6_DONTFRAG
+	ipv6PmtudProbe  = 3  // IPV6_PMTUDISC_PROBE
+	icmpEchoReply   = 0
+	icmpEcho        = 8
+	icmp6Echo       = 128
+	icmp6EchoReply  = 129
+	icmp6NeighSol   = 135
+	icmp6NeighAdv   = 136
+	ndpOptSourceLL  = 1
+	ndpOptTargetLL  = 2
+	arpOpRequest    = 1
+	arpOpReply      = 2
+	defaultProbes   = 3
+	defaultProbeTTL = time.Second
+)
+
+var errNoReply = errors.New("no reply")
+
+// ProbeOptions tunes the probes of the gateway
+type ProbeOptions struct {
+	Count   int           // echo requests sent to the gateway
+	Timeout time.Duration // wait for each reply
+}
+
+// ProbeReport is the outcome of the probes of an endpoint
+type ProbeReport struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Results    []*CheckResult
+}
+
+// Probe checks layer by layer the connectivity of a stored endpoint to the
+// gateways of its network: the host links, the interface and addresses in
+// the sandbox, the arp or ndp resolution of the gateways, echo requests and
+// the path mtu with DF set. The gateway probes are skipped once a check
+// failed. The sandbox the endpoint joined is probed when sandboxKey is empty.
+func Probe(opts Options, eid, sandboxKey string, popts ProbeOptions) (*ProbeReport, error) {
+	configs, endpoints, err := readRecords(opts)
+	if err != nil {
+		return nil, err
+	}
+	var ep *endpoint
+	for _, e := range endpoints {
+		if e.id == eid {
+			ep = e
+		}
+	}
+	if ep == nil {
+		return nil, fmt.Errorf("no such endpoint %s", eid)
+	}
+	var config *configuration
+	for _, c := range configs {
+		if c.ID == ep.nid {
+			config = c
+		}
+	}
+	if config == nil {
+		return nil, fmt.Errorf("network %s of endpoint %s is not in the store", stringid.TruncateID(ep.nid), stringid.TruncateID(eid))
+	}
+	if sandboxKey == "" {
+		if ep.sandbox == nil {
+			return nil, fmt.Errorf("endpoint %s is not joined to a sandbox", stringid.TruncateID(eid))
+		}
+		sandboxKey = ep.sandbox.Key
+	}
+
+	return &ProbeReport{
+		NetworkID:  config.ID,
+		EndpointID: ep.id,
+		SandboxKey: sandboxKey,
+		Results:    probeEndpoint(config, ep, sandboxKey, popts),
+	}, nil
+}
+
+func probeEndpoint(config *configuration, ep *endpoint, sandboxKey string, popts ProbeOptions) []*CheckResult {
+	if popts.Count <= 0 {
+		popts.Count = defaultProbes
+	}
+	if popts.Timeout <= 0 {
+		popts.Timeout = defaultProbeTTL
+	}
+	results := probeHostLinks(config)
+	err := inSandbox(sandboxKey, func() error {
+		results = append(results, probeSandbox(config, ep, popts, PreflightFailed(results))...)
+		return nil
+	})
+	if err != nil {
+		results = append(results, fail("sandbox", err.Error(), "the container may have stopped, check docker ps"))
+	}
+
+	return results
+}
+
+// probeHostLinks checks the links carrying the endpoint on the host: the
+// parent, the lower link of a vlan parent and the bridge of a bridge network
+func probeHostLinks(config *configuration) []*CheckResult {
+	var results []*CheckResult
+	check := func(name, linkName, hint string) netlink.Link {
+		link, err := ns.NlHandle().LinkByName(linkName)
+		if err != nil {
+			results = append(results, fail(name, "not found", hint))
+			return nil
+		}
+		results = append(results, checkCarrier(name, link.Attrs()))
+		return link
+	}
+
+	parent := check("parent "+config.Parent, config.Parent, "the parent was deleted, recreate it or the network")
+	if vlan, ok := parent.(*netlink.Vlan); ok {
+		lower, err := ns.NlHandle().LinkByIndex(vlan.ParentIndex)
+		name := fmt.Sprintf("vlan %d lower link", vlan.VlanId)
+		if err != nil {
+			results = append(results, fail(name, err.Error(), ""))
+		} else {
+			results = append(results, checkCarrier(name+" "+lower.Attrs().Name, lower.Attrs()))
+		}
+	}
+	if config.LinkType == linkBridge && config.Bridge != "" {
+		check("bridge "+config.Bridge, config.Bridge, "the bridge was deleted, recreate the network")
+	}
+
+	return results
+}
+
+// probeSandbox runs the checks of the current namespace, the gateway probes
+// are skipped after a failed check
+func probeSandbox(config *configuration, ep *endpoint, popts ProbeOptions, failed bool) []*CheckResult {
+	var results []*CheckResult
+	name := "sandbox interface " + ep.mac.String()
+	links, err := netlink.LinkList()
+	if err != nil {
+		return append(results, fail(name, err.Error(), ""))
+	}
+	var link netlink.Link
+	for _, l := range links {
+		if l.Attrs().HardwareAddr.String() == ep.mac.String() {
+			link = l
+		}
+	}
+	if link == nil {
+		return append(results, fail(name, "no interface with the mac of the endpoint",
+			"the sandbox is not the one of the endpoint, compare with docker inspect"))
+	}
+	attrs := link.Attrs()
+	name = "sandbox interface " + attrs.Name
+	results = append(results, checkCarrier(name, attrs))
+
+	n := &network{config: config}
+	families := []struct {
+		family int
+		addr   *net.IPNet
+		gw     string
+	}{
+		{netlink.FAMILY_V4, ep.addr, ""},
+		{netlink.FAMILY_V6, ep.addrv6, ""},
+	}
+	if s := n.getSubnetforIPv4(ep.addr); s != nil {
+		families[0].gw = s.GwIP
+	}
+	if s := n.getSubnetforIPv6(ep.addrv6); s != nil {
+		families[1].gw = s.GwIP
+	}
+	for _, f := range families {
+		if f.addr == nil {
+			continue
+		}
+		results = append(results, probeAddress(link, f.family, f.addr))
+		failed = failed || PreflightFailed(results)
+		gwName := "gateway"
+		gw, _, err := net.ParseCIDR(f.gw)
+		if err == nil {
+			gwName += " " + gw.String()
+		}
+		switch {
+		case config.Internal:
+			results = append(results, skip(gwName, "internal network"))
+		case err != nil:
+			results = append(results, skip(gwName, "the subnet has no gateway"))
+		case failed:
+			results = append(results, skip(gwName, "a check of a lower layer failed"))
+		default:
+			results = append(results, probeGateway(gwName, link, f.addr.IP, gw, popts)...)
+		}
+	}
+
+	return results
+}
+
+func probeAddress(link netlink.Link, family int, addr *net.IPNet) *CheckResult {
+	name := "sandbox address " + addr.String()
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(addr.IP) {
+			return pass(name, "configured on "+link.Attrs().Name)
+		}
+	}
+
+	return fail(name, "not configured on "+link.Attrs().Name, "the daemon did not configure the address, restart the container")
+}
+
+// probeGateway resolves the gateway, pings it and finds the largest packet
+// it answers with DF set
+func probeGateway(name string, link netlink.Link, src, gw net.IP, popts ProbeOptions) []*CheckResult {
+	attrs := link.Attrs()
+	resolveName, resolve := name+" arp", arpResolve
+	if gw.To4() == nil {
+		resolveName, resolve = name+" ndp", ndpResolve
+	}
+	mac, err := resolve(link, src, gw, popts)
+	if err != nil {
+		return []*CheckResult{
+			fail(resolveName, err.Error(), fmt.Sprintf("check the vlan of the switch port and the gateway address, docker-macvlan capture the endpoint with %q", resolveFilter(gw))),
+			skip(name+" ping", "the gateway is not resolved"),
+			skip(name+" mtu", "the gateway is not resolved"),
+		}
+	}
+	results := []*CheckResult{pass(resolveName, "at "+mac.String())}
+
+	p, err := newPinger(attrs.Name, attrs.Index, gw)
+	if err != nil {
+		return append(results, fail(name+" ping", err.Error(), ""), skip(name+" mtu", "the ping failed"))
+	}
+	defer p.close()
+	var replies int
+	var rtt time.Duration
+	size := minMtu
+	if gw.To4() == nil {
+		size = minIPv6Mtu
+	}
+	for i := 0; i < popts.Count; i++ {
+		d, err := p.ping(size, popts.Timeout)
+		if err == nil {
+			replies++
+			rtt += d
+		}
+	}
+	detail := fmt.Sprintf("%d/%d replies", replies, popts.Count)
+	switch {
+	case replies == 0:
+		return append(results, fail(name+" ping", detail, "the gateway resolves but doesn't answer, check its firewall"),
+			skip(name+" mtu", "the ping failed"))
+	case replies < popts.Count:
+		results = append(results, warn(name+" ping", detail, "packets are lost between the endpoint and the gateway"))
+	default:
+		results = append(results, pass(name+" ping", fmt.Sprintf("%s, avg rtt %v", detail, rtt/time.Duration(replies))))
+	}
+
+	return append(results, probeMtu(name+" mtu", p, size, attrs.MTU, popts.Timeout))
+}
+
+func resolveFilter(gw net.IP) string {
+	if gw.To4() != nil {
+		return "arp"
+	}
+	return "icmp6"
+}
+
+// probeMtu finds the largest packet up to the mtu of the interface the
+// gateway answers with DF set
+func probeMtu(name string, p *pinger, min, mtu int, timeout time.Duration) *CheckResult {
+	if _, err := p.ping(mtu, timeout); err == nil {
+		return pass(name, fmt.Sprintf("%d bytes with DF set", mtu))
+	}
+	lo, hi := min, mtu-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if _, err := p.ping(mid, timeout); err == nil {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return fail(name, fmt.Sprintf("no reply above %d bytes with DF set, the interface mtu is %d", lo, mtu),
+		fmt.Sprintf("lower the mtu of the network to %d or raise the mtu of the path to the gateway", lo))
+}
+
+// arpResolve sends arp requests for the gateway on a packet socket
+func arpResolve(link netlink.Link, src, gw net.IP, popts ProbeOptions) (net.HardwareAddr, error) {
+	filter, err := CompileFilter("arp", DefaultSnaplen)
+	if err != nil {
+		return nil, err
+	}
+	mac := link.Attrs().HardwareAddr
+	fd, err := openCapture(mac, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	req := make([]byte, 0, ethHdrLen+28)
+	req = append(req, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	req = append(req, mac...)
+	req = append(req, ethTypeARP>>8, ethTypeARP&0xff)
+	req = append(req, 0, 1, ethTypeIPv4>>8, ethTypeIPv4&0xff, 6, 4, 0, arpOpRequest)
+	req = append(req, mac...)
+	req = append(req, src.To4()...)
+	req = append(req, make([]byte, 6)...)
+	req = append(req, gw.To4()...)
+
+	buf := make([]byte, 1500)
+	for i := 0; i < popts.Count; i++ {
+		if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrLinklayer{Ifindex: link.Attrs().Index}); err != nil {
+			return nil, fmt.Errorf("failed to send an arp request: %v", err)
+		}
+		deadline := time.Now().Add(popts.Timeout)
+		for time.Now().Before(deadline) {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				continue
+			}
+			// the sender of a reply is at 22, its address at 28
+			arp := buf[:n]
+			if n >= ethHdrLen+28 && arp[ethHdrLen+7] == arpOpReply && net.IP(arp[28:32]).Equal(gw) {
+				return net.HardwareAddr(append([]byte{}, arp[22:28]...)), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no arp reply to %d requests", popts.Count)
+}
+
+// ndpResolve sends neighbor solicitations for the gateway on a raw icmpv6
+// socket, the kernel fills the checksum
+func ndpResolve(link netlink.Link, src, gw net.IP, popts ProbeOptions) (net.HardwareAddr, error) {
+	attrs := link.Attrs()
+	fd, err := icmpSocket(syscall.AF_INET6, attrs.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	// neighbor discovery messages are only accepted with a hop limit of 255
+	for _, opt := range []int{syscall.IPV6_MULTICAST_HOPS, syscall.IPV6_UNICAST_HOPS} {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, opt, 255); err != nil {
+			return nil, err
+		}
+	}
+	sol := []byte{icmp6NeighSol, 0, 0, 0, 0, 0, 0, 0}
+	sol = append(sol, gw.To16()...)
+	sol = append(sol, ndpOptSourceLL, 1)
+	sol = append(sol, attrs.HardwareAddr...)
+	// the solicited node multicast address of the gateway
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(attrs.Index)}
+	copy(dst.Addr[:], net.ParseIP("ff02::1:ff00:0"))
+	copy(dst.Addr[13:], gw.To16()[13:])
+
+	buf := make([]byte, 1500)
+	for i := 0; i < popts.Count; i++ {
+		if err := syscall.Sendto(fd, sol, 0, dst); err != nil {
+			return nil, fmt.Errorf("failed to send a neighbor solicitation: %v", err)
+		}
+		deadline := time.Now().Add(popts.Timeout)
+		for time.Now().Before(deadline) {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				continue
+			}
+			adv := buf[:n]
+			if n < 24 || adv[0] != icmp6NeighAdv || !net.IP(adv[8:24]).Equal(gw) {
+				continue
+			}
+			for opts := adv[24:]; len(opts) >= 8 && opts[1] > 0 && len(opts) >= int(opts[1])*8; opts = opts[int(opts[1])*8:] {
+				if opts[0] == ndpOptTargetLL {
+					return net.HardwareAddr(append([]byte{}, opts[2:8]...)), nil
+				}
+			}
+			return nil, fmt.Errorf("the advertisement has no link-layer address")
+		}
+	}
+
+	return nil, fmt.Errorf("no neighbor advertisement to %d solicitations", popts.Count)
+}
+
+// icmpSocket opens a raw icmp socket of the family bound to the interface
+// with a timeout bounding the reads
+func icmpSocket(family int, ifName string) (int, error) {
+	proto := syscall.IPPROTO_ICMP
+	if family == syscall.AF_INET6 {
+		proto = syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, proto)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open an icmp socket: %v", err)
+	}
+	tv := syscall.NsecToTimeval(captureWakeup.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.BindToDevice(fd, ifName); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to bind the icmp socket to %s: %v", ifName, err)
+	}
+
+	return fd, nil
+}
+
+// pinger sends echo requests with DF set to the gateway
+type pinger struct {
+	fd  int
+	v6  bool
+	dst syscall.Sockaddr
+	id  uint16
+	seq uint16
+}
+
+func newPinger(ifName string, ifIndex int, gw net.IP) (*pinger, error) {
+	p := &pinger{id: uint16(rand.Intn(1 << 16))}
+	family := syscall.AF_INET
+	if ip4 := gw.To4(); ip4 != nil {
+		dst := &syscall.SockaddrInet4{}
+		copy(dst.Addr[:], ip4)
+		p.dst = dst
+	} else {
+		family, p.v6 = syscall.AF_INET6, true
+		dst := &syscall.SockaddrInet6{ZoneId: uint32(ifIndex)}
+		copy(dst.Addr[:], gw.To16())
+		p.dst = dst
+	}
+	fd, err := icmpSocket(family, ifName)
+	if err != nil {
+		return nil, err
+	}
+	// probe ignores the cached path mtu, packets above the interface mtu fail
+	if p.v6 {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, ipv6PmtudProbe)
+		if err == nil {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+		}
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set DF on the icmp socket: %v", err)
+	}
+	p.fd = fd
+
+	return p, nil
+}
+
+func (p *pinger) close() {
+	syscall.Close(p.fd)
+}
+
+// ping sends an echo request making an ip packet of size bytes and waits
+// for the reply
+func (p *pinger) ping(size int, timeout time.Duration) (time.Duration, error) {
+	p.seq++
+	hdr := ipv4HdrLen + icmpHdrLen
+	typ, replyType := byte(icmpEcho), byte(icmpEchoReply)
+	if p.v6 {
+		hdr = ipv6HdrLen + icmpHdrLen
+		typ, replyType = icmp6Echo, icmp6EchoReply
+	}
+	if size < hdr {
+		size = hdr
+	}
+	msg := make([]byte, size-hdr+icmpHdrLen)
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], p.id)
+	binary.BigEndian.PutUint16(msg[6:], p.seq)
+	if !p.v6 {
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+
+	start := time.Now()
+	if err := syscall.Sendto(p.fd, msg, 0, p.dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, size+ipv4HdrLen)
+	for time.Since(start) < timeout {
+		n, _, err := syscall.Recvfrom(p.fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		reply := buf[:n]
+		// raw ipv4 sockets read the ip header
+		if !p.v6 && n > 0 {
+			ihl := int(reply[0]&0x0f) * 4
+			if n < ihl {
+				continue
+			}
+			reply = reply[ihl:]
+		}
+		if len(reply) >= icmpHdrLen && reply[0] == replyType &&
+			binary.BigEndian.Uint16(reply[4:]) == p.id && binary.BigEndian.Uint16(reply[6:]) == p.seq {
+			return time.Since(start), nil
+		}
+	}
+
+	return 0, errNoReply
+}
+
+// checksum is the internet checksum of b
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
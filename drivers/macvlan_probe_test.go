@@ -0,0 +1,174 @@
+package drivers
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestChecksum(t *testing.T) {
+	// echo request, id 1, seq 1
+	assert.Equal(t, uint16(0xf7fd), checksum([]byte{8, 0, 0, 0, 0, 1, 0, 1}))
+	assert.Equal(t, uint16(0xfffe), checksum([]byte{0, 1}))
+}
+
+func TestProbeWithErr(t *testing.T) {
+	dir, d := initStoreFile(t)
+	defer os.RemoveAll(dir)
+	_, _, _, ep := initEndpointData()
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	assert.Nil(t, d.store.StoreUpdate(&configuration{ID: "1", Parent: "eth0"}))
+
+	_, err := Probe(d.opts, "0abcdef", "", ProbeOptions{})
+	assert.EqualError(t, err, "no such endpoint 0abcdef")
+	_, err = Probe(d.opts, "1234567", "", ProbeOptions{})
+	assert.EqualError(t, err, "endpoint 1234567 is not joined to a sandbox")
+	assert.Nil(t, d.Close())
+}
+
+func addTestAddr(h *netlink.Handle, link netlink.Link, cidr string) error {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return err
+	}
+	addr.Flags = syscall.IFA_F_NODAD
+	return h.AddrAdd(link, addr)
+}
+
+// waitCarrier waits for the carrier the kernel sets after the link is up
+func waitCarrier(h *netlink.Handle, name string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		link, err := h.LinkByName(name)
+		if err != nil || link.Attrs().OperState == netlink.OperUp || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProbeEndpoint(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	assert.Nil(t, netutils.CreateVethPair("mvprb0", "mvprb1"))
+	defer netutils.DeleteVethPair("mvprb0", "mvprb1")
+	host, err := ns.NlHandle().LinkByName("mvprb0")
+	assert.Nil(t, err)
+	peer, err := ns.NlHandle().LinkByName("mvprb1")
+	assert.Nil(t, err)
+	sbox, err := netns.GetFromPath(sandboxKey)
+	assert.Nil(t, err)
+	defer sbox.Close()
+	assert.Nil(t, ns.NlHandle().LinkSetNsFd(peer, int(sbox)))
+	h, err := netlink.NewHandleAt(sbox)
+	assert.Nil(t, err)
+	defer h.Delete()
+	peer, err = h.LinkByName("mvprb1")
+	assert.Nil(t, err)
+	assert.Nil(t, addTestAddr(h, peer, "10.99.0.2/24"))
+	assert.Nil(t, h.LinkSetUp(peer))
+	assert.Nil(t, addTestAddr(ns.NlHandle(), host, "10.99.0.1/24"))
+	assert.Nil(t, ns.NlHandle().LinkSetUp(host))
+	assert.Nil(t, waitCarrier(h, "mvprb1"))
+
+	config := &configuration{
+		ID:          "1",
+		Parent:      "mvprb0",
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "10.99.0.0/24", GwIP: "10.99.0.1/24"}},
+	}
+	ep := &endpoint{id: "1234567", nid: "1", mac: peer.Attrs().HardwareAddr}
+	ep.addr, _ = netlink.ParseIPNet("10.99.0.2/24")
+	popts := ProbeOptions{Count: 2, Timeout: 300 * time.Millisecond}
+
+	results := probeEndpoint(config, ep, sandboxKey, popts)
+	names := []string{}
+	for _, r := range results {
+		names = append(names, r.Name)
+		assert.Equal(t, CheckPass, r.Status, r.Name+": "+r.Detail)
+	}
+	assert.Equal(t, []string{
+		"parent mvprb0",
+		"sandbox interface mvprb1",
+		"sandbox address 10.99.0.2/24",
+		"gateway 10.99.0.1 arp",
+		"gateway 10.99.0.1 ping",
+		"gateway 10.99.0.1 mtu",
+	}, names)
+	assert.Equal(t, "at "+host.Attrs().HardwareAddr.String(), results[3].Detail)
+	assert.Equal(t, "1500 bytes with DF set", results[5].Detail)
+
+	// the sandbox interface accepts larger packets than the gateway's link
+	assert.Nil(t, h.LinkSetMTU(peer, 2000))
+	results = probeEndpoint(config, ep, sandboxKey, popts)
+	assert.Equal(t, CheckFail, results[5].Status)
+	assert.Contains(t, results[5].Detail, "the interface mtu is 2000")
+	assert.Nil(t, h.LinkSetMTU(peer, 1500))
+
+	// the address of the gateway is gone
+	addr, _ := netlink.ParseAddr("10.99.0.1/24")
+	assert.Nil(t, ns.NlHandle().AddrDel(host, addr))
+	results = probeEndpoint(config, ep, sandboxKey, popts)
+	assert.Equal(t, CheckFail, results[3].Status)
+	assert.Equal(t, "no arp reply to 2 requests", results[3].Detail)
+	assert.Equal(t, CheckSkip, results[4].Status)
+	assert.Equal(t, CheckSkip, results[5].Status)
+
+	// the parent is down, the gateway is not probed
+	assert.Nil(t, ns.NlHandle().LinkSetDown(host))
+	results = probeEndpoint(config, ep, sandboxKey, popts)
+	assert.Equal(t, CheckFail, results[0].Status)
+	assert.Equal(t, "link is down", results[0].Detail)
+	assert.Equal(t, CheckSkip, results[len(results)-1].Status)
+	assert.Equal(t, "gateway 10.99.0.1", results[len(results)-1].Name)
+}
+
+func TestProbeEndpointIPv6(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	assert.Nil(t, netutils.CreateVethPair("mvprb2", "mvprb3"))
+	defer netutils.DeleteVethPair("mvprb2", "mvprb3")
+	host, err := ns.NlHandle().LinkByName("mvprb2")
+	assert.Nil(t, err)
+	peer, err := ns.NlHandle().LinkByName("mvprb3")
+	assert.Nil(t, err)
+	sbox, err := netns.GetFromPath(sandboxKey)
+	assert.Nil(t, err)
+	defer sbox.Close()
+	assert.Nil(t, ns.NlHandle().LinkSetNsFd(peer, int(sbox)))
+	h, err := netlink.NewHandleAt(sbox)
+	assert.Nil(t, err)
+	defer h.Delete()
+	peer, err = h.LinkByName("mvprb3")
+	assert.Nil(t, err)
+	if err := addTestAddr(ns.NlHandle(), host, "fd99::1/64"); err != nil {
+		t.Skipf("ipv6 is not supported: %v", err)
+	}
+	assert.Nil(t, addTestAddr(h, peer, "fd99::2/64"))
+	assert.Nil(t, h.LinkSetUp(peer))
+	assert.Nil(t, ns.NlHandle().LinkSetUp(host))
+	assert.Nil(t, waitCarrier(h, "mvprb3"))
+
+	config := &configuration{
+		ID:          "1",
+		Parent:      "mvprb2",
+		Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "fd99::/64", GwIP: "fd99::1/64"}},
+	}
+	ep := &endpoint{id: "1234567", nid: "1", mac: peer.Attrs().HardwareAddr}
+	ep.addrv6 = &net.IPNet{IP: net.ParseIP("fd99::2"), Mask: net.CIDRMask(64, 128)}
+
+	results := probeEndpoint(config, ep, sandboxKey, ProbeOptions{Count: 2, Timeout: 300 * time.Millisecond})
+	for _, r := range results {
+		assert.Equal(t, CheckPass, r.Status, r.Name+": "+r.Detail)
+	}
+	assert.Equal(t, 6, len(results))
+	assert.Equal(t, "gateway fd99::1 ndp", results[3].Name)
+	assert.Equal(t, "at "+host.Attrs().HardwareAddr.String(), results[3].Detail)
+}
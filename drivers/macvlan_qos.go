@@ -0,0 +1,277 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	egressQosOpt  = "egress_qos_map"  // -o egress_qos_map=skb_prio:pcp,...
+	ingressQosOpt = "ingress_qos_map" // -o ingress_qos_map=pcp:skb_prio,...
+	dscpOpt       = "dscp"            // -o dscp=46 marks every endpoint's egress traffic
+
+	iflaVlanQosMapping  = 1    // IFLA_VLAN_QOS_MAPPING
+	maxPcp              = 7    // 802.1p priority code points are 3 bits
+	maxDscp             = 63   // DSCP is the upper 6 bits of the tos/traffic class
+	tcaPeditParms       = 2    // TCA_PEDIT_PARMS
+	tcaCsumParms        = 1    // TCA_CSUM_PARMS
+	csumUpdateIPv4Hdr   = 1    // TCA_CSUM_UPDATE_FLAG_IPV4HDR
+	sizeofTcPeditKey    = 24   // struct tc_pedit_key
+	sizeofTcPeditSelHdr = 24   // struct tc_pedit_sel up to the keys, padded
+	dscpIPv4Shift       = 18   // tos byte in the first ipv4 header word, dscp above ecn
+	dscpIPv6Shift       = 22   // traffic class in the first ipv6 header word, dscp above ecn
+	dscpMask            = 0x3f // six bits of dscp
+)
+
+// vlanQosMapping maps a priority to another: skb priority to 802.1p PCP on
+// egress, PCP to skb priority on ingress
+type vlanQosMapping struct {
+	From uint32
+	To   uint32
+}
+
+type byQosFrom []vlanQosMapping
+
+func (m byQosFrom) Len() int           { return len(m) }
+func (m byQosFrom) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byQosFrom) Less(i, j int) bool { return m[i].From < m[j].From }
+
+// parseQosMap parses an ip-link style qos map, ex. 0:3,5:5. The maximum
+// value allowed on either side of the ':' depends on the direction.
+func parseQosMap(qosMap string, maxFrom, maxTo uint32) ([]vlanQosMapping, error) {
+	var mappings []vlanQosMapping
+	seen := make(map[uint32]bool)
+	for _, entry := range strings.FieldsFunc(qosMap, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("mapping %q must be formatted as from:to", entry)
+		}
+		from, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || uint32(from) > maxFrom {
+			return nil, fmt.Errorf("mapping %q must start with a value between 0 and %d", entry, maxFrom)
+		}
+		to, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || uint32(to) > maxTo {
+			return nil, fmt.Errorf("mapping %q must end with a value between 0 and %d", entry, maxTo)
+		}
+		if seen[uint32(from)] {
+			return nil, fmt.Errorf("priority %d is mapped more than once", from)
+		}
+		seen[uint32(from)] = true
+		mappings = append(mappings, vlanQosMapping{From: uint32(from), To: uint32(to)})
+	}
+	sort.Sort(byQosFrom(mappings))
+
+	return mappings, nil
+}
+
+// parseEgressQosMap parses -o egress_qos_map, skb priorities to PCP values
+func parseEgressQosMap(qosMap string) ([]vlanQosMapping, error) {
+	return parseQosMap(qosMap, ^uint32(0), maxPcp)
+}
+
+// parseIngressQosMap parses -o ingress_qos_map, PCP values to skb priorities
+func parseIngressQosMap(qosMap string) ([]vlanQosMapping, error) {
+	return parseQosMap(qosMap, maxPcp, ^uint32(0))
+}
+
+// parseDscp parses -o dscp, a decimal or 0x prefixed DSCP value
+func parseDscp(dscp string) (uint8, error) {
+	v, err := strconv.ParseUint(dscp, 0, 8)
+	if err != nil || v > maxDscp {
+		return 0, fmt.Errorf("dscp must be a value between 0 and %d, received: %s", maxDscp, dscp)
+	}
+
+	return uint8(v), nil
+}
+
+// validateQosOptions verifies the qos options of a network configuration
+func (config *configuration) validateQosOptions() error {
+	if config.EgressQosMap != "" {
+		if _, err := parseEgressQosMap(config.EgressQosMap); err != nil {
+			return fmt.Errorf("invalid -o %s=%s: %v", egressQosOpt, config.EgressQosMap, err)
+		}
+	}
+	if config.IngressQosMap != "" {
+		if _, err := parseIngressQosMap(config.IngressQosMap); err != nil {
+			return fmt.Errorf("invalid -o %s=%s: %v", ingressQosOpt, config.IngressQosMap, err)
+		}
+	}
+	if config.EgressQosMap != "" || config.IngressQosMap != "" {
+		// the maps are only programmed on vlan links
+		if !strings.Contains(config.Parent, ".") {
+			return fmt.Errorf("-o %s and -o %s require a vlan sub-interface parent, ex. eth0.10", egressQosOpt, ingressQosOpt)
+		}
+	}
+	if config.Dscp != "" {
+		if _, err := parseDscp(config.Dscp); err != nil {
+			return fmt.Errorf("invalid -o %s=%s: %v", dscpOpt, config.Dscp, err)
+		}
+	}
+
+	return nil
+}
+
+// setParentQosMaps programs the qos maps on a parent the driver did not
+// create, which must be a vlan link to carry them
+func (config *configuration) setParentQosMaps() error {
+	if config.EgressQosMap == "" && config.IngressQosMap == "" {
+		return nil
+	}
+	link, err := ns.NlHandle().LinkByName(config.Parent)
+	if err != nil {
+		return fmt.Errorf("failed to find the parent link %s: %v", config.Parent, err)
+	}
+	if link.Type() != "vlan" {
+		return fmt.Errorf("-o %s and -o %s require a vlan parent, %s is a %s link", egressQosOpt, ingressQosOpt, config.Parent, link.Type())
+	}
+	egress, err := parseEgressQosMap(config.EgressQosMap)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", egressQosOpt, err)
+	}
+	ingress, err := parseIngressQosMap(config.IngressQosMap)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", ingressQosOpt, err)
+	}
+	if err := setVlanQosMaps(link, egress, ingress); err != nil {
+		return fmt.Errorf("failed to set the qos maps of %s vlan link: %v", config.Parent, err)
+	}
+
+	return nil
+}
+
+// setVlanQosMaps programs the 802.1p priority maps of a vlan link. The
+// vendored netlink Vlan type has no qos fields so the link change request
+// is built here.
+func setVlanQosMaps(link netlink.Link, egress, ingress []vlanQosMapping) error {
+	if len(egress) == 0 && len(ingress) == 0 {
+		return nil
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("vlan"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	addQosMappings(data, nl.IFLA_VLAN_EGRESS_QOS, egress)
+	addQosMappings(data, nl.IFLA_VLAN_INGRESS_QOS, ingress)
+	req.AddData(linkInfo)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+
+	return err
+}
+
+func addQosMappings(data *nl.RtAttr, attrType int, mappings []vlanQosMapping) {
+	if len(mappings) == 0 {
+		return
+	}
+	native := nl.NativeEndian()
+	qos := nl.NewRtAttrChild(data, attrType, nil)
+	for _, m := range mappings {
+		b := make([]byte, 8)
+		native.PutUint32(b[0:], m.From)
+		native.PutUint32(b[4:], m.To)
+		nl.NewRtAttrChild(qos, iflaVlanQosMapping, b)
+	}
+}
+
+// setDscpMark rewrites the DSCP of every ipv4 and ipv6 packet sent by the
+// slave with pedit filters on the clsact egress hook, ipv4 header checksums
+// are fixed up by a csum action.
+func setDscpMark(linkName string, dscp uint8) error {
+	link, err := ns.NlHandle().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s to apply dscp mark: %v", linkName, err)
+	}
+	mask, val := dscpPeditKey(dscp, dscpIPv4Shift)
+	err = addU32Filter(link, clsactEgress, 1, syscall.ETH_P_IP, func(options *nl.RtAttr) {
+		actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+		addPeditAction(actions, nl.TCA_ACT_TAB, mask, val, int32(netlink.TC_ACT_PIPE))
+		addCsumAction(actions, nl.TCA_ACT_TAB+1, csumUpdateIPv4Hdr)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ipv4 dscp mark on %s: %v", linkName, err)
+	}
+	mask, val = dscpPeditKey(dscp, dscpIPv6Shift)
+	err = addU32Filter(link, clsactEgress, 2, syscall.ETH_P_IPV6, func(options *nl.RtAttr) {
+		actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+		addPeditAction(actions, nl.TCA_ACT_TAB, mask, val, int32(netlink.TC_ACT_OK))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ipv6 dscp mark on %s: %v", linkName, err)
+	}
+	logrus.Debugf("Set dscp mark %d on %s", dscp, linkName)
+
+	return nil
+}
+
+// dscpPeditKey returns the pedit mask and value rewriting the dscp bits of the
+// first 32 bit word of the ip header. pedit applies them to the raw packet
+// bytes, so they are converted from network to host byte order.
+func dscpPeditKey(dscp uint8, shift uint) (uint32, uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, ^uint32(dscpMask<<shift))
+	mask := nl.NativeEndian().Uint32(b)
+	binary.BigEndian.PutUint32(b, uint32(dscp)<<shift)
+	val := nl.NativeEndian().Uint32(b)
+
+	return mask, val
+}
+
+// addPeditAction adds a pedit action with a single key at offset 0 of the
+// network header, ex. tc action pedit munge offset 0 u32 ...
+func addPeditAction(actions *nl.RtAttr, index int, mask, val uint32, action int32) {
+	native := nl.NativeEndian()
+	table := nl.NewRtAttrChild(actions, index, nil)
+	nl.NewRtAttrChild(table, nl.TCA_ACT_KIND, nl.ZeroTerminated("pedit"))
+	aopts := nl.NewRtAttrChild(table, nl.TCA_ACT_OPTIONS, nil)
+	gen := nl.TcGen{Action: action}
+	parms := make([]byte, sizeofTcPeditSelHdr+sizeofTcPeditKey)
+	copy(parms, gen.Serialize())
+	parms[nl.SizeofTcGen] = 1 // nkeys
+	key := parms[sizeofTcPeditSelHdr:]
+	native.PutUint32(key[0:], mask)
+	native.PutUint32(key[4:], val)
+	nl.NewRtAttrChild(aopts, tcaPeditParms, parms)
+}
+
+// addCsumAction adds a csum action recalculating the given checksums
+func addCsumAction(actions *nl.RtAttr, index int, flags uint32) {
+	table := nl.NewRtAttrChild(actions, index, nil)
+	nl.NewRtAttrChild(table, nl.TCA_ACT_KIND, nl.ZeroTerminated("csum"))
+	aopts := nl.NewRtAttrChild(table, nl.TCA_ACT_OPTIONS, nil)
+	gen := nl.TcGen{Action: int32(netlink.TC_ACT_OK)}
+	parms := make([]byte, nl.SizeofTcGen+4)
+	copy(parms, gen.Serialize())
+	nl.NativeEndian().PutUint32(parms[nl.SizeofTcGen:], flags)
+	nl.NewRtAttrChild(aopts, tcaCsumParms, parms)
+}
+
+// setEndpointQos programs the endpoint rate limits and the dscp mark of the
+// network on the slave
+func setEndpointQos(linkName string, limits *bandwidthLimits, dscp string) error {
+	if err := setBandwidthLimits(linkName, limits); err != nil {
+		return err
+	}
+	if dscp == "" {
+		return nil
+	}
+	mark, err := parseDscp(dscp)
+	if err != nil {
+		return err
+	}
+
+	return setDscpMark(linkName, mark)
+}
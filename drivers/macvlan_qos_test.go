@@ -0,0 +1,121 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestParseQosMap(t *testing.T) {
+	m, err := parseEgressQosMap("5:5, 0:3,1:2")
+	assert.Nil(t, err)
+	assert.EqualValues(t, []vlanQosMapping{{0, 3}, {1, 2}, {5, 5}}, m)
+
+	m, err = parseIngressQosMap("")
+	assert.Nil(t, err)
+	assert.Empty(t, m)
+
+	_, err = parseEgressQosMap("0:8")
+	assert.EqualError(t, err, `mapping "0:8" must end with a value between 0 and 7`)
+	_, err = parseIngressQosMap("8:0")
+	assert.EqualError(t, err, `mapping "8:0" must start with a value between 0 and 7`)
+	_, err = parseIngressQosMap("1:2,1:3")
+	assert.EqualError(t, err, "priority 1 is mapped more than once")
+	_, err = parseEgressQosMap("1-2")
+	assert.EqualError(t, err, `mapping "1-2" must be formatted as from:to`)
+}
+
+func TestParseDscp(t *testing.T) {
+	v, err := parseDscp("46")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 46, v)
+	v, err = parseDscp("0x2e")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 46, v)
+	_, err = parseDscp("64")
+	assert.NotNil(t, err)
+	_, err = parseDscp("ef")
+	assert.NotNil(t, err)
+}
+
+func TestDscpPeditKey(t *testing.T) {
+	b := make([]byte, 4)
+	mask, val := dscpPeditKey(46, dscpIPv4Shift)
+	nl.NativeEndian().PutUint32(b, val)
+	// the tos byte of the ipv4 header carries the dscp above the two ecn bits
+	assert.EqualValues(t, []byte{0, 46 << 2, 0, 0}, b)
+	nl.NativeEndian().PutUint32(b, mask)
+	assert.EqualValues(t, []byte{0xff, 0x03, 0xff, 0xff}, b)
+
+	mask, val = dscpPeditKey(46, dscpIPv6Shift)
+	nl.NativeEndian().PutUint32(b, val)
+	assert.EqualValues(t, uint32(46)<<2<<20, binary.BigEndian.Uint32(b))
+	nl.NativeEndian().PutUint32(b, mask)
+	assert.EqualValues(t, []byte{0xf0, 0x3f, 0xff, 0xff}, b)
+}
+
+func TestValidateQosOptions(t *testing.T) {
+	config := &configuration{
+		Parent:        "eth0.10",
+		EgressQosMap:  "0:5",
+		IngressQosMap: "5:0",
+		Dscp:          "46",
+	}
+	assert.Nil(t, config.validateQosOptions())
+
+	config.Parent = "eth0"
+	assert.EqualError(t, config.validateQosOptions(), "-o egress_qos_map and -o ingress_qos_map require a vlan sub-interface parent, ex. eth0.10")
+
+	config = &configuration{Parent: "eth0", Dscp: "100"}
+	assert.EqualError(t, config.validateQosOptions(), "invalid -o dscp=100: dscp must be a value between 0 and 63, received: 100")
+}
+
+func TestCreateNetworkWithInvalidQos(t *testing.T) {
+	_, d, r, _ := initNetworkData()
+	opts := r.Options[netlabel.GenericData].(map[string]string)
+	opts[egressQosOpt] = "0:9"
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, `invalid -o egress_qos_map=0:9: mapping "0:9" must end with a value between 0 and 7`)
+	assert.Empty(t, d.networks[r.NetworkID])
+}
+
+func TestAllocateNetworkWithDscp(t *testing.T) {
+	_, d, r, n := initData()
+	r.Options[dscpOpt] = "46"
+	n.config.Dscp = "46"
+	res, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestMarshaJSONForConfigWithQos(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	c := d.networks[r.NetworkID].config
+	c.Parent = "eth0.10"
+	c.EgressQosMap = "0:3"
+	c.IngressQosMap = "3:0"
+	c.Dscp = "46"
+	b, err := c.MarshalJSON()
+	assert.Nil(t, err)
+	c1 := &configuration{}
+	err1 := c1.UnmarshalJSON(b)
+	assert.Nil(t, err1)
+	assert.EqualValues(t, c, c1)
+}
+
+func TestCreateNetworkWithQosOnExistingParent(t *testing.T) {
+	assert.Nil(t, netutils.CreateVethPair("mvqos0.10", "mvqos1"))
+	defer netutils.DeleteVethPair("mvqos0.10", "mvqos1")
+	_, d, r, _ := initNetworkData()
+	opts := r.Options[netlabel.GenericData].(map[string]string)
+	opts[parentOpt] = "mvqos0.10"
+	opts[egressQosOpt] = "0:5"
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "CreateNetwork is failed -o egress_qos_map and -o ingress_qos_map require a vlan parent, mvqos0.10 is a veth link")
+	assert.Empty(t, d.networks[r.NetworkID])
+}
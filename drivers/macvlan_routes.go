@@ -0,0 +1,111 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+)
+
+const (
+	routesOpt   = "routes"                      // -o routes=10.0.0.0/8 via 192.168.10.254;...
+	epRoutesOpt = macvlanType + "." + routesOpt // endpoint option macvlan.routes
+)
+
+// staticRoute is a route pushed into the container on join. A route without
+// a next hop is reachable directly on the macvlan interface.
+type staticRoute struct {
+	Destination string
+	NextHop     string
+}
+
+// parseRoutes parses a ';' separated list of routes formatted as
+// "10.0.0.0/8 via 192.168.10.254" or "10.1.0.0/16" for connected routes
+func parseRoutes(routes string) ([]*staticRoute, error) {
+	var rs []*staticRoute
+	for _, entry := range strings.Split(routes, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+			return nil, fmt.Errorf("route %q must be formatted as <destination> [via <next hop>]", strings.TrimSpace(entry))
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("route destination %s is not a valid CIDR", fields[0])
+		}
+		r := &staticRoute{Destination: dst.String()}
+		if len(fields) == 3 {
+			nh := net.ParseIP(fields[2])
+			if nh == nil {
+				return nil, fmt.Errorf("route next hop %s is not a valid ip address", fields[2])
+			}
+			if (nh.To4() == nil) != (dst.IP.To4() == nil) {
+				return nil, fmt.Errorf("route %s via %s mixes ipv4 and ipv6 addresses", dst, nh)
+			}
+			r.NextHop = nh.String()
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+// validateRoutes verifies every next hop is reachable on one of the network subnets
+func (config *configuration) validateRoutes(routes []*staticRoute) error {
+	for _, r := range routes {
+		if r.NextHop == "" {
+			continue
+		}
+		nh := net.ParseIP(r.NextHop)
+		if !config.onLink(nh) {
+			return fmt.Errorf("route %s next hop %s is not in a subnet of network %s", r.Destination, r.NextHop, config.ID)
+		}
+	}
+
+	return nil
+}
+
+// onLink returns whether the ip belongs to one of the network subnets
+func (config *configuration) onLink(ip net.IP) bool {
+	var subnets []string
+	if ip.To4() != nil {
+		for _, s := range config.Ipv4Subnets {
+			subnets = append(subnets, s.SubnetIP)
+		}
+	} else {
+		for _, s := range config.Ipv6Subnets {
+			subnets = append(subnets, s.SubnetIP)
+		}
+	}
+	for _, s := range subnets {
+		if _, snet, err := net.ParseCIDR(s); err == nil && snet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// joinRoutes converts the network and endpoint routes to the join response format
+func joinRoutes(routes ...[]*staticRoute) []*pluginNet.StaticRoute {
+	var res []*pluginNet.StaticRoute
+	for _, rs := range routes {
+		for _, r := range rs {
+			sr := &pluginNet.StaticRoute{
+				Destination: r.Destination,
+				RouteType:   types.CONNECTED,
+			}
+			if r.NextHop != "" {
+				sr.RouteType = types.NEXTHOP
+				sr.NextHop = r.NextHop
+			}
+			res = append(res, sr)
+		}
+	}
+
+	return res
+}
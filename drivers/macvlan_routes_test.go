@@ -0,0 +1,138 @@
+package drivers
+
+import (
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	rs, err := parseRoutes("10.0.0.0/8 via 192.168.10.254; 172.16.1.0/24;fd00::/8 via fe80::1;")
+	assert.Nil(t, err)
+	assert.EqualValues(t, []*staticRoute{
+		{Destination: "10.0.0.0/8", NextHop: "192.168.10.254"},
+		{Destination: "172.16.1.0/24"},
+		{Destination: "fd00::/8", NextHop: "fe80::1"},
+	}, rs)
+
+	_, err = parseRoutes("10.0.0.0/8 through 192.168.10.254")
+	assert.EqualError(t, err, `route "10.0.0.0/8 through 192.168.10.254" must be formatted as <destination> [via <next hop>]`)
+	_, err = parseRoutes("10.0.0.0 via 192.168.10.254")
+	assert.EqualError(t, err, "route destination 10.0.0.0 is not a valid CIDR")
+	_, err = parseRoutes("10.0.0.0/8 via gateway")
+	assert.EqualError(t, err, "route next hop gateway is not a valid ip address")
+	_, err = parseRoutes("10.0.0.0/8 via fe80::1")
+	assert.EqualError(t, err, "route 10.0.0.0/8 via fe80::1 mixes ipv4 and ipv6 addresses")
+}
+
+func TestValidateRoutes(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	c := d.networks[r.NetworkID].config
+	assert.Nil(t, c.validateRoutes([]*staticRoute{
+		{Destination: "10.0.0.0/8", NextHop: "192.168.2.254"},
+		{Destination: "172.16.0.0/12"},
+	}))
+	assert.EqualError(t, c.validateRoutes([]*staticRoute{
+		{Destination: "10.0.0.0/8", NextHop: "192.168.3.254"},
+	}), "route 10.0.0.0/8 next hop 192.168.3.254 is not in a subnet of network 1")
+}
+
+func TestCreateNetworkWithInvalidRoutes(t *testing.T) {
+	_, d, r, _ := initNetworkData()
+	opts := r.Options[netlabel.GenericData].(map[string]string)
+	opts[routesOpt] = "10.0.0.0/8 via 10.1.1.1"
+	err := d.CreateNetwork(r)
+	assert.EqualError(t, err, "invalid -o routes: route 10.0.0.0/8 next hop 10.1.1.1 is not in a subnet of network 1")
+	assert.Empty(t, d.networks[r.NetworkID])
+}
+
+func TestAllocateNetworkWithRoutes(t *testing.T) {
+	_, d, r, n := initData()
+	r.Options[routesOpt] = "10.0.0.0/8 via 192.168.1.254"
+	n.config.StaticRoutes = []*staticRoute{{Destination: "10.0.0.0/8", NextHop: "192.168.1.254"}}
+	res, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestCreateEndpointWithInvalidRoutes(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	r.Options[epRoutesOpt] = "10.0.0.0/8 via 10.1.1.1"
+	ms.On("StoreUpdate", ep).Return(nil)
+	res, err := d.CreateEndpoint(r)
+	assert.Nil(t, res)
+	assert.EqualError(t, err, "create endpoint was passed invalid macvlan.routes option: route 10.0.0.0/8 next hop 10.1.1.1 is not in a subnet of network 1")
+}
+
+func TestJoinWithRoutes(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	n := d.networks[r.NetworkID]
+	n.config.StaticRoutes = []*staticRoute{{Destination: "10.0.0.0/8", NextHop: "192.168.2.254"}}
+	ep.routes = []*staticRoute{{Destination: "172.16.0.0/12"}}
+	n.endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	jr := &pluginNet.JoinRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	res, err := d.Join(jr)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	defer func() {
+		if link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+	}()
+	assert.EqualValues(t, []*pluginNet.StaticRoute{
+		{Destination: "10.0.0.0/8", RouteType: types.NEXTHOP, NextHop: "192.168.2.254"},
+		{Destination: "172.16.0.0/12", RouteType: types.CONNECTED},
+	}, res.StaticRoutes)
+	assert.False(t, res.DisableGatewayService)
+	assert.Equal(t, "192.168.2.1", res.Gateway)
+}
+
+func TestJoinWithInternal(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	n := d.networks[r.NetworkID]
+	n.config.Internal = true
+	n.endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	jr := &pluginNet.JoinRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+	}
+	res, err := d.Join(jr)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	defer func() {
+		if link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+	}()
+	assert.True(t, res.DisableGatewayService)
+	assert.Empty(t, res.Gateway)
+	assert.Empty(t, res.GatewayIPv6)
+}
+
+func TestMarshaJSONWithRoutes(t *testing.T) {
+	_, d, r, ep := initEndpointData()
+	ep.routes = []*staticRoute{{Destination: "172.16.0.0/12"}}
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	ep1 := &endpoint{}
+	assert.Nil(t, ep1.UnmarshalJSON(b))
+	assert.EqualValues(t, ep, ep1)
+
+	c := d.networks[r.NetworkID].config
+	c.StaticRoutes = []*staticRoute{{Destination: "10.0.0.0/8", NextHop: "192.168.2.254"}}
+	b, err = c.MarshalJSON()
+	assert.Nil(t, err)
+	c1 := &configuration{}
+	assert.Nil(t, c1.UnmarshalJSON(b))
+	assert.EqualValues(t, c, c1)
+}
@@ -0,0 +1,52 @@
+package drivers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// sandboxInfo is the container namespace an endpoint joined, kept until the
+// endpoint leaves it
+type sandboxInfo struct {
+	Key      string
+	JoinedAt time.Time
+	Labels   map[string]string `json:",omitempty"`
+}
+
+// metadataLabels returns the container and service labels of the endpoint
+// or join options: the namespaced string options other than the libnetwork
+// and driver options
+func metadataLabels(options map[string]interface{}) map[string]string {
+	var labels map[string]string
+	add := func(opts map[string]interface{}) {
+		for k, v := range opts {
+			s, ok := v.(string)
+			if !ok || !strings.Contains(k, ".") || strings.HasPrefix(k, netlabel.Prefix) || strings.HasPrefix(k, macvlanType+".") {
+				continue
+			}
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[k] = s
+		}
+	}
+	add(options)
+	if genData, ok := options[netlabel.GenericData].(map[string]interface{}); ok {
+		add(genData)
+	}
+
+	return labels
+}
+
+// joinSandbox returns the sandbox of a join, a retried join of the same
+// sandbox keeps the time of the first one
+func (ep *endpoint) joinSandbox(key string, options map[string]interface{}) *sandboxInfo {
+	sb := &sandboxInfo{Key: key, JoinedAt: time.Now().UTC(), Labels: metadataLabels(options)}
+	if ep.sandbox != nil && ep.sandbox.Key == key {
+		sb.JoinedAt = ep.sandbox.JoinedAt
+	}
+
+	return sb
+}
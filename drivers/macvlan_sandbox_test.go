@@ -0,0 +1,87 @@
+package drivers
+
+import (
+	"fmt"
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataLabels(t *testing.T) {
+	assert.Nil(t, metadataLabels(map[string]interface{}{"parent": "eth0"}))
+	assert.Equal(t, map[string]string{
+		"com.docker.swarm.service.name": "web",
+		"com.docker.compose.project":    "shop",
+	}, metadataLabels(map[string]interface{}{
+		"com.docker.swarm.service.name": "web",
+		netlabel.MacAddress:             "02:42:c0:a8:02:02",
+		epRoutesOpt:                     "10.0.0.0/8",
+		"com.docker.swarm.task.slot":    1.0,
+		netlabel.GenericData: map[string]interface{}{
+			"com.docker.compose.project": "shop",
+		},
+	}))
+}
+
+func TestCreateEndpointRecordsLabels(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	r.Options["com.docker.swarm.service.name"] = "web"
+	ep.labels = map[string]string{"com.docker.swarm.service.name": "web"}
+	ms.On("StoreUpdate", ep).Return(nil)
+	_, err := d.CreateEndpoint(r)
+	assert.Nil(t, err)
+	assert.Equal(t, ep.labels, d.networks[r.NetworkID].endpoints[r.EndpointID].labels)
+}
+
+func TestJoinLeaveRecordsSandbox(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(nil)
+	jr := &pluginNet.JoinRequest{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+		SandboxKey: "/var/run/docker/netns/1a2b3c",
+		Options:    map[string]interface{}{"com.docker.swarm.service.name": "web"},
+	}
+	res, err := d.Join(jr)
+	assert.Nil(t, err)
+	defer func() {
+		if link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+	}()
+	assert.Equal(t, jr.SandboxKey, ep.sandbox.Key)
+	assert.Equal(t, map[string]string{"com.docker.swarm.service.name": "web"}, ep.sandbox.Labels)
+	assert.False(t, ep.sandbox.JoinedAt.IsZero())
+
+	// a retried join keeps the join time, the record survives a restart
+	joinedAt := ep.sandbox.JoinedAt
+	_, err = d.Join(jr)
+	assert.Nil(t, err)
+	assert.Equal(t, joinedAt, ep.sandbox.JoinedAt)
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	ep1 := &endpoint{}
+	assert.Nil(t, ep1.UnmarshalJSON(b))
+	assert.Equal(t, jr.SandboxKey, ep1.sandbox.Key)
+	assert.True(t, joinedAt.Equal(ep1.sandbox.JoinedAt))
+
+	lr := &pluginNet.LeaveRequest{NetworkID: r.NetworkID, EndpointID: r.EndpointID}
+	assert.Nil(t, d.Leave(lr))
+	assert.Nil(t, ep.sandbox)
+	assert.Nil(t, d.Leave(lr))
+	ms.AssertNumberOfCalls(t, "StoreUpdate", 3)
+}
+
+func TestLeaveStoreFailure(t *testing.T) {
+	ms, d, r, ep := initEndpointData()
+	ep.sandbox = &sandboxInfo{Key: "/var/run/docker/netns/1a2b3c"}
+	d.networks[r.NetworkID].endpoints[r.EndpointID] = ep
+	ms.On("StoreUpdate", ep).Return(fmt.Errorf("error"))
+	err := d.Leave(&pluginNet.LeaveRequest{NetworkID: r.NetworkID, EndpointID: r.EndpointID})
+	assert.EqualError(t, err, "failed to save macvlan endpoint 1234567 to store: error")
+	assert.NotNil(t, ep.sandbox)
+}
@@ -0,0 +1,162 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// storeVersion is the version of the records written to the local store.
+// Version 0 records carry no version, keep their nested values as json
+// strings and name the created slave link flag CreatedSubIface.
+const storeVersion = 1
+
+const macvlanQuarantinePrefix = macvlanPrefix + "/quarantine"
+
+// newerRecordError is returned for a record written by a newer plugin, the
+// record is left in place for that plugin to read after an upgrade
+type newerRecordError struct {
+	version int
+}
+
+func (e *newerRecordError) Error() string {
+	return fmt.Sprintf("record version %d is newer than the supported version %d", e.version, storeVersion)
+}
+
+// migration upgrades a decoded record from its version to the next one
+type migration func(record map[string]interface{}) error
+
+// the migrations of version i are at index i, a record is upgraded by
+// applying them in turn from its version up to storeVersion
+var (
+	endpointMigrations = []migration{migrateEndpointV0}
+	configMigrations   = []migration{migrateConfigV0}
+)
+
+// endpointRecord is the stored form of an endpoint
+type endpointRecord struct {
+	Version      int
+	ID           string `json:"id"`
+	NetworkID    string `json:"nid"`
+	SrcName      string
+	MacAddress   string            `json:",omitempty"`
+	Addr         string            `json:",omitempty"`
+	Addrv6       string            `json:",omitempty"`
+	Bandwidth    *bandwidthLimits  `json:",omitempty"`
+	StaticRoutes []*staticRoute    `json:",omitempty"`
+	Tap          *tapDevice        `json:",omitempty"`
+	Labels       map[string]string `json:",omitempty"`
+	Sandbox      *sandboxInfo      `json:",omitempty"`
+	Tuning       *ifaceTuning      `json:",omitempty"`
+}
+
+// configurationRecord is the stored form of a network configuration
+type configurationRecord struct {
+	Version          int
+	ID               string
+	Mtu              int
+	Parent           string
+	MacvlanMode      string
+	LinkType         string `json:",omitempty"`
+	Internal         bool
+	CreatedSlaveLink bool
+	Bridge           string         `json:",omitempty"`
+	CreatedBridge    bool           `json:",omitempty"`
+	Vrf              string         `json:",omitempty"`
+	VrfTable         string         `json:",omitempty"`
+	CreatedVrf       bool           `json:",omitempty"`
+	EgressQosMap     string         `json:",omitempty"`
+	IngressQosMap    string         `json:",omitempty"`
+	Dscp             string         `json:",omitempty"`
+	MacPolicy        string         `json:",omitempty"`
+	GatewayCheck     bool           `json:",omitempty"`
+	Tuning           *ifaceTuning   `json:",omitempty"`
+	StaticRoutes     []*staticRoute `json:",omitempty"`
+	Ipv4Subnets      []*ipv4Subnet  `json:",omitempty"`
+	Ipv6Subnets      []*ipv6Subnet  `json:",omitempty"`
+}
+
+// decodeRecord upgrades a stored record with the migrations and decodes it
+// into v. It returns the version the record was stored with. Fields of the
+// wrong type return an error rather than being ignored.
+func decodeRecord(b []byte, migrations []migration, v interface{}) (int, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return 0, err
+	}
+	if record == nil {
+		return 0, fmt.Errorf("record is empty")
+	}
+	version := 0
+	if raw, ok := record["Version"]; ok {
+		f, ok := raw.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return 0, fmt.Errorf("invalid record version %v", raw)
+		}
+		version = int(f)
+	}
+	if version > storeVersion {
+		return version, &newerRecordError{version: version}
+	}
+	for i := version; i < storeVersion; i++ {
+		if err := migrations[i](record); err != nil {
+			return version, fmt.Errorf("failed to migrate record from version %d: %v", i, err)
+		}
+	}
+	record["Version"] = storeVersion
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return version, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return version, err
+	}
+
+	return version, nil
+}
+
+// migrateEndpointV0 decodes the bandwidth limits and routes json strings
+func migrateEndpointV0(record map[string]interface{}) error {
+	for _, key := range []string{"Bandwidth", "StaticRoutes"} {
+		if err := unquoteField(record, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateConfigV0 decodes the routes and subnets json strings and renames
+// CreatedSubIface
+func migrateConfigV0(record map[string]interface{}) error {
+	if v, ok := record["CreatedSubIface"]; ok {
+		record["CreatedSlaveLink"] = v
+		delete(record, "CreatedSubIface")
+	}
+	for _, key := range []string{"StaticRoutes", "Ipv4Subnets", "Ipv6Subnets"} {
+		if err := unquoteField(record, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unquoteField replaces a field holding json as a string by its decoded value
+func unquoteField(record map[string]interface{}, key string) error {
+	s, ok := record[key].(string)
+	if !ok {
+		return nil
+	}
+	if s == "" {
+		delete(record, key)
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return fmt.Errorf("invalid %s %q: %v", key, s, err)
+	}
+	record[key] = v
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package drivers
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/docker/libnetwork/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+// records as written by the previous versions of the driver
+const (
+	endpointV0 = `{"id":"1234567","nid":"1","SrcName":"veth1234567",` +
+		`"MacAddress":"02:42:c0:a8:02:02","Addr":"192.168.2.2/24","Addrv6":"fe80::c0a8:202/120"}`
+	endpointV0Bare    = `{"id":"1234567","nid":"1","SrcName":""}`
+	endpointV0Options = `{"id":"1234567","nid":"1","SrcName":"veth1234567",` +
+		`"Bandwidth":"{\"EgressRate\":1000,\"EgressBurst\":10,\"IngressRate\":2000,\"IngressBurst\":20}",` +
+		`"StaticRoutes":"[{\"Destination\":\"10.0.0.0/8\",\"NextHop\":\"192.168.2.254\"}]"}`
+	configV0 = `{"ID":"1","Mtu":1500,"Parent":"eth0.10","MacvlanMode":"bridge","Internal":false,"CreatedSubIface":true,` +
+		`"Ipv4Subnets":"[{\"SubnetIP\":\"192.168.2.0/24\",\"GwIP\":\"192.168.2.1/24\"}]",` +
+		`"Ipv6Subnets":"[{\"SubnetIP\":\"fe80::c0a8:200/120\",\"GwIP\":\"fe80::c0a8:201/120\"}]"}`
+	configV0Options = `{"ID":"1","Mtu":0,"Parent":"eth0","MacvlanMode":"private","Internal":true,"CreatedSubIface":false,` +
+		`"EgressQosMap":"0:1","IngressQosMap":"1:0","Dscp":"46","MacPolicy":"hash",` +
+		`"StaticRoutes":"[{\"Destination\":\"10.1.0.0/16\",\"NextHop\":\"\"}]"}`
+)
+
+func TestDecodeEndpointV0(t *testing.T) {
+	ep := &endpoint{}
+	version, err := ep.decode([]byte(endpointV0))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+	assert.Equal(t, "1234567", ep.id)
+	assert.Equal(t, "1", ep.nid)
+	assert.Equal(t, "veth1234567", ep.srcName)
+	assert.Equal(t, "02:42:c0:a8:02:02", ep.mac.String())
+	assert.Equal(t, "192.168.2.2/24", ep.addr.String())
+	assert.Equal(t, "fe80::c0a8:202/120", ep.addrv6.String())
+	assert.Nil(t, ep.limits)
+	assert.Nil(t, ep.routes)
+
+	ep = &endpoint{}
+	assert.Nil(t, ep.UnmarshalJSON([]byte(endpointV0Bare)))
+	assert.Equal(t, "1234567", ep.id)
+	assert.Nil(t, ep.mac)
+	assert.Nil(t, ep.addr)
+}
+
+func TestDecodeEndpointV0Options(t *testing.T) {
+	ep := &endpoint{}
+	version, err := ep.decode([]byte(endpointV0Options))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+	assert.EqualValues(t, &bandwidthLimits{EgressRate: 1000, EgressBurst: 10, IngressRate: 2000, IngressBurst: 20}, ep.limits)
+	assert.EqualValues(t, []*staticRoute{{Destination: "10.0.0.0/8", NextHop: "192.168.2.254"}}, ep.routes)
+
+	// the upgraded record decodes to the same endpoint
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	ep1 := &endpoint{}
+	version, err = ep1.decode(b)
+	assert.Nil(t, err)
+	assert.Equal(t, storeVersion, version)
+	assert.EqualValues(t, ep, ep1)
+}
+
+func TestDecodeConfigV0(t *testing.T) {
+	c := &configuration{}
+	assert.Nil(t, c.UnmarshalJSON([]byte(configV0)))
+	assert.EqualValues(t, &configuration{
+		ID:               "1",
+		Mtu:              1500,
+		Parent:           "eth0.10",
+		MacvlanMode:      "bridge",
+		CreatedSlaveLink: true,
+		Ipv4Subnets:      []*ipv4Subnet{{SubnetIP: "192.168.2.0/24", GwIP: "192.168.2.1/24"}},
+		Ipv6Subnets:      []*ipv6Subnet{{SubnetIP: "fe80::c0a8:200/120", GwIP: "fe80::c0a8:201/120"}},
+	}, c)
+
+	c = &configuration{}
+	assert.Nil(t, c.UnmarshalJSON([]byte(configV0Options)))
+	assert.EqualValues(t, &configuration{
+		ID:            "1",
+		Parent:        "eth0",
+		MacvlanMode:   "private",
+		Internal:      true,
+		EgressQosMap:  "0:1",
+		IngressQosMap: "1:0",
+		Dscp:          "46",
+		MacPolicy:     "hash",
+		StaticRoutes:  []*staticRoute{{Destination: "10.1.0.0/16"}},
+	}, c)
+}
+
+func TestMarshalJSONVersion(t *testing.T) {
+	_, d, r, ep := initEndpointData()
+	for _, o := range []json.Marshaler{ep, d.networks[r.NetworkID].config} {
+		b, err := o.MarshalJSON()
+		assert.Nil(t, err)
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal(b, &m))
+		assert.EqualValues(t, storeVersion, m["Version"])
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, b := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"nid":"1","SrcName":"veth"}`,
+		`{"id":"1234567","SrcName":"veth"}`,
+		`{"id":1234567,"nid":"1","SrcName":"veth"}`,
+		`{"id":"1234567","nid":"1","SrcName":42}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","MacAddress":"zz"}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","Addr":"192.168.2.2"}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","Bandwidth":"{"}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","Version":"1"}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","Version":1.5}`,
+		`{"id":"1234567","nid":"1","SrcName":"veth","Version":99}`,
+	} {
+		ep := &endpoint{}
+		assert.NotNil(t, ep.UnmarshalJSON([]byte(b)), b)
+	}
+	for _, b := range []string{
+		`{"Mtu":1500}`,
+		`{"ID":"1","Mtu":"1500"}`,
+		`{"ID":"1","CreatedSubIface":"yes"}`,
+		`{"ID":"1","Ipv4Subnets":"not json"}`,
+	} {
+		c := &configuration{}
+		assert.NotNil(t, c.UnmarshalJSON([]byte(b)), b)
+	}
+}
+
+func TestPopulateEndpointsMigrateAndQuarantine(t *testing.T) {
+	dir, d := initStoreFile(t)
+	defer os.RemoveAll(dir)
+	_, d1, _, _ := initEndpointData()
+	d.networks = d1.networks
+	kv := d.store.(*MacvlanStore).store.KVStore()
+	good := datastore.Key(macvlanEndpointPrefix, "1234567")
+	bad := datastore.Key(macvlanEndpointPrefix, "bad0000")
+	assert.Nil(t, kv.Put(good, []byte(endpointV0Options), nil))
+	assert.Nil(t, kv.Put(bad, []byte(`{"id":"bad0000","nid":"1","SrcName":42}`), nil))
+
+	assert.Nil(t, d.store.PopulateEndpoints())
+	ep := d.networks["1"].endpoints["1234567"]
+	assert.NotNil(t, ep)
+	assert.Equal(t, "veth1234567", ep.srcName)
+	assert.Nil(t, d.networks["1"].endpoints["bad0000"])
+
+	// the restored record is rewritten in the current version
+	pair, err := kv.Get(good)
+	assert.Nil(t, err)
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(pair.Value, &m))
+	assert.EqualValues(t, storeVersion, m["Version"])
+
+	// the malformed record is moved aside untouched
+	_, err = kv.Get(bad)
+	assert.NotNil(t, err)
+	pair, err = kv.Get(datastore.Key(macvlanQuarantinePrefix, "endpoint", "bad0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"bad0000","nid":"1","SrcName":42}`, string(pair.Value))
+	assert.Nil(t, d.Close())
+}
+
+func TestPopulateSkipsNewerRecords(t *testing.T) {
+	dir, d := initStoreFile(t)
+	defer os.RemoveAll(dir)
+	kv := d.store.(*MacvlanStore).store.KVStore()
+	records := map[string]string{
+		datastore.Key(macvlanNetworkPrefix, "9"):        `{"Version":99,"ID":"9","Parent":"eth0","Future":true}`,
+		datastore.Key(macvlanEndpointPrefix, "7654321"): `{"Version":1,"id":"7654321","nid":"9","SrcName":"veth7654321"}`,
+		datastore.Key(macvlanEndpointPrefix, "0abcdef"): `{"Version":99,"id":"0abcdef","nid":"1","SrcName":"veth0abcdef"}`,
+	}
+	for key, value := range records {
+		assert.Nil(t, kv.Put(key, []byte(value), nil))
+	}
+
+	assert.Nil(t, d.store.PopulateNetworks())
+	assert.Nil(t, d.store.PopulateEndpoints())
+	assert.Nil(t, d.network("9"))
+
+	// a downgraded plugin leaves the records for the upgraded one
+	for key, value := range records {
+		pair, err := kv.Get(key)
+		assert.Nil(t, err, key)
+		assert.Equal(t, value, string(pair.Value))
+	}
+	_, err := kv.List(datastore.Key(macvlanQuarantinePrefix))
+	assert.NotNil(t, err)
+	assert.Nil(t, d.Close())
+}
@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 
@@ -16,8 +17,9 @@ const (
 	macvlanMajorVer  = 9     // minimum macvlan major kernel support
 )
 
-// Create the macvlan slave specifying the source name
-func createMacVlan(containerIfName, parent, macvlanMode string) (string, error) {
+// Create the macvlan or macvtap slave specifying the source name, mac address
+// and mtu, a zero mtu inherits the parent's
+func createMacVlan(containerIfName, parent, macvlanMode, linkType string, mac net.HardwareAddr, mtu int) (string, error) {
 	// Set the macvlan mode. Default is bridge mode
 	mode, err := setMacVlanMode(macvlanMode)
 	if err != nil {
@@ -33,19 +35,28 @@ func createMacVlan(containerIfName, parent, macvlanMode string) (string, error)
 		return "", fmt.Errorf("error occoured looking up the %s parent iface %s error: %s", macvlanType, parent, err)
 	}
 	// Create a macvlan link
-	macvlan := &netlink.Macvlan{
+	macvlan := netlink.Macvlan{
 		LinkAttrs: netlink.LinkAttrs{
 			Name:        containerIfName,
 			ParentIndex: parentLink.Attrs().Index,
+			MTU:         mtu,
 		},
 		Mode: mode,
 	}
-	if err := ns.NlHandle().LinkAdd(macvlan); err != nil {
+	// a passthru slave takes over the mac of the parent, don't rewrite it
+	if mode != netlink.MACVLAN_MODE_PASSTHRU {
+		macvlan.HardwareAddr = mac
+	}
+	var link netlink.Link = &macvlan
+	if linkType == linkMacvtap {
+		link = &netlink.Macvtap{Macvlan: macvlan}
+	}
+	if err := ns.NlHandle().LinkAdd(link); err != nil {
 		// If a user creates a macvlan and ipvlan on same parent, only one slave iface can be active at a time.
-		return "", fmt.Errorf("failed to create the %s port: %v", macvlanType, err)
+		return "", fmt.Errorf("failed to create the %s port: %v", link.Type(), err)
 	}
 
-	return macvlan.Attrs().Name, nil
+	return link.Attrs().Name, nil
 }
 
 // setMacVlanMode setter for one of the four macvlan port types
@@ -74,8 +85,9 @@ func parentExists(ifaceStr string) bool {
 	return true
 }
 
-// createVlanLink parses sub-interfaces and vlan id for creation
-func createVlanLink(parentName string) error {
+// createVlanLink parses sub-interfaces and vlan id for creation, the optional
+// qos maps set the 802.1p priority of the tagged frames
+func createVlanLink(parentName, egressQosMap, ingressQosMap string) error {
 	if strings.Contains(parentName, ".") {
 		parent, vidInt, err := parseVlan(parentName)
 		if err != nil {
@@ -85,6 +97,14 @@ func createVlanLink(parentName string) error {
 		if vidInt > 4094 || vidInt < 1 {
 			return fmt.Errorf("vlan id must be between 1-4094, received: %d", vidInt)
 		}
+		egressQos, err := parseEgressQosMap(egressQosMap)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", egressQosOpt, err)
+		}
+		ingressQos, err := parseIngressQosMap(ingressQosMap)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", ingressQosOpt, err)
+		}
 		// get the parent link to attach a vlan subinterface
 		parentLink, err := ns.NlHandle().LinkByName(parent)
 		if err != nil {
@@ -101,6 +121,11 @@ func createVlanLink(parentName string) error {
 		if err := ns.NlHandle().LinkAdd(vlanLink); err != nil {
 			return fmt.Errorf("failed to create %s vlan link: %v", vlanLink.Name, err)
 		}
+		// apply the 802.1p priority maps
+		if err := setVlanQosMaps(vlanLink, egressQos, ingressQos); err != nil {
+			ns.NlHandle().LinkDel(vlanLink)
+			return fmt.Errorf("failed to set the qos maps of %s vlan link: %v", vlanLink.Name, err)
+		}
 		// Bring the new netlink iface up
 		if err := ns.NlHandle().LinkSetUp(vlanLink); err != nil {
 			return fmt.Errorf("failed to enable %s the macvlan parent link %v", vlanLink.Name, err)
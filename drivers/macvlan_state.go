@@ -15,10 +15,35 @@ func (d *Driver) addNetwork(n *network) {
 	d.Unlock()
 }
 
-func (d *Driver) deleteNetwork(nid string) {
+// deleteNetwork removes the network and returns whether it was known
+func (d *Driver) deleteNetwork(nid string) bool {
 	d.Lock()
+	defer d.Unlock()
+	_, ok := d.networks[nid]
 	delete(d.networks, nid)
+
+	return ok
+}
+
+// acquire serializes the operations on a network, operations on different
+// networks run in parallel. It returns false, without holding the network,
+// when the network was deleted while waiting.
+func (d *Driver) acquire(n *network) bool {
+	n.ops.Lock()
+	d.Lock()
+	current := d.networks[n.id]
 	d.Unlock()
+	if current != n {
+		n.ops.Unlock()
+		return false
+	}
+
+	return true
+}
+
+// release ends an operation started by acquire
+func (n *network) release() {
+	n.ops.Unlock()
 }
 
 // getnetworks Safely returns a slice of existing Networks
@@ -53,6 +78,19 @@ func (n *network) deleteEndpoint(eid string) {
 	n.Unlock()
 }
 
+// getEndpoints Safely returns a slice of the endpoints of the network
+func (n *network) getEndpoints() []*endpoint {
+	n.Lock()
+	defer n.Unlock()
+
+	ls := make([]*endpoint, 0, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		ls = append(ls, ep)
+	}
+
+	return ls
+}
+
 func (n *network) getEndpoint(eid string) (*endpoint, error) {
 	n.Lock()
 	defer n.Unlock()
@@ -109,9 +147,19 @@ func (d *Driver) network(nid string) *network {
 	if !ok {
 		n = d.getNetworkFromSwarm(nid)
 		if n != nil {
+			// another request may have restored the network meanwhile
 			d.Lock()
-			d.networks[nid] = n
+			current, ok := d.networks[nid]
+			if !ok {
+				d.networks[nid] = n
+			}
 			d.Unlock()
+			if ok {
+				return current
+			}
+			if err := d.store.StoreUpdate(n.config); err != nil {
+				logrus.Warnf("Failed to store macvlan network %s restored from swarm: %v", nid, err)
+			}
 		}
 	}
 
@@ -119,12 +167,9 @@ func (d *Driver) network(nid string) *network {
 }
 
 func (d *Driver) getNetworkFromSwarm(nid string) *network {
-	if d.client == nil {
-		logrus.Errorf("Docker clinet is nil.")
-		return nil
-	}
-	nw, err := d.client.NetworkInfo(nid)
+	nw, err := d.swarmNetworkInfo(nid)
 	if err != nil {
+		logrus.Debugf("Network (%s) not found from swarm: %v", nid, err)
 		return nil
 	}
 	logrus.Infof("Network (%s)  found from swarm", nw)
@@ -133,7 +178,7 @@ func (d *Driver) getNetworkFromSwarm(nid string) *network {
 	options := make(map[string]interface{})
 	options[netlabel.GenericData] = opts
 	// parse and validate the config and bind to networkConfiguration
-	config, err := parseNetworkOptions(nid, options)
+	config, err := parseNetworkOptions(nid, options, phaseRestore)
 	if err != nil {
 		logrus.Errorf("Swarm:Network (%s)  found, but parseNetworkOptions error %v", nw, err)
 		return nil
@@ -142,6 +187,10 @@ func (d *Driver) getNetworkFromSwarm(nid string) *network {
 		logrus.Errorf("Swarm:Network (%s)  found, but processIPAMFromSwarm error %v", nw, err)
 		return nil
 	}
+	if err := config.complete(d, phaseRestore); err != nil {
+		logrus.Errorf("Swarm:Network (%s)  found, but its options are invalid: %v", nid, err)
+		return nil
+	}
 
 	n := &network{
 		id:        nid,
@@ -0,0 +1,209 @@
+package drivers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// initStressData returns a driver with count networks on eth0
+func initStressData(count int) (*MacStore, *Driver) {
+	ms := &MacStore{}
+	ms.On("StoreUpdate", mock.Anything).Return(nil)
+	ms.On("StoreDelete", mock.Anything).Return(nil)
+	d := &Driver{
+		networks: networkTable{},
+		store:    ms,
+	}
+	for i := 0; i < count; i++ {
+		nid := fmt.Sprintf("stress%02d", i)
+		d.addNetwork(&network{
+			id:        nid,
+			driver:    d,
+			endpoints: endpointTable{},
+			config: &configuration{
+				ID:          nid,
+				Parent:      "eth0",
+				MacvlanMode: modeBridge,
+				Ipv4Subnets: []*ipv4Subnet{{
+					SubnetIP: fmt.Sprintf("10.%d.0.0/24", i),
+					GwIP:     fmt.Sprintf("10.%d.0.1/24", i),
+				}},
+			},
+		})
+	}
+
+	return ms, d
+}
+
+// addStressBridge creates a bridge network on mbparent0 with the subnet
+// 10.i.0.0/24, in a vrf when the kernel supports them
+func addStressBridge(t *testing.T, d *Driver, nid string, i int) {
+	opts := map[string]string{parentOpt: "mbparent0", linkTypeOpt: linkBridge}
+	if err := createVrfLink("mvrfstress", 1002); err == nil {
+		if link, err := ns.NlHandle().LinkByName("mvrfstress"); err == nil {
+			ns.NlHandle().LinkDel(link)
+		}
+		opts[vrfOpt], opts[vrfTableOpt] = "mvrfstress", "1002"
+	}
+	assert.Nil(t, d.CreateNetwork(&pluginNet.CreateNetworkRequest{
+		NetworkID: nid,
+		Options:   map[string]interface{}{netlabel.GenericData: opts},
+		IPv4Data: []*pluginNet.IPAMData{{
+			Pool:    fmt.Sprintf("10.%d.0.0/24", i),
+			Gateway: fmt.Sprintf("10.%d.0.1/24", i),
+		}},
+	}))
+}
+
+// run with -race to check the accesses to the network and endpoint tables
+func TestConcurrentEndpointOperations(t *testing.T) {
+	const networks, endpoints, rounds = 8, 6, 3
+	_, d := initStressData(networks)
+	var nids []string
+	for i := 0; i < networks; i++ {
+		nids = append(nids, fmt.Sprintf("stress%02d", i))
+	}
+	// revalidate sets up the bridge and vrf again while their endpoints change
+	defer initBridgeParent(t)()
+	addStressBridge(t, d, "stressbr", networks)
+	nids = append(nids, "stressbr")
+	stop := make(chan struct{})
+	readers := &sync.WaitGroup{}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			d.Revalidate()
+			for _, n := range d.getnetworks() {
+				n.getEndpoints()
+			}
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i, nid := range nids {
+		for j := 0; j < endpoints; j++ {
+			wg.Add(1)
+			go func(nid, eid, addr string) {
+				defer wg.Done()
+				for k := 0; k < rounds; k++ {
+					_, err := d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+						NetworkID:  nid,
+						EndpointID: eid,
+						Interface:  &pluginNet.EndpointInterface{Address: addr},
+					})
+					assert.Nil(t, err)
+					_, err = d.Join(&pluginNet.JoinRequest{NetworkID: nid, EndpointID: eid})
+					assert.Nil(t, err)
+					assert.Nil(t, d.Leave(&pluginNet.LeaveRequest{NetworkID: nid, EndpointID: eid}))
+					assert.Nil(t, d.DeleteEndpoint(&pluginNet.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid}))
+				}
+			}(nid, fmt.Sprintf("ep%02d%02d", i, j), fmt.Sprintf("10.%d.0.%d/24", i, j+10))
+		}
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	for _, n := range d.getnetworks() {
+		assert.Empty(t, n.getEndpoints(), n.id)
+	}
+	assert.Nil(t, d.DeleteNetwork(&pluginNet.DeleteNetworkRequest{NetworkID: "stressbr"}))
+	_, err := ns.NlHandle().LinkByName("mb-stressbr")
+	assert.NotNil(t, err)
+}
+
+func TestConcurrentRevalidateDeleteNetwork(t *testing.T) {
+	defer initBridgeParent(t)()
+	_, d := initStressData(0)
+	for i := 0; i < 10; i++ {
+		addStressBridge(t, d, "stressbr", 0)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				d.Revalidate()
+			}
+		}()
+		assert.Nil(t, d.DeleteNetwork(&pluginNet.DeleteNetworkRequest{NetworkID: "stressbr"}))
+		close(stop)
+		<-done
+		// a revalidation racing the delete must not set the bridge up again
+		if link, err := ns.NlHandle().LinkByName("mb-stressbr"); err == nil {
+			ns.NlHandle().LinkDel(link)
+			t.Fatal("bridge mb-stressbr set up again after the delete of its network")
+		}
+	}
+}
+
+func TestConcurrentDeleteNetwork(t *testing.T) {
+	const networks = 8
+	_, d := initStressData(networks)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < networks; i++ {
+		nid := fmt.Sprintf("stress%02d", i)
+		wg.Add(2)
+		go func(nid, addr string) {
+			defer wg.Done()
+			// either lands before the delete and is removed with the network, or fails
+			d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+				NetworkID:  nid,
+				EndpointID: "late" + nid,
+				Interface:  &pluginNet.EndpointInterface{Address: addr},
+			})
+		}(nid, fmt.Sprintf("10.%d.0.99/24", i))
+		go func(nid string) {
+			defer wg.Done()
+			assert.Nil(t, d.DeleteNetwork(&pluginNet.DeleteNetworkRequest{NetworkID: nid}))
+		}(nid)
+	}
+	wg.Wait()
+	assert.Empty(t, d.getnetworks())
+}
+
+func TestAcquireDeletedNetwork(t *testing.T) {
+	_, d := initStressData(1)
+	n := d.getnetworks()[0]
+	assert.True(t, d.acquire(n))
+	done := make(chan bool)
+	go func() {
+		done <- d.acquire(n)
+	}()
+	d.deleteNetwork(n.id)
+	n.release()
+	assert.False(t, <-done)
+}
+
+func TestRevalidateDeletedNetwork(t *testing.T) {
+	_, d := initStressData(1)
+	n := d.getnetworks()[0]
+	n.config.Parent = "mstressgone"
+	assert.True(t, d.acquire(n))
+	done := make(chan error)
+	go func() {
+		done <- d.Revalidate()
+	}()
+	// the revalidation waits for the delete and skips the network
+	d.deleteNetwork(n.id)
+	n.release()
+	assert.Nil(t, <-done)
+	assert.EqualError(t, n.revalidate(), "parent link mstressgone not found")
+}
@@ -3,23 +3,29 @@ package drivers
 import (
 	"encoding/json"
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/libkv/store/boltdb"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libkv/store"
 	"github.com/docker/libnetwork/datastore"
 )
 
 type macStore interface {
 	InitStore(d *Driver) error
+	PopulateNetworks() error
 	PopulateEndpoints() error
 	StoreUpdate(kvObject datastore.KVObject) error
 	StoreDelete(kvObject datastore.KVObject) error
+	Close() error
 }
 
 //MacvlanStore ...
 type MacvlanStore struct {
 	store  datastore.DataStore
 	driver *Driver
+	newer  map[string]bool // networks stored by a newer plugin, their endpoints are kept
 }
 
 // networkConfiguration for this driver's network specific configuration
@@ -31,67 +37,174 @@ type configuration struct {
 	Internal         bool
 	Parent           string
 	MacvlanMode      string
+	LinkType         string
 	CreatedSlaveLink bool
+	Bridge           string // bridge of a link_type=bridge network
+	CreatedBridge    bool
+	Vrf              string // vrf of the host side links
+	VrfTable         string
+	CreatedVrf       bool
+	EgressQosMap     string
+	IngressQosMap    string
+	Dscp             string
+	MacPolicy        string
+	GatewayCheck     bool
+	Tuning           *ifaceTuning
+	StaticRoutes     []*staticRoute
 	Ipv4Subnets      []*ipv4Subnet
 	Ipv6Subnets      []*ipv6Subnet
 }
 
 type ipv4Subnet struct {
-	SubnetIP string
-	GwIP     string
+	SubnetIP     string
+	GwIP         string
+	IPRange      string            `json:",omitempty"` // known from swarm only
+	AuxAddresses map[string]string `json:",omitempty"` // addresses docker reserves by name
 }
 
 type ipv6Subnet struct {
-	SubnetIP string
-	GwIP     string
+	SubnetIP     string
+	GwIP         string
+	IPRange      string            `json:",omitempty"`
+	AuxAddresses map[string]string `json:",omitempty"`
 }
 
 // InitStore drivers are responsible for caching their own persistent state
 func (ms *MacvlanStore) InitStore(d *Driver) error {
-	// initiate the boltdb
-	boltdb.Register()
 	var err error
-	ms.store, err = datastore.NewDataStore(datastore.LocalScope, nil)
+	ms.store, err = openStore(d.opts)
 	ms.driver = d
 	if err != nil {
 		return fmt.Errorf("could not init macvlan local store. Error: %s", err)
 	}
+	if err = ms.PopulateNetworks(); err != nil {
+		logrus.Errorf("Failure during macvlan networks populate: %v", err)
+	}
 	if err = ms.PopulateEndpoints(); err != nil {
 		logrus.Errorf("Failure during macvlan endpoints populate: %v", err)
 	}
 	return nil
 }
 
-// PopulateEndpoints ...
+// PopulateNetworks restores the stored network configurations, recreating
+// the slave links the driver owns. Malformed records are quarantined, the
+// ones of a newer plugin are skipped.
+func (ms *MacvlanStore) PopulateNetworks() error {
+	kvs, err := ms.store.KVStore().List(datastore.Key(macvlanNetworkPrefix))
+	if err != nil && err != store.ErrKeyNotFound {
+		return fmt.Errorf("failed to get macvlan networks from store: %v", err)
+	}
+
+	if err == store.ErrKeyNotFound {
+		logrus.Infof("There is no networks in the localStore for key (%s).", macvlanNetworkPrefix)
+		return nil
+	}
+
+	for _, kv := range kvs {
+		config := &configuration{}
+		if err := config.UnmarshalJSON(kv.Value); err != nil {
+			if ms.skipNewer(kv, err) {
+				if ms.newer == nil {
+					ms.newer = make(map[string]bool)
+				}
+				ms.newer[path.Base(kv.Key)] = true
+				continue
+			}
+			ms.quarantine(kv, err)
+			continue
+		}
+		config.SetIndex(kv.LastIndex)
+		if _, err := ms.driver.getNetwork(config.ID); err == nil {
+			continue
+		}
+		if err := ms.driver.createNetwork(config); err != nil {
+			logrus.Errorf("Failed to restore macvlan network (%s): %v", stringid.TruncateID(config.ID), err)
+			continue
+		}
+		logrus.Infof("Network (%s) restored on parent %s", stringid.TruncateID(config.ID), config.Parent)
+	}
+
+	return nil
+}
+
+// PopulateEndpoints restores the stored endpoints to their networks. Records
+// of an older version are rewritten in the current one, malformed records are
+// moved under the quarantine prefix rather than failing the restore and the
+// ones of a newer plugin are skipped.
 func (ms *MacvlanStore) PopulateEndpoints() error {
-	kvol, err := ms.store.List(datastore.Key(macvlanEndpointPrefix), &endpoint{})
-	if err != nil && err != datastore.ErrKeyNotFound {
+	kvs, err := ms.store.KVStore().List(datastore.Key(macvlanEndpointPrefix))
+	if err != nil && err != store.ErrKeyNotFound {
 		return fmt.Errorf("failed to get macvlan endpoints from store: %v", err)
 	}
 
-	if err == datastore.ErrKeyNotFound {
+	if err == store.ErrKeyNotFound {
 		logrus.Infof("There is no endpoints in the localStore for key (%s).", macvlanEndpointPrefix)
 		return nil
 	}
 
-	for _, kvo := range kvol {
-		ep := kvo.(*endpoint)
+	for _, kv := range kvs {
+		ep := &endpoint{}
+		version, err := ep.decode(kv.Value)
+		if err != nil {
+			if !ms.skipNewer(kv, err) {
+				ms.quarantine(kv, err)
+			}
+			continue
+		}
+		ep.SetIndex(kv.LastIndex)
 		n := ms.driver.network(ep.nid)
+		if n == nil && ms.newer[ep.nid] {
+			logrus.Warnf("Skipping macvlan endpoint (%s) of network (%s) stored by a newer plugin", stringid.TruncateID(ep.id), stringid.TruncateID(ep.nid))
+			continue
+		}
 		if n == nil {
-			logrus.Infof("Network (%s) not found for restored macvlan endpoint (%s)", ep.nid[0:7], ep.id[0:7])
-			logrus.Infof("Deleting stale macvlan endpoint (%s) from store", ep.id[0:7])
+			logrus.Infof("Network (%s) not found for restored macvlan endpoint (%s)", stringid.TruncateID(ep.nid), stringid.TruncateID(ep.id))
+			logrus.Infof("Deleting stale macvlan endpoint (%s) from store", stringid.TruncateID(ep.id))
 			if err := ms.StoreDelete(ep); err != nil {
-				logrus.Infof("Failed to delete stale macvlan endpoint (%s) from store", ep.id[0:7])
+				logrus.Infof("Failed to delete stale macvlan endpoint (%s) from store", stringid.TruncateID(ep.id))
 			}
 			continue
 		}
-		n.endpoints[ep.id] = ep
-		logrus.Infof("Endpoint (%s) restored to network (%s)", ep.id[0:7], ep.nid[0:7])
+		if version < storeVersion {
+			if err := ms.StoreUpdate(ep); err != nil {
+				logrus.Warnf("Failed to upgrade macvlan endpoint (%s) from version %d: %v", stringid.TruncateID(ep.id), version, err)
+			} else {
+				logrus.Infof("Upgraded macvlan endpoint (%s) from version %d to %d", stringid.TruncateID(ep.id), version, storeVersion)
+			}
+		}
+		n.addEndpoint(ep)
+		logrus.Infof("Endpoint (%s) restored to network (%s)", stringid.TruncateID(ep.id), stringid.TruncateID(ep.nid))
 	}
 
 	return nil
 }
 
+// skipNewer logs a record written by a newer plugin and leaves it in place,
+// a downgraded plugin must not lose it
+func (ms *MacvlanStore) skipNewer(kv *store.KVPair, err error) bool {
+	if _, ok := err.(*newerRecordError); !ok {
+		return false
+	}
+	logrus.Warnf("Skipping macvlan record %s: %v", kv.Key, err)
+
+	return true
+}
+
+// quarantine moves a record that can't be decoded out of the networks or
+// endpoints so it is kept for inspection without being restored again
+func (ms *MacvlanStore) quarantine(kv *store.KVPair, cause error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(kv.Key, datastore.Key(macvlanPrefix)), "/")
+	key := datastore.Key(macvlanQuarantinePrefix, name)
+	logrus.Errorf("Quarantining malformed macvlan record %s to %s: %v", kv.Key, key, cause)
+	if err := ms.store.KVStore().Put(key, kv.Value, nil); err != nil {
+		logrus.Errorf("Failed to quarantine macvlan record %s: %v", kv.Key, err)
+		return
+	}
+	if err := ms.store.KVStore().Delete(kv.Key); err != nil {
+		logrus.Errorf("Failed to delete quarantined macvlan record %s: %v", kv.Key, err)
+	}
+}
+
 // StoreUpdate used to update persistent macvlan network records as they are created
 func (ms *MacvlanStore) StoreUpdate(kvObject datastore.KVObject) error {
 	if ms.store == nil {
@@ -125,57 +238,127 @@ retry:
 	return nil
 }
 
-func (config *configuration) MarshalJSON() ([]byte, error) {
-	nMap := make(map[string]interface{})
-	nMap["ID"] = config.ID
-	nMap["Mtu"] = config.Mtu
-	nMap["Parent"] = config.Parent
-	nMap["MacvlanMode"] = config.MacvlanMode
-	nMap["Internal"] = config.Internal
-	nMap["CreatedSubIface"] = config.CreatedSlaveLink
-	if len(config.Ipv4Subnets) > 0 {
-		iis, err := json.Marshal(config.Ipv4Subnets)
-		if err != nil {
-			return nil, err
-		}
-		nMap["Ipv4Subnets"] = string(iis)
-	}
-	if len(config.Ipv6Subnets) > 0 {
-		iis, err := json.Marshal(config.Ipv6Subnets)
-		if err != nil {
-			return nil, err
-		}
-		nMap["Ipv6Subnets"] = string(iis)
+// Close closes the local store, releasing the boltdb file lock
+func (ms *MacvlanStore) Close() error {
+	if ms.store == nil {
+		return nil
 	}
+	ms.store.Close()
+	ms.store = nil
 
-	return json.Marshal(nMap)
+	return nil
 }
 
-func (config *configuration) UnmarshalJSON(b []byte) error {
-	var (
-		err  error
-		nMap map[string]interface{}
-	)
+func (config *configuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&configurationRecord{
+		Version:          storeVersion,
+		ID:               config.ID,
+		Mtu:              config.Mtu,
+		Parent:           config.Parent,
+		MacvlanMode:      config.MacvlanMode,
+		LinkType:         config.LinkType,
+		Internal:         config.Internal,
+		CreatedSlaveLink: config.CreatedSlaveLink,
+		Bridge:           config.Bridge,
+		CreatedBridge:    config.CreatedBridge,
+		Vrf:              config.Vrf,
+		VrfTable:         config.VrfTable,
+		CreatedVrf:       config.CreatedVrf,
+		EgressQosMap:     config.EgressQosMap,
+		IngressQosMap:    config.IngressQosMap,
+		Dscp:             config.Dscp,
+		MacPolicy:        config.MacPolicy,
+		GatewayCheck:     config.GatewayCheck,
+		Tuning:           config.Tuning,
+		StaticRoutes:     config.StaticRoutes,
+		Ipv4Subnets:      config.Ipv4Subnets,
+		Ipv6Subnets:      config.Ipv6Subnets,
+	})
+}
 
-	if err = json.Unmarshal(b, &nMap); err != nil {
-		return err
-	}
-	config.ID = nMap["ID"].(string)
-	config.Mtu = int(nMap["Mtu"].(float64))
-	config.Parent = nMap["Parent"].(string)
-	config.MacvlanMode = nMap["MacvlanMode"].(string)
-	config.Internal = nMap["Internal"].(bool)
-	config.CreatedSlaveLink = nMap["CreatedSubIface"].(bool)
-	if v, ok := nMap["Ipv4Subnets"]; ok {
-		if err := json.Unmarshal([]byte(v.(string)), &config.Ipv4Subnets); err != nil {
+func (config *configuration) UnmarshalJSON(b []byte) error {
+	var r configurationRecord
+	if _, err := decodeRecord(b, configMigrations, &r); err != nil {
+		if _, ok := err.(*newerRecordError); ok {
 			return err
 		}
+		return fmt.Errorf("failed to unmarshal to macvlan network configuration: %v", err)
 	}
-	if v, ok := nMap["Ipv6Subnets"]; ok {
-		if err := json.Unmarshal([]byte(v.(string)), &config.Ipv6Subnets); err != nil {
-			return err
-		}
+	if r.ID == "" {
+		return fmt.Errorf("macvlan network configuration has no id")
+	}
+	config.ID = r.ID
+	config.Mtu = r.Mtu
+	config.Parent = r.Parent
+	config.MacvlanMode = r.MacvlanMode
+	config.LinkType = r.LinkType
+	config.Internal = r.Internal
+	config.CreatedSlaveLink = r.CreatedSlaveLink
+	config.Bridge = r.Bridge
+	config.CreatedBridge = r.CreatedBridge
+	config.Vrf = r.Vrf
+	config.VrfTable = r.VrfTable
+	config.CreatedVrf = r.CreatedVrf
+	config.EgressQosMap = r.EgressQosMap
+	config.IngressQosMap = r.IngressQosMap
+	config.Dscp = r.Dscp
+	config.MacPolicy = r.MacPolicy
+	config.GatewayCheck = r.GatewayCheck
+	config.Tuning = r.Tuning
+	config.StaticRoutes = r.StaticRoutes
+	config.Ipv4Subnets = r.Ipv4Subnets
+	config.Ipv6Subnets = r.Ipv6Subnets
+
+	return nil
+}
+
+func (config *configuration) Key() []string {
+	return []string{macvlanNetworkPrefix, config.ID}
+}
+
+func (config *configuration) KeyPrefix() []string {
+	return []string{macvlanNetworkPrefix}
+}
+
+func (config *configuration) Value() []byte {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil
 	}
+	return b
+}
 
+func (config *configuration) SetValue(value []byte) error {
+	return json.Unmarshal(value, config)
+}
+
+func (config *configuration) Index() uint64 {
+	return config.dbIndex
+}
+
+func (config *configuration) SetIndex(index uint64) {
+	config.dbIndex = index
+	config.dbExists = true
+}
+
+func (config *configuration) Exists() bool {
+	return config.dbExists
+}
+
+func (config *configuration) Skip() bool {
+	return false
+}
+
+func (config *configuration) New() datastore.KVObject {
+	return &configuration{}
+}
+
+func (config *configuration) CopyTo(o datastore.KVObject) error {
+	dstNcfg := o.(*configuration)
+	*dstNcfg = *config
 	return nil
 }
+
+func (config *configuration) DataScope() string {
+	return datastore.LocalScope
+}
@@ -0,0 +1,592 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/libkv/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSharedBackend stores a network and an endpoint through the backend,
+// restores them in a second driver and deletes the endpoint
+func testSharedBackend(t *testing.T, opts Options) {
+	d := NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	_, d1, r, ep := initEndpointData()
+	assert.Nil(t, d.store.StoreUpdate(d1.networks[r.NetworkID].config))
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	assert.Nil(t, d.Close())
+
+	d = NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	if assert.NotNil(t, d.networks["1"]) {
+		restored := d.networks["1"].endpoints["1234567"]
+		if assert.NotNil(t, restored) {
+			assert.Nil(t, d.store.StoreDelete(restored))
+		}
+	}
+	assert.Nil(t, d.Close())
+
+	ns, err := ReadStoreState(opts)
+	assert.Nil(t, err)
+	if assert.Len(t, ns, 1) {
+		assert.Empty(t, ns[0].Endpoints)
+	}
+	assert.Equal(t, pass(opts.StoreBackend+" store", "reachable"), checkStore(opts))
+}
+
+func TestConsulBackend(t *testing.T) {
+	srv := httptest.NewServer(&consulStandIn{kv: newTestMemoryStore("TestConsulBackend")})
+	defer srv.Close()
+	testSharedBackend(t, Options{StoreBackend: storeConsul, StoreAddress: strings.TrimPrefix(srv.URL, "http://")})
+}
+
+func TestEtcdBackend(t *testing.T) {
+	srv := httptest.NewServer(&etcdStandIn{kv: newTestMemoryStore("TestEtcdBackend")})
+	defer srv.Close()
+	testSharedBackend(t, Options{StoreBackend: storeEtcd, StoreAddress: strings.TrimPrefix(srv.URL, "http://")})
+}
+
+func TestZookeeperBackend(t *testing.T) {
+	zk, err := newZkStandIn()
+	assert.Nil(t, err)
+	defer zk.Close()
+	testSharedBackend(t, Options{StoreBackend: storeZK, StoreAddress: zk.Addr().String()})
+}
+
+func TestSharedBackendDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	for _, backend := range []string{storeConsul, storeEtcd} {
+		_, err := openStore(Options{StoreBackend: backend, StoreAddress: addr})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("could not open the %s store %s", backend, addr))
+		}
+	}
+}
+
+func newTestMemoryStore(name string) *memoryStore {
+	s, _ := newMemoryStore([]string{name}, nil)
+	return s.(*memoryStore)
+}
+
+// lastIndex returns the index of the last write of the memory store
+func (ms *memoryStore) lastIndex() uint64 {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.index
+}
+
+// consulStandIn serves the consul kv api libkv uses from a memory store
+type consulStandIn struct {
+	kv *memoryStore
+}
+
+type consulPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+func (c *consulStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.kv.lastIndex(), 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+
+	var ok bool
+	switch r.Method {
+	case "GET":
+		var kvs []*store.KVPair
+		var err error
+		if _, recurse := q["recurse"]; recurse {
+			kvs, err = c.kv.List(key)
+		} else {
+			var kv *store.KVPair
+			kv, err = c.kv.Get(key)
+			kvs = []*store.KVPair{kv}
+		}
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		pairs := make([]consulPair, 0, len(kvs))
+		for _, kv := range kvs {
+			pairs = append(pairs, consulPair{Key: kv.Key, Value: kv.Value, CreateIndex: kv.LastIndex, ModifyIndex: kv.LastIndex})
+		}
+		json.NewEncoder(w).Encode(pairs)
+		return
+	case "PUT":
+		value, _ := ioutil.ReadAll(r.Body)
+		if cas := q.Get("cas"); cas != "" {
+			index, _ := strconv.ParseUint(cas, 10, 64)
+			var previous *store.KVPair
+			if index != 0 {
+				previous = &store.KVPair{Key: key, LastIndex: index}
+			}
+			ok, _, _ = c.kv.AtomicPut(key, value, previous, nil)
+		} else {
+			ok = c.kv.Put(key, value, nil) == nil
+		}
+	case "DELETE":
+		if _, recurse := q["recurse"]; recurse {
+			ok = c.kv.DeleteTree(key) == nil
+		} else if cas := q.Get("cas"); cas != "" {
+			index, _ := strconv.ParseUint(cas, 10, 64)
+			ok, _ = c.kv.AtomicDelete(key, &store.KVPair{Key: key, LastIndex: index})
+		} else {
+			ok = c.kv.Delete(key) == nil
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(ok)
+}
+
+// etcdStandIn serves the etcd v2 keys api libkv uses from a memory store,
+// the directories are the key prefixes of the stored keys
+type etcdStandIn struct {
+	kv *memoryStore
+}
+
+type etcdNode struct {
+	Key           string      `json:"key"`
+	Value         string      `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Nodes         []*etcdNode `json:"nodes,omitempty"`
+	CreatedIndex  uint64      `json:"createdIndex"`
+	ModifiedIndex uint64      `json:"modifiedIndex"`
+}
+
+// etcd v2 error codes
+const (
+	etcdKeyNotFound = 100
+	etcdTestFailed  = 101
+	etcdNodeExist   = 105
+)
+
+func (e *etcdStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/keys/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/keys"), "/")
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	var err error
+	action := strings.ToLower(r.Method)
+	switch r.Method {
+	case "GET":
+		node := e.node(key)
+		if node == nil {
+			e.fail(w, etcdKeyNotFound, key)
+			return
+		}
+		e.reply(w, http.StatusOK, action, node)
+		return
+	case "PUT":
+		var previous *store.KVPair
+		if index := r.Form.Get("prevIndex"); index != "" {
+			previous = &store.KVPair{Key: key}
+			previous.LastIndex, _ = strconv.ParseUint(index, 10, 64)
+		}
+		value := []byte(r.Form.Get("value"))
+		switch {
+		case r.Form.Get("prevValue") != "" && !e.sameValue(key, r.Form.Get("prevValue")):
+			err = store.ErrKeyModified
+		case previous != nil:
+			_, _, err = e.kv.AtomicPut(key, value, previous, nil)
+		case r.Form.Get("prevExist") == "false":
+			_, _, err = e.kv.AtomicPut(key, value, nil, nil)
+		default:
+			err = e.kv.Put(key, value, nil)
+		}
+	case "DELETE":
+		if r.Form.Get("prevValue") != "" && !e.sameValue(key, r.Form.Get("prevValue")) {
+			err = store.ErrKeyModified
+			break
+		}
+		index := r.Form.Get("prevIndex")
+		if index == "" {
+			if ok, _ := e.kv.Exists(key); !ok {
+				err = store.ErrKeyNotFound
+				break
+			}
+			err = e.kv.Delete(key)
+			break
+		}
+		previous := &store.KVPair{Key: key}
+		previous.LastIndex, _ = strconv.ParseUint(index, 10, 64)
+		_, err = e.kv.AtomicDelete(key, previous)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case nil:
+	case store.ErrKeyNotFound:
+		e.fail(w, etcdKeyNotFound, key)
+		return
+	case store.ErrKeyModified:
+		e.fail(w, etcdTestFailed, key)
+		return
+	case store.ErrKeyExists:
+		e.fail(w, etcdNodeExist, key)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	node := &etcdNode{Key: "/" + key, ModifiedIndex: e.kv.lastIndex(), CreatedIndex: e.kv.lastIndex()}
+	if kv, err := e.kv.Get(key); err == nil {
+		node = e.leaf(kv)
+	}
+	e.reply(w, http.StatusOK, action, node)
+}
+
+func (e *etcdStandIn) sameValue(key, value string) bool {
+	kv, err := e.kv.Get(key)
+	return err == nil && string(kv.Value) == value
+}
+
+func (e *etcdStandIn) leaf(kv *store.KVPair) *etcdNode {
+	return &etcdNode{Key: "/" + kv.Key, Value: string(kv.Value), CreatedIndex: kv.LastIndex, ModifiedIndex: kv.LastIndex}
+}
+
+// node returns the key, or the directory of the keys under it with its
+// direct children
+func (e *etcdStandIn) node(key string) *etcdNode {
+	if kv, err := e.kv.Get(key); err == nil {
+		return e.leaf(kv)
+	}
+	dir := key + "/"
+	if key == "" {
+		dir = ""
+	}
+	kvs, err := e.kv.List(dir)
+	if err != nil {
+		if key != "" {
+			return nil
+		}
+		kvs = nil
+	}
+	node := &etcdNode{Key: "/" + key, Dir: true}
+	seen := make(map[string]bool)
+	for _, kv := range kvs {
+		name := strings.SplitN(strings.TrimPrefix(kv.Key, dir), "/", 2)[0]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if kv.Key == dir+name {
+			node.Nodes = append(node.Nodes, e.leaf(kv))
+		} else {
+			node.Nodes = append(node.Nodes, &etcdNode{Key: "/" + dir + name, Dir: true})
+		}
+	}
+
+	return node
+}
+
+func (e *etcdStandIn) reply(w http.ResponseWriter, code int, action string, node *etcdNode) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(e.kv.lastIndex(), 10))
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"action": action, "node": node})
+}
+
+func (e *etcdStandIn) fail(w http.ResponseWriter, code int, key string) {
+	status := http.StatusPreconditionFailed
+	if code == etcdKeyNotFound {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(e.kv.lastIndex(), 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errorCode": code, "message": http.StatusText(status), "cause": "/" + key, "index": e.kv.lastIndex(),
+	})
+}
+
+// zkStandIn serves the zookeeper requests libkv sends, the znodes are kept
+// in memory with their data version
+type zkStandIn struct {
+	net.Listener
+	zxid  int64
+	nodes map[string]*zkNode
+	sync.Mutex
+}
+
+type zkNode struct {
+	data     []byte
+	version  int32
+	czxid    int64
+	mzxid    int64
+	children map[string]bool
+}
+
+// zookeeper opcodes and error codes
+const (
+	zkOpCreate       = 1
+	zkOpDelete       = 2
+	zkOpExists       = 3
+	zkOpGetData      = 4
+	zkOpSetData      = 5
+	zkOpPing         = 11
+	zkOpGetChildren2 = 12
+	zkOpClose        = -11
+
+	zkErrNoNode        = -101
+	zkErrBadVersion    = -103
+	zkErrNodeExists    = -110
+	zkErrNotEmpty      = -111
+	zkErrUnimplemented = -6
+)
+
+func newZkStandIn() (*zkStandIn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	zk := &zkStandIn{Listener: l, nodes: map[string]*zkNode{"/": {children: map[string]bool{}}}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go zk.serve(conn)
+		}
+	}()
+
+	return zk, nil
+}
+
+// zkReader decodes the jute encoding of the requests
+type zkReader struct {
+	b   []byte
+	err error
+}
+
+func (r *zkReader) int32() int32 {
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.b))
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *zkReader) int64() int64 {
+	return int64(r.int32())<<32 | int64(uint32(r.int32()))
+}
+
+func (r *zkReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 || r.err != nil {
+		return nil
+	}
+	if int(n) > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *zkReader) string() string {
+	return string(r.bytes())
+}
+
+// zkWriter encodes the jute encoding of the responses
+type zkWriter struct {
+	bytes.Buffer
+}
+
+func (w *zkWriter) int32(v int32) { binary.Write(w, binary.BigEndian, v) }
+func (w *zkWriter) int64(v int64) { binary.Write(w, binary.BigEndian, v) }
+func (w *zkWriter) bytes(v []byte) {
+	w.int32(int32(len(v)))
+	w.Write(v)
+}
+
+func (w *zkWriter) stat(n *zkNode) {
+	for _, v := range []int64{n.czxid, n.mzxid, 0, 0} {
+		w.int64(v)
+	}
+	for _, v := range []int32{n.version, 0, 0} {
+		w.int32(v)
+	}
+	w.int64(0)
+	w.int32(int32(len(n.data)))
+	w.int32(int32(len(n.children)))
+	w.int64(n.mzxid)
+}
+
+func readZkPacket(conn net.Conn) ([]byte, error) {
+	var n int32
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(conn, b)
+	return b, err
+}
+
+func writeZkPacket(conn net.Conn, w *zkWriter) error {
+	b := make([]byte, 4, 4+w.Len())
+	binary.BigEndian.PutUint32(b, uint32(w.Len()))
+	_, err := conn.Write(append(b, w.Bytes()...))
+	return err
+}
+
+// serve answers the connect request, then the requests of the session
+func (zk *zkStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	b, err := readZkPacket(conn)
+	if err != nil {
+		return
+	}
+	req := &zkReader{b: b}
+	req.int32()
+	req.int64()
+	timeout := req.int32()
+	resp := &zkWriter{}
+	resp.int32(0)
+	resp.int32(timeout)
+	resp.int64(1)
+	resp.bytes(make([]byte, 16))
+	if writeZkPacket(conn, resp) != nil {
+		return
+	}
+	for {
+		b, err := readZkPacket(conn)
+		if err != nil {
+			return
+		}
+		req := &zkReader{b: b}
+		xid, op := req.int32(), req.int32()
+		body := &zkWriter{}
+		code := zk.handle(op, req, body)
+		resp := &zkWriter{}
+		resp.int32(xid)
+		resp.int64(zk.zxid)
+		resp.int32(code)
+		if code == 0 {
+			resp.Write(body.Bytes())
+		}
+		if writeZkPacket(conn, resp) != nil || op == zkOpClose {
+			return
+		}
+	}
+}
+
+func zkParent(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/", path[1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+// handle applies a request to the znodes and encodes its response body
+func (zk *zkStandIn) handle(op int32, req *zkReader, resp *zkWriter) int32 {
+	zk.Lock()
+	defer zk.Unlock()
+	switch op {
+	case zkOpPing, zkOpClose:
+		return 0
+	case zkOpCreate:
+		path, data := req.string(), req.bytes()
+		parentPath, name := zkParent(path)
+		parent, ok := zk.nodes[parentPath]
+		if !ok {
+			return zkErrNoNode
+		}
+		if _, ok := zk.nodes[path]; ok {
+			return zkErrNodeExists
+		}
+		zk.zxid++
+		zk.nodes[path] = &zkNode{data: append([]byte(nil), data...), czxid: zk.zxid, mzxid: zk.zxid, children: map[string]bool{}}
+		parent.children[name] = true
+		resp.bytes([]byte(path))
+	case zkOpDelete:
+		path, version := req.string(), req.int32()
+		n, ok := zk.nodes[path]
+		if !ok {
+			return zkErrNoNode
+		}
+		if version != -1 && version != n.version {
+			return zkErrBadVersion
+		}
+		if len(n.children) > 0 {
+			return zkErrNotEmpty
+		}
+		zk.zxid++
+		parentPath, name := zkParent(path)
+		delete(zk.nodes[parentPath].children, name)
+		delete(zk.nodes, path)
+	case zkOpExists, zkOpGetData, zkOpGetChildren2:
+		n, ok := zk.nodes[req.string()]
+		if !ok {
+			return zkErrNoNode
+		}
+		switch op {
+		case zkOpGetData:
+			resp.bytes(n.data)
+		case zkOpGetChildren2:
+			var names []string
+			for name := range n.children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			resp.int32(int32(len(names)))
+			for _, name := range names {
+				resp.bytes([]byte(name))
+			}
+		}
+		resp.stat(n)
+	case zkOpSetData:
+		path, data, version := req.string(), req.bytes(), req.int32()
+		n, ok := zk.nodes[path]
+		if !ok {
+			return zkErrNoNode
+		}
+		if version != -1 && version != n.version {
+			return zkErrBadVersion
+		}
+		zk.zxid++
+		n.data = append([]byte(nil), data...)
+		n.version++
+		n.mzxid = zk.zxid
+		resp.stat(n)
+	default:
+		return zkErrUnimplemented
+	}
+
+	return 0
+}
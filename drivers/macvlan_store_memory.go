@@ -0,0 +1,171 @@
+package drivers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+)
+
+// memoryStore is a libkv store kept in memory. Stores are shared by address
+// for the life of the process so a driver reopening one finds its records,
+// which makes it usable in tests and as a local stand-in for a kv store.
+type memoryStore struct {
+	index uint64
+	kvs   map[string]*store.KVPair
+	sync.Mutex
+}
+
+var memoryStores = struct {
+	stores map[string]*memoryStore
+	sync.Mutex
+}{stores: make(map[string]*memoryStore)}
+
+func init() {
+	libkv.AddStore(store.Backend(storeMemory), newMemoryStore)
+}
+
+// newMemoryStore returns the memory store of the addresses
+func newMemoryStore(addrs []string, options *store.Config) (store.Store, error) {
+	addr := strings.Join(addrs, ",")
+	memoryStores.Lock()
+	defer memoryStores.Unlock()
+	ms, ok := memoryStores.stores[addr]
+	if !ok {
+		ms = &memoryStore{kvs: make(map[string]*store.KVPair)}
+		memoryStores.stores[addr] = ms
+	}
+
+	return ms, nil
+}
+
+func copyPair(kv *store.KVPair) *store.KVPair {
+	return &store.KVPair{Key: kv.Key, Value: append([]byte(nil), kv.Value...), LastIndex: kv.LastIndex}
+}
+
+// put stores the value with a new index, the lock must be held
+func (ms *memoryStore) put(key string, value []byte) *store.KVPair {
+	ms.index++
+	kv := &store.KVPair{Key: key, Value: append([]byte(nil), value...), LastIndex: ms.index}
+	ms.kvs[key] = kv
+	return copyPair(kv)
+}
+
+func (ms *memoryStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.put(key, value)
+	return nil
+}
+
+func (ms *memoryStore) Get(key string) (*store.KVPair, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	kv, ok := ms.kvs[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return copyPair(kv), nil
+}
+
+func (ms *memoryStore) Delete(key string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.kvs, key)
+	return nil
+}
+
+func (ms *memoryStore) Exists(key string) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	_, ok := ms.kvs[key]
+	return ok, nil
+}
+
+func (ms *memoryStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (ms *memoryStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (ms *memoryStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// List returns the pairs under the directory sorted by key
+func (ms *memoryStore) List(directory string) ([]*store.KVPair, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	var keys []string
+	for k := range ms.kvs {
+		if strings.HasPrefix(k, directory) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	sort.Strings(keys)
+	kvs := make([]*store.KVPair, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, copyPair(ms.kvs[k]))
+	}
+	return kvs, nil
+}
+
+func (ms *memoryStore) DeleteTree(directory string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	for k := range ms.kvs {
+		if strings.HasPrefix(k, directory) {
+			delete(ms.kvs, k)
+		}
+	}
+	return nil
+}
+
+// AtomicPut creates the key when previous is nil, else updates it when its
+// index still is the one of previous
+func (ms *memoryStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	kv, ok := ms.kvs[key]
+	if previous == nil {
+		if ok {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if !ok {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if kv.LastIndex != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+	return true, ms.put(key, value), nil
+}
+
+// AtomicDelete deletes the key when its index still is the one of previous
+func (ms *memoryStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	kv, ok := ms.kvs[key]
+	if !ok {
+		return false, store.ErrKeyNotFound
+	}
+	if kv.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	delete(ms.kvs, key)
+	return true, nil
+}
+
+// Close keeps the records, the store lives as long as the process
+func (ms *memoryStore) Close() {}
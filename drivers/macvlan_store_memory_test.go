@@ -0,0 +1,67 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/docker/libkv/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s, err := newMemoryStore([]string{"TestMemoryStore"}, nil)
+	assert.Nil(t, err)
+	_, err = s.List("a/")
+	assert.Equal(t, store.ErrKeyNotFound, err)
+
+	ok, kv, err := s.AtomicPut("a/1", []byte("1"), nil, nil)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, _, err = s.AtomicPut("a/1", []byte("1"), nil, nil)
+	assert.Equal(t, store.ErrKeyExists, err)
+	ok, kv1, err := s.AtomicPut("a/1", []byte("2"), kv, nil)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, _, err = s.AtomicPut("a/1", []byte("3"), kv, nil)
+	assert.Equal(t, store.ErrKeyModified, err)
+	assert.Nil(t, s.Put("a/0", []byte("0"), nil))
+	assert.Nil(t, s.Put("b/0", []byte("0"), nil))
+
+	kvs, err := s.List("a/")
+	assert.Nil(t, err)
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "a/0", kvs[0].Key)
+	assert.Equal(t, "2", string(kvs[1].Value))
+
+	_, err = s.AtomicDelete("a/1", kv)
+	assert.Equal(t, store.ErrKeyModified, err)
+	ok, err = s.AtomicDelete("a/1", kv1)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Nil(t, s.DeleteTree("a/"))
+	exists, _ := s.Exists("a/0")
+	assert.False(t, exists)
+
+	// reopening the address finds the records
+	s.Close()
+	s, _ = newMemoryStore([]string{"TestMemoryStore"}, nil)
+	exists, _ = s.Exists("b/0")
+	assert.True(t, exists)
+}
+
+func TestMemoryBackend(t *testing.T) {
+	opts := Options{StoreBackend: storeMemory, StoreAddress: "TestMemoryBackend"}
+	d := NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	_, d1, r, ep := initEndpointData()
+	assert.Nil(t, d.store.StoreUpdate(d1.networks[r.NetworkID].config))
+	assert.Nil(t, d.store.StoreUpdate(ep))
+	assert.Nil(t, d.Close())
+
+	d = NewDriver(opts)
+	assert.Nil(t, d.store.InitStore(d))
+	assert.NotNil(t, d.networks["1"].endpoints["1234567"])
+	ns, err := ReadStoreState(opts)
+	assert.Nil(t, err)
+	assert.Len(t, ns, 1)
+	assert.Nil(t, d.Close())
+}
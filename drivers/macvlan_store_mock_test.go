@@ -10,6 +10,20 @@ type MacStore struct {
 	mock.Mock
 }
 
+// Close provides a mock function with given fields:
+func (_m *MacStore) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // InitStore provides a mock function with given fields: d
 func (_m *MacStore) InitStore(d *Driver) error {
 	ret := _m.Called(d)
@@ -24,6 +38,20 @@ func (_m *MacStore) InitStore(d *Driver) error {
 	return r0
 }
 
+// PopulateNetworks provides a mock function with given fields:
+func (_m *MacStore) PopulateNetworks() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // PopulateEndpoints provides a mock function with given fields:
 func (_m *MacStore) PopulateEndpoints() error {
 	ret := _m.Called()
@@ -0,0 +1,255 @@
+package drivers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/homedir"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	swarmTimeout       = 10 * time.Second // timeout of a single request to a manager
+	swarmRetryInterval = 15 * time.Second // delay between reconnections in degraded mode
+)
+
+// swarmConn holds a client per swarm manager, requests go to the active
+// manager and fail over to the next one when it is unreachable
+type swarmConn struct {
+	endpoints []string
+	clients   []*docker.Client
+	active    int
+	sync.Mutex
+}
+
+// swarmEndpoints returns the managers to connect to: the configured host,
+// else $SWARM_HOST, else $DOCKER_HOST, else the default. Any of them may be
+// a comma separated list of tcp:// or unix:// endpoints.
+func swarmEndpoints(host string) []string {
+	for _, h := range []string{host, os.Getenv("SWARM_HOST"), os.Getenv("DOCKER_HOST")} {
+		var endpoints []string
+		for _, e := range strings.Split(h, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				endpoints = append(endpoints, e)
+			}
+		}
+		if len(endpoints) > 0 {
+			return endpoints
+		}
+	}
+
+	return []string{swarmHost}
+}
+
+// swarmTLS returns the CA, certificate and key used to reach the managers.
+// Without configured certificates the docker client environment applies:
+// DOCKER_TLS_VERIFY enables TLS with the ca.pem, cert.pem and key.pem of
+// DOCKER_CERT_PATH, ~/.docker by default.
+func swarmTLS(caCert, cert, key string) (string, string, string, error) {
+	if cert != "" || os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		return caCert, cert, key, nil
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		home := homedir.Get()
+		if home == "" {
+			return "", "", "", fmt.Errorf("DOCKER_TLS_VERIFY is set but neither DOCKER_CERT_PATH nor HOME are")
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+
+	return filepath.Join(certPath, "ca.pem"), filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"), nil
+}
+
+// newSwarmConn creates the clients of the managers
+func newSwarmConn(host, caCert, cert, key string) (*swarmConn, error) {
+	caCert, cert, key, err := swarmTLS(caCert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	sc := &swarmConn{endpoints: swarmEndpoints(host)}
+	for _, endpoint := range sc.endpoints {
+		var client *docker.Client
+		if cert != "" {
+			client, err = docker.NewTLSClient(endpoint, cert, key, caCert)
+		} else {
+			client, err = docker.NewClient(endpoint)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid swarm endpoint %s: %v", endpoint, err)
+		}
+		client.SetTimeout(swarmTimeout)
+		sc.clients = append(sc.clients, client)
+	}
+
+	return sc, nil
+}
+
+// current returns the index of the active manager
+func (sc *swarmConn) current() int {
+	sc.Lock()
+	defer sc.Unlock()
+
+	return sc.active
+}
+
+// setActive makes a manager the active one
+func (sc *swarmConn) setActive(idx int) {
+	sc.Lock()
+	if idx != sc.active {
+		logrus.Warnf("Swarm manager %s unreachable, failed over to %s", sc.endpoints[sc.active], sc.endpoints[idx])
+		sc.active = idx
+	}
+	sc.Unlock()
+}
+
+// ping makes the first manager answering active, starting from the
+// current one
+func (sc *swarmConn) ping() error {
+	var errs []string
+	active := sc.current()
+	for i := 0; i < len(sc.clients); i++ {
+		idx := (active + i) % len(sc.clients)
+		err := sc.clients[idx].Ping()
+		if err == nil {
+			sc.setActive(idx)
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", sc.endpoints[idx], err))
+	}
+
+	return fmt.Errorf("no swarm manager reachable (%s)", strings.Join(errs, "; "))
+}
+
+// networkInfo inspects a network on the active manager, failing over to the
+// other managers when it can't be reached
+func (sc *swarmConn) networkInfo(nid string) (*docker.Network, error) {
+	var err error
+	active := sc.current()
+	for i := 0; i < len(sc.clients); i++ {
+		idx := (active + i) % len(sc.clients)
+		var nw *docker.Network
+		nw, err = sc.clients[idx].NetworkInfo(nid)
+		if err == nil {
+			sc.setActive(idx)
+			return nw, nil
+		}
+		if _, ok := err.(*docker.NoSuchNetwork); ok {
+			return nil, err
+		}
+		logrus.Debugf("Swarm manager %s failed to inspect network %s: %v", sc.endpoints[idx], nid, err)
+	}
+
+	return nil, err
+}
+
+// SetSwarm replaces the connection used to restore networks from swarm. The
+// managers are authenticated with the certificate and key when they are set.
+// When no manager answers the connection is kept and retried in the
+// background, the driver serves the networks it already knows meanwhile.
+func (d *Driver) SetSwarm(host, caCert, cert, key string) error {
+	sc, err := newSwarmConn(host, caCert, cert, key)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	d.swarm = sc
+	d.opts.SwarmHost = host
+	d.opts.TLSCACert = caCert
+	d.opts.TLSCert = cert
+	d.opts.TLSKey = key
+	d.Unlock()
+	logrus.Infof("Swarm endpoints set to %s", strings.Join(sc.endpoints, ", "))
+	if err := d.pingSwarm(); err != nil {
+		d.degrade(err)
+	}
+
+	return nil
+}
+
+// pingSwarm checks a manager of the current connection answers
+func (d *Driver) pingSwarm() error {
+	d.Lock()
+	sc := d.swarm
+	d.Unlock()
+	if sc == nil {
+		return fmt.Errorf("no swarm endpoint configured")
+	}
+
+	return sc.ping()
+}
+
+// degrade logs the swarm connection problem and retries it until a manager
+// answers or the driver is closed
+func (d *Driver) degrade(cause error) {
+	d.Lock()
+	defer d.Unlock()
+	logrus.Warnf("Swarm unavailable, running degraded: %v", cause)
+	if d.degraded {
+		return
+	}
+	d.degraded = true
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+	}
+	go d.retrySwarm(d.stop)
+}
+
+func (d *Driver) retrySwarm(stop chan struct{}) {
+	ticker := time.NewTicker(swarmRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := d.pingSwarm()
+		if err != nil {
+			d.Lock()
+			opts := d.opts
+			d.Unlock()
+			// the endpoints or certificates may have been fixed meanwhile
+			if sc, cerr := newSwarmConn(opts.SwarmHost, opts.TLSCACert, opts.TLSCert, opts.TLSKey); cerr == nil {
+				d.Lock()
+				d.swarm = sc
+				d.Unlock()
+				err = d.pingSwarm()
+			}
+		}
+		if err != nil {
+			logrus.Debugf("Swarm still unavailable: %v", err)
+			continue
+		}
+		d.Lock()
+		d.degraded = false
+		d.Unlock()
+		logrus.Infof("Swarm connection restored")
+		return
+	}
+}
+
+// Degraded returns whether the driver runs without a reachable swarm manager
+func (d *Driver) Degraded() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.degraded
+}
+
+// swarmNetworkInfo inspects a network through the swarm connection
+func (d *Driver) swarmNetworkInfo(nid string) (*docker.Network, error) {
+	d.Lock()
+	sc := d.swarm
+	d.Unlock()
+	if sc == nil {
+		return nil, fmt.Errorf("no swarm endpoint configured")
+	}
+
+	return sc.networkInfo(nid)
+}
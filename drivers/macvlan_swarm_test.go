@@ -0,0 +1,106 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// swarmManager answers pings and inspects of network 1
+func swarmManager() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_ping":
+			fmt.Fprint(w, "OK")
+		case "/networks/1":
+			fmt.Fprint(w, `{"Id": "1", "Driver": "macvlan_swarm", "Options": {"parent": "eth0"}}`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+}
+
+func TestSwarmEndpoints(t *testing.T) {
+	os.Setenv("SWARM_HOST", "")
+	os.Setenv("DOCKER_HOST", "unix:///var/run/docker.sock")
+	defer os.Unsetenv("DOCKER_HOST")
+	assert.EqualValues(t, []string{"tcp://10.0.0.1:2376", "tcp://10.0.0.2:2376"}, swarmEndpoints("tcp://10.0.0.1:2376, tcp://10.0.0.2:2376"))
+	assert.EqualValues(t, []string{"unix:///var/run/docker.sock"}, swarmEndpoints(""))
+	os.Unsetenv("DOCKER_HOST")
+	assert.EqualValues(t, []string{swarmHost}, swarmEndpoints(""))
+}
+
+func TestSwarmTLS(t *testing.T) {
+	ca, cert, key, err := swarmTLS("ca.pem", "cert.pem", "key.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ca.pem", "cert.pem", "key.pem"}, []string{ca, cert, key})
+
+	os.Setenv("DOCKER_TLS_VERIFY", "1")
+	os.Setenv("DOCKER_CERT_PATH", "/etc/docker/certs")
+	defer os.Unsetenv("DOCKER_TLS_VERIFY")
+	defer os.Unsetenv("DOCKER_CERT_PATH")
+	ca, cert, key, err = swarmTLS("", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/etc/docker/certs/ca.pem", "/etc/docker/certs/cert.pem", "/etc/docker/certs/key.pem"}, []string{ca, cert, key})
+}
+
+func TestSwarmFailover(t *testing.T) {
+	down := httptest.NewServer(swarmManager())
+	down.Close()
+	up := httptest.NewServer(swarmManager())
+	defer up.Close()
+
+	sc, err := newSwarmConn(down.URL+","+up.URL, "", "", "")
+	assert.Nil(t, err)
+	nw, err := sc.networkInfo("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", nw.ID)
+	assert.Equal(t, 1, sc.current())
+
+	_, err = sc.networkInfo("2")
+	assert.IsType(t, &docker.NoSuchNetwork{}, err)
+	assert.Equal(t, 1, sc.current())
+
+	sc.active = 0
+	assert.Nil(t, sc.ping())
+	assert.Equal(t, 1, sc.current())
+}
+
+func TestSwarmUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macvlan-swarm")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	assert.Nil(t, err)
+	go http.Serve(l, swarmManager())
+	defer l.Close()
+
+	_, d, _, _ := initData()
+	assert.Nil(t, d.SetSwarm("unix://"+sock, "", "", ""))
+	assert.False(t, d.Degraded())
+	n := d.getNetworkFromSwarm("1")
+	assert.NotNil(t, n)
+	assert.Equal(t, "eth0", n.config.Parent)
+}
+
+func TestSetSwarmDegraded(t *testing.T) {
+	down := httptest.NewServer(swarmManager())
+	down.Close()
+	_, d, _, _ := initData()
+	assert.Nil(t, d.SetSwarm(down.URL, "", "", ""))
+	assert.True(t, d.Degraded())
+	assert.Nil(t, d.getNetworkFromSwarm("1"))
+
+	d.store = nil
+	assert.Nil(t, d.Close())
+	assert.NotNil(t, d.SetSwarm("tcp://[::1", "", "", ""))
+}
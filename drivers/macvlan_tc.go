@@ -0,0 +1,69 @@
+package drivers
+
+import (
+	"syscall"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	clsactType    = "clsact"
+	clsactIngress = 0xfff2 // TC_H_MIN_INGRESS, filters on received traffic
+	clsactEgress  = 0xfff3 // TC_H_MIN_EGRESS, filters on transmitted traffic
+)
+
+// ensureClsact adds the clsact qdisc that ingress and egress filters of the
+// slave hang off. It is independent of the root qdisc so it can be combined
+// with the egress tbf.
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := ns.NlHandle().QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Type() == clsactType {
+			return nil
+		}
+	}
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: clsactType,
+	}
+
+	return ns.NlHandle().QdiscAdd(clsact)
+}
+
+// addU32Filter adds a match-all u32 filter for protocol below the clsact
+// hook, options lets the caller attach a policer or actions to the filter.
+// The vendored netlink u32 filter only supports mirred and gact actions.
+func addU32Filter(link netlink.Link, hook, prio, protocol uint16, options func(*nl.RtAttr)) error {
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  netlink.MakeHandle(0xffff, hook),
+		Info:    netlink.MakeHandle(prio, nl.Swap16(protocol)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+	opts := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	sel := nl.TcU32Sel{
+		Nkeys: 1,
+		Flags: nl.TC_U32_TERMINAL,
+	}
+	sel.Keys = append(sel.Keys, nl.TcU32Key{})
+	nl.NewRtAttrChild(opts, nl.TCA_U32_SEL, sel.Serialize())
+	options(opts)
+	req.AddData(opts)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,9 +51,10 @@ func initData() (*MacStore, *Driver, *pluginNet.AllocateNetworkRequest, *network
 		},
 	}
 	n := &network{
-		id:     "1",
-		driver: d,
-		config: config,
+		id:        "1",
+		driver:    d,
+		config:    config,
+		allocated: true,
 	}
 
 	return ms, d, r, n
@@ -100,6 +102,33 @@ func TestAllocateNetworkWithMode(t *testing.T) {
 	assert.EqualValues(t, n, d.networks[r.NetworkID])
 }
 
+func TestAllocateNetworkReplay(t *testing.T) {
+	_, d, r, n := initData()
+	res, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	res1, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	assert.Equal(t, res, res1)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+
+	r.Options["macvlan_mode"] = "private"
+	_, err = d.AllocateNetwork(r)
+	assert.EqualError(t, err, "macvlan network 1 already exists with a different configuration")
+	_, ok := err.(types.ForbiddenError)
+	assert.True(t, ok)
+	assert.EqualValues(t, n, d.networks[r.NetworkID])
+}
+
+func TestFreeNetworkReplay(t *testing.T) {
+	_, d, r, _ := initData()
+	_, err := d.AllocateNetwork(r)
+	assert.Nil(t, err)
+	fr := &pluginNet.FreeNetworkRequest{NetworkID: r.NetworkID}
+	assert.Nil(t, d.FreeNetwork(fr))
+	assert.Nil(t, d.FreeNetwork(fr))
+	assert.Empty(t, d.networks)
+}
+
 func TestAllocateNetworkWithInvalidSubnet(t *testing.T) {
 	_, d, r, _ := initData()
 	r.IPv4Data[0].Pool = "0.0.0.0/0"
@@ -121,6 +150,7 @@ func TestAllocateNetworkWithInvalidID(t *testing.T) {
 func TestAllocateNetworkWithSameParent(t *testing.T) {
 	_, d, r, n := initData()
 	d.networks[r.NetworkID] = n
+	r.NetworkID = "2"
 	res, err := d.AllocateNetwork(r)
 	assert.NotNil(t, err)
 	assert.Nil(t, res)
@@ -133,7 +163,7 @@ func TestAllocateNetworkWithInvalidParent(t *testing.T) {
 	res, err := d.AllocateNetwork(r)
 	assert.NotNil(t, err)
 	assert.Nil(t, res)
-	assert.EqualError(t, err, "loopback interface is not a valid macvlan parent link")
+	assert.EqualError(t, err, "invalid -o parent=lo: loopback interface is not a valid macvlan parent link")
 }
 
 func TestFreeNetworkWithOK(t *testing.T) {
@@ -0,0 +1,364 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	tuningInfo    = "macvlan.tuning" // endpoint info of the tuning status
+	tuningPending = "pending"
+	tuningApplied = "applied"
+
+	siocEthtool   = 0x8946 // SIOCETHTOOL
+	siocSIfTxQLen = 0x8943 // SIOCSIFTXQLEN
+	ethtoolSTSO   = 0x1f   // ETHTOOL_STSO
+	ethtoolSGSO   = 0x24   // ETHTOOL_SGSO
+	ethtoolSGRO   = 0x2c   // ETHTOOL_SGRO
+)
+
+var (
+	// tuneTimeout bounds the wait for the daemon to move the interface
+	tuneTimeout = 30 * time.Second
+	tunePoll    = 100 * time.Millisecond
+
+	errNotMoved = errors.New("interface not yet in the sandbox")
+)
+
+// ifaceTuning are the settings of the container side interface docker can't
+// express for remote drivers, empty fields are left to the kernel defaults
+type ifaceTuning struct {
+	TxQueueLen  string `json:",omitempty"`
+	GRO         string `json:",omitempty"`
+	GSO         string `json:",omitempty"`
+	TSO         string `json:",omitempty"`
+	ArpIgnore   string `json:",omitempty"`
+	ArpAnnounce string `json:",omitempty"`
+	AcceptRA    string `json:",omitempty"`
+	DisableIPv6 string `json:",omitempty"`
+}
+
+// tuningOption is a -o network option and macvlan.* endpoint option
+// setting a field of the tuning
+type tuningOption struct {
+	name  string
+	kind  optionKind
+	parse func(v string) error
+	field func(t *ifaceTuning) *string
+}
+
+var tuningOptions = []*tuningOption{
+	{"txqueuelen", optUint, parseUint(1<<32 - 1), func(t *ifaceTuning) *string { return &t.TxQueueLen }},
+	{"gro", optString, parseOnOff, func(t *ifaceTuning) *string { return &t.GRO }},
+	{"gso", optString, parseOnOff, func(t *ifaceTuning) *string { return &t.GSO }},
+	{"tso", optString, parseOnOff, func(t *ifaceTuning) *string { return &t.TSO }},
+	{"arp_ignore", optUint, parseUint(8), func(t *ifaceTuning) *string { return &t.ArpIgnore }},
+	{"arp_announce", optUint, parseUint(2), func(t *ifaceTuning) *string { return &t.ArpAnnounce }},
+	{"accept_ra", optUint, parseUint(2), func(t *ifaceTuning) *string { return &t.AcceptRA }},
+	{"disable_ipv6", optString, parseBool, func(t *ifaceTuning) *string { return &t.DisableIPv6 }},
+}
+
+func init() {
+	for _, o := range tuningOptions {
+		o := o
+		networkOptions = append(networkOptions, &networkOption{
+			name: o.name,
+			kind: o.kind,
+			set: func(c *configuration, v string) error {
+				if c.Tuning == nil {
+					c.Tuning = &ifaceTuning{}
+				}
+				*o.field(c.Tuning) = v
+				return o.parse(v)
+			},
+		})
+	}
+}
+
+func parseUint(max uint64) func(string) error {
+	return func(v string) error {
+		if n, err := strconv.ParseUint(v, 10, 64); err != nil || n > max {
+			return fmt.Errorf("must be between 0 and %d", max)
+		}
+		return nil
+	}
+}
+
+func parseOnOff(v string) error {
+	if v != "on" && v != "off" {
+		return fmt.Errorf("must be on or off")
+	}
+
+	return nil
+}
+
+func parseBool(v string) error {
+	if _, err := strconv.ParseBool(v); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+
+	return nil
+}
+
+// parseTuningOptions parses the macvlan.* tuning endpoint options
+func parseTuningOptions(epOptions map[string]interface{}) (*ifaceTuning, error) {
+	var t *ifaceTuning
+	for _, o := range tuningOptions {
+		key := macvlanType + "." + o.name
+		v, ok := getEndpointOption(epOptions, key)
+		if !ok {
+			continue
+		}
+		if err := o.parse(v); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", key, v, err)
+		}
+		if t == nil {
+			t = &ifaceTuning{}
+		}
+		*o.field(t) = v
+	}
+
+	return t, nil
+}
+
+// merge returns the network tuning overridden by the endpoint one, nil when
+// nothing is to be tuned
+func (t *ifaceTuning) merge(ep *ifaceTuning) *ifaceTuning {
+	if t == nil && ep == nil {
+		return nil
+	}
+	merged := &ifaceTuning{}
+	for _, o := range tuningOptions {
+		if t != nil && *o.field(t) != "" {
+			*o.field(merged) = *o.field(t)
+		}
+		if ep != nil && *o.field(ep) != "" {
+			*o.field(merged) = *o.field(ep)
+		}
+	}
+
+	return merged
+}
+
+// apply sets the interface name of the current namespace
+func (t *ifaceTuning) apply(name string) error {
+	if t.TxQueueLen != "" {
+		qlen, _ := strconv.ParseUint(t.TxQueueLen, 10, 32)
+		if err := setTxQueueLen(name, uint32(qlen)); err != nil {
+			return fmt.Errorf("failed to set the txqueuelen of %s: %v", name, err)
+		}
+	}
+	for _, o := range []struct {
+		name  string
+		value string
+		cmd   uint32
+	}{
+		{"gro", t.GRO, ethtoolSGRO},
+		{"gso", t.GSO, ethtoolSGSO},
+		{"tso", t.TSO, ethtoolSTSO},
+	} {
+		if o.value == "" {
+			continue
+		}
+		if err := setOffload(name, o.cmd, o.value == "on"); err != nil {
+			return fmt.Errorf("failed to turn %s the %s offload of %s: %v", o.value, o.name, name, err)
+		}
+	}
+	disableIPv6 := ""
+	if t.DisableIPv6 != "" {
+		disableIPv6 = "0"
+		if b, _ := strconv.ParseBool(t.DisableIPv6); b {
+			disableIPv6 = "1"
+		}
+	}
+	for _, s := range []struct {
+		path  string
+		value string
+	}{
+		{"ipv4/conf/%s/arp_ignore", t.ArpIgnore},
+		{"ipv4/conf/%s/arp_announce", t.ArpAnnounce},
+		{"ipv6/conf/%s/accept_ra", t.AcceptRA},
+		{"ipv6/conf/%s/disable_ipv6", disableIPv6},
+	} {
+		if s.value == "" {
+			continue
+		}
+		path := filepath.Join("/proc/sys/net", fmt.Sprintf(s.path, name))
+		if err := ioutil.WriteFile(path, []byte(s.value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// ifreqData is a struct ifreq holding a pointer
+type ifreqData struct {
+	Name [syscall.IFNAMSIZ]byte
+	Data uintptr
+	_    [16]byte
+}
+
+// ifreqInt is a struct ifreq holding an int
+type ifreqInt struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Value int32
+	_     [20]byte
+}
+
+// ethtoolValue is a struct ethtool_value
+type ethtoolValue struct {
+	Cmd  uint32
+	Data uint32
+}
+
+// ioctl issues the interface request on a socket of the current namespace
+func ioctl(req uintptr, ifr unsafe.Pointer) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(ifr)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func setTxQueueLen(name string, qlen uint32) error {
+	ifr := &ifreqInt{Value: int32(qlen)}
+	copy(ifr.Name[:syscall.IFNAMSIZ-1], name)
+	return ioctl(siocSIfTxQLen, unsafe.Pointer(ifr))
+}
+
+func setOffload(name string, cmd uint32, on bool) error {
+	value := &ethtoolValue{Cmd: cmd}
+	if on {
+		value.Data = 1
+	}
+	ifr := &ifreqData{Data: uintptr(unsafe.Pointer(value))}
+	copy(ifr.Name[:syscall.IFNAMSIZ-1], name)
+	err := ioctl(siocEthtool, unsafe.Pointer(ifr))
+	runtime.KeepAlive(value)
+	return err
+}
+
+// inSandbox runs fn on a thread switched to the network namespace of the
+// sandbox. A thread which can't be switched back stays locked, the runtime
+// then ends it with the goroutine rather than reusing it in the sandbox.
+func inSandbox(sandboxKey string, fn func() error) error {
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get the current namespace: %v", err)
+	}
+	defer origin.Close()
+	sbox, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open the sandbox %s: %v", sandboxKey, err)
+	}
+	defer sbox.Close()
+	if err := netns.Set(sbox); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter the sandbox %s: %v", sandboxKey, err)
+	}
+	err = fn()
+	if serr := netns.Set(origin); serr != nil {
+		return fmt.Errorf("failed to leave the sandbox %s: %v", sandboxKey, serr)
+	}
+	runtime.UnlockOSThread()
+
+	return err
+}
+
+// tuneSandbox applies the tuning to the interface with the mac once the
+// daemon moved it into the sandbox and renamed it
+func tuneSandbox(sandboxKey, srcName string, mac net.HardwareAddr, t *ifaceTuning) error {
+	return inSandbox(sandboxKey, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if attrs.HardwareAddr.String() != mac.String() {
+				continue
+			}
+			if attrs.Name == srcName {
+				return errNotMoved
+			}
+			return t.apply(attrs.Name)
+		}
+		return errNotMoved
+	})
+}
+
+// tuneEndpoint applies the tuning of the endpoint waiting up to wait for the
+// daemon to move the interface, the outcome is reported by EndpointInfo
+func (d *Driver) tuneEndpoint(eid, sandboxKey, srcName string, mac net.HardwareAddr, t *ifaceTuning, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for {
+		err := tuneSandbox(sandboxKey, srcName, mac, t)
+		if err == errNotMoved && time.Now().Before(deadline) {
+			time.Sleep(tunePoll)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Failed to tune the interface of endpoint %s: %v", stringid.TruncateID(eid), err)
+			d.setTuningStatus(eid, err.Error())
+			return
+		}
+		logrus.Debugf("Tuned the interface of endpoint %s", stringid.TruncateID(eid))
+		d.setTuningStatus(eid, tuningApplied)
+		return
+	}
+}
+
+// retune applies again the tuning of the restored endpoints still in a sandbox
+func (d *Driver) retune() {
+	for _, n := range d.getnetworks() {
+		for _, ep := range n.getEndpoints() {
+			t := n.config.Tuning.merge(ep.tuning)
+			if t == nil || ep.sandbox == nil || len(ep.mac) == 0 {
+				continue
+			}
+			d.tuneEndpoint(ep.id, ep.sandbox.Key, ep.srcName, ep.mac, t, 0)
+		}
+	}
+}
+
+func (d *Driver) setTuningStatus(eid, status string) {
+	d.Lock()
+	defer d.Unlock()
+	if d.tuning == nil {
+		d.tuning = make(map[string]string)
+	}
+	if status == "" {
+		delete(d.tuning, eid)
+		return
+	}
+	d.tuning[eid] = status
+}
+
+func (d *Driver) tuningStatus(eid string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	status, ok := d.tuning[eid]
+	return status, ok
+}
@@ -0,0 +1,177 @@
+package drivers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/XiaoweiQian/macvlan-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestParseTuningOptions(t *testing.T) {
+	config, err := parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]interface{}{"txqueuelen": float64(5000), "gro": "off", "arp_ignore": "1"},
+	}, phaseCreate)
+	assert.Nil(t, err)
+	assert.Equal(t, &ifaceTuning{TxQueueLen: "5000", GRO: "off", ArpIgnore: "1"}, config.Tuning)
+
+	for _, c := range []struct {
+		opts map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{"arp_announce": "3"}, "invalid -o arp_announce=3: must be between 0 and 2"},
+		{map[string]interface{}{"gro": "no"}, "invalid -o gro=no: must be on or off"},
+		{map[string]interface{}{"disable_ipv6": "maybe"}, "invalid -o disable_ipv6=maybe: must be true or false"},
+	} {
+		_, err := parseNetworkOptions("1", map[string]interface{}{netlabel.GenericData: c.opts}, phaseCreate)
+		assert.EqualError(t, err, c.err)
+	}
+
+	tuning, err := parseTuningOptions(map[string]interface{}{"macvlan.tso": "off", "macvlan.accept_ra": "0"})
+	assert.Nil(t, err)
+	assert.Equal(t, &ifaceTuning{TSO: "off", AcceptRA: "0"}, tuning)
+	tuning, err = parseTuningOptions(map[string]interface{}{"parent": "eth0"})
+	assert.Nil(t, err)
+	assert.Nil(t, tuning)
+	_, err = parseTuningOptions(map[string]interface{}{"macvlan.txqueuelen": "-1"})
+	assert.EqualError(t, err, `invalid macvlan.txqueuelen "-1": must be between 0 and 4294967295`)
+}
+
+func TestMergeTuning(t *testing.T) {
+	var none *ifaceTuning
+	assert.Nil(t, none.merge(nil))
+	assert.Equal(t, &ifaceTuning{GRO: "on"}, none.merge(&ifaceTuning{GRO: "on"}))
+	network := &ifaceTuning{GRO: "off", ArpIgnore: "1"}
+	assert.Equal(t, &ifaceTuning{GRO: "on", ArpIgnore: "1", TSO: "off"}, network.merge(&ifaceTuning{GRO: "on", TSO: "off"}))
+}
+
+func TestCreateEndpointWithInvalidTuning(t *testing.T) {
+	_, d, r, _ := initEndpointData()
+	r.Options["macvlan.gso"] = "yes"
+	_, err := d.CreateEndpoint(r)
+	assert.EqualError(t, err, `create endpoint was passed invalid tuning options: invalid macvlan.gso "yes": must be on or off`)
+}
+
+// newTestSandbox returns the path of a new network namespace kept alive by
+// a locked thread until the returned function is called
+func newTestSandbox(t *testing.T) (string, func()) {
+	path := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			close(path)
+			return
+		}
+		defer origin.Close()
+		sbox, err := netns.New()
+		if err != nil {
+			close(path)
+			return
+		}
+		defer sbox.Close()
+		path <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		<-done
+		netns.Set(origin)
+	}()
+	p, ok := <-path
+	if !ok {
+		t.Skip("network namespaces are not supported")
+	}
+
+	return p, func() { close(done) }
+}
+
+func TestTuneSandbox(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	assert.Nil(t, netutils.CreateVethPair("mvtune0", "mvtune1"))
+	defer netutils.DeleteVethPair("mvtune0", "mvtune1")
+	link, err := ns.NlHandle().LinkByName("mvtune1")
+	assert.Nil(t, err)
+	mac := link.Attrs().HardwareAddr
+	sbox, err := netns.GetFromPath(sandboxKey)
+	assert.Nil(t, err)
+	defer sbox.Close()
+	assert.Nil(t, ns.NlHandle().LinkSetNsFd(link, int(sbox)))
+
+	tuning := &ifaceTuning{TxQueueLen: "5000", GSO: "off", ArpIgnore: "1", DisableIPv6: "true"}
+	// the daemon didn't rename the interface yet
+	assert.Equal(t, errNotMoved, tuneSandbox(sandboxKey, "mvtune1", mac, tuning))
+
+	h, err := netlink.NewHandleAt(sbox)
+	assert.Nil(t, err)
+	defer h.Delete()
+	link, err = h.LinkByName("mvtune1")
+	assert.Nil(t, err)
+	assert.Nil(t, h.LinkSetName(link, "eth1"))
+
+	_, d := initStressData(0)
+	d.tuneEndpoint("1234567", sandboxKey, "mvtune1", mac, tuning, 0)
+	status, ok := d.tuningStatus("1234567")
+	assert.True(t, ok)
+	assert.Equal(t, tuningApplied, status)
+	link, err = h.LinkByName("eth1")
+	assert.Nil(t, err)
+	assert.Equal(t, 5000, link.Attrs().TxQLen)
+	assert.Nil(t, inSandbox(sandboxKey, func() error {
+		for path, value := range map[string]string{
+			"/proc/sys/net/ipv4/conf/eth1/arp_ignore":   "1",
+			"/proc/sys/net/ipv6/conf/eth1/disable_ipv6": "1",
+		} {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, value, strings.TrimSpace(string(b)), path)
+		}
+		return nil
+	}))
+
+	info, err := d.EndpointInfo(&pluginNet.InfoRequest{NetworkID: "1", EndpointID: "1234567"})
+	assert.Nil(t, err)
+	assert.Equal(t, tuningApplied, info.Value[tuningInfo])
+
+	// a sandbox gone away is reported
+	d.tuneEndpoint("1234567", "/proc/0/ns/net", "mvtune1", mac, tuning, 0)
+	status, _ = d.tuningStatus("1234567")
+	assert.Contains(t, status, "failed to open the sandbox /proc/0/ns/net")
+}
+
+func TestInSandboxRestoresNamespace(t *testing.T) {
+	sandboxKey, release := newTestSandbox(t)
+	defer release()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	assert.Nil(t, err)
+	defer origin.Close()
+
+	fnErr := fmt.Errorf("fn failed")
+	err = inSandbox(sandboxKey, func() error {
+		current, err := netns.Get()
+		assert.Nil(t, err)
+		defer current.Close()
+		assert.False(t, current.Equal(origin))
+		return fnErr
+	})
+	assert.Equal(t, fnErr, err)
+	current, err := netns.Get()
+	assert.Nil(t, err)
+	defer current.Close()
+	assert.True(t, current.Equal(origin))
+
+	assert.Contains(t, inSandbox("/nonexistent", func() error { return nil }).Error(), "failed to open the sandbox /nonexistent")
+}
@@ -0,0 +1,178 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/ns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	vrfOpt       = "vrf"       // -o vrf=name, the vrf of the host side links
+	vrfTableOpt  = "vrf_table" // -o vrf_table=id, the routing table of a vrf the driver creates
+	vrfType      = "vrf"
+	iflaVrfTable = 1 // IFLA_VRF_TABLE, missing from the vendored netlink
+)
+
+// parseVrfName verifies the -o vrf option is a valid link name
+func parseVrfName(name string) error {
+	if name == "" || len(name) > 15 || strings.ContainsAny(name, "/: \t") {
+		return fmt.Errorf("vrf name must be a valid link name of at most 15 characters")
+	}
+
+	return nil
+}
+
+// parseVrfTable parses the -o vrf_table option, the main, local and default
+// tables are rejected
+func parseVrfTable(table string) (uint32, error) {
+	if table == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(table, 0, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("vrf table must be between 1 and 4294967295")
+	}
+	if id >= syscall.RT_TABLE_DEFAULT && id <= syscall.RT_TABLE_LOCAL {
+		return 0, fmt.Errorf("vrf table %d is reserved", id)
+	}
+
+	return uint32(id), nil
+}
+
+// validateVrfOptions verifies -o vrf_table comes with -o vrf
+func (config *configuration) validateVrfOptions() error {
+	if config.VrfTable != "" && config.Vrf == "" {
+		return fmt.Errorf("-o %s requires -o %s", vrfTableOpt, vrfOpt)
+	}
+
+	return nil
+}
+
+// vrfSlaves returns the host side links of the network the driver created,
+// they are the ones enslaved to the vrf
+func (config *configuration) vrfSlaves() []string {
+	if config.LinkType == linkBridge {
+		// the parent is a port of the bridge, the bridge routes
+		if config.CreatedBridge {
+			return []string{config.Bridge}
+		}
+		return nil
+	}
+	if config.CreatedSlaveLink {
+		return []string{config.Parent}
+	}
+
+	return nil
+}
+
+// setupVrf enslaves the host side links of the network to its vrf. A
+// missing vrf is created with -o vrf_table and owned by the driver, as is
+// a vrf another network of the driver owns.
+func (d *Driver) setupVrf(config *configuration) error {
+	vrf, err := ns.NlHandle().LinkByName(config.Vrf)
+	if err != nil {
+		table, err := parseVrfTable(config.VrfTable)
+		if err != nil {
+			return err
+		}
+		if table == 0 {
+			return fmt.Errorf("vrf %s not found, -o %s is required to create it", config.Vrf, vrfTableOpt)
+		}
+		if err := createVrfLink(config.Vrf, table); err != nil {
+			return fmt.Errorf("failed to create the vrf %s: %v", config.Vrf, err)
+		}
+		logrus.Debugf("Added the vrf %s with the table %d", config.Vrf, table)
+		config.CreatedVrf = true
+		if vrf, err = ns.NlHandle().LinkByName(config.Vrf); err != nil {
+			return fmt.Errorf("failed to find the vrf %s: %v", config.Vrf, err)
+		}
+	} else if vrf.Type() != vrfType {
+		return fmt.Errorf("link %s is not a vrf", config.Vrf)
+	} else if !config.CreatedVrf && d.vrfUsers(config) > 0 {
+		config.CreatedVrf = true
+	}
+	if err := ns.NlHandle().LinkSetUp(vrf); err != nil {
+		return fmt.Errorf("failed to enable the vrf %s: %v", config.Vrf, err)
+	}
+	for _, name := range config.vrfSlaves() {
+		link, err := ns.NlHandle().LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find the link %s: %v", name, err)
+		}
+		if link.Attrs().MasterIndex == vrf.Attrs().Index {
+			continue
+		}
+		if err := ns.NlHandle().LinkSetMasterByIndex(link, vrf.Attrs().Index); err != nil {
+			return fmt.Errorf("failed to enslave the link %s to the vrf %s: %v", name, config.Vrf, err)
+		}
+	}
+
+	return nil
+}
+
+// setVrfMaster enslaves the link to the vrf
+func setVrfMaster(link netlink.Link, name string) error {
+	vrf, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find the vrf %s: %v", name, err)
+	}
+	if err := ns.NlHandle().LinkSetMasterByIndex(link, vrf.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to enslave the link %s to the vrf %s: %v", link.Attrs().Name, name, err)
+	}
+
+	return nil
+}
+
+// vrfUsers counts the other networks of the driver owning the vrf of config
+func (d *Driver) vrfUsers(config *configuration) int {
+	users := 0
+	for _, n := range d.getnetworks() {
+		if n.id != config.ID && n.config.Vrf == config.Vrf && n.config.CreatedVrf {
+			users++
+		}
+	}
+
+	return users
+}
+
+// delVrf deletes the vrf of the network when the driver owns it and no
+// other network uses it anymore
+func (d *Driver) delVrf(config *configuration) error {
+	if config.Vrf == "" || !config.CreatedVrf || d.vrfUsers(config) > 0 {
+		return nil
+	}
+	vrf, err := ns.NlHandle().LinkByName(config.Vrf)
+	if err != nil {
+		return nil
+	}
+	if vrf.Type() != vrfType {
+		return fmt.Errorf("link %s is not a vrf", config.Vrf)
+	}
+	if err := ns.NlHandle().LinkDel(vrf); err != nil {
+		return fmt.Errorf("failed to delete the vrf %s: %v", config.Vrf, err)
+	}
+	logrus.Debugf("Deleted the vrf %s", config.Vrf)
+
+	return nil
+}
+
+// createVrfLink adds a vrf link bound to the routing table
+func createVrfLink(name string, table uint32) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(vrfType))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaVrfTable, nl.Uint32Attr(table))
+	req.AddData(linkInfo)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+
+	return err
+}
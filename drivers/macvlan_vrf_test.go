@@ -0,0 +1,115 @@
+package drivers
+
+import (
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseVrfOptions(t *testing.T) {
+	config, err := parseNetworkOptions("1", map[string]interface{}{
+		netlabel.GenericData: map[string]interface{}{parentOpt: "eth0.10", vrfOpt: "tenant1", vrfTableOpt: float64(1001)},
+	}, phaseCreate)
+	assert.Nil(t, err)
+	assert.Equal(t, "tenant1", config.Vrf)
+	assert.Equal(t, "1001", config.VrfTable)
+
+	for _, c := range []struct {
+		opts map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{vrfOpt: "tenant/1"}, "invalid -o vrf=tenant/1: vrf name must be a valid link name of at most 15 characters"},
+		{map[string]interface{}{vrfTableOpt: "254"}, "invalid -o vrf_table=254: vrf table 254 is reserved"},
+		{map[string]interface{}{vrfTableOpt: "0"}, "invalid -o vrf_table=0: vrf table must be between 1 and 4294967295"},
+		{map[string]interface{}{vrfTableOpt: "4294967296"}, "invalid -o vrf_table=4294967296: vrf table must be between 1 and 4294967295"},
+	} {
+		_, err := parseNetworkOptions("1", map[string]interface{}{netlabel.GenericData: c.opts}, phaseCreate)
+		assert.EqualError(t, err, c.err)
+	}
+
+	d := NewDriver(Options{})
+	ipv4 := []*pluginNet.IPAMData{{Pool: "192.168.1.0/24", Gateway: "192.168.1.1"}}
+	_, err = d.networkConfig("1", map[string]interface{}{
+		netlabel.GenericData: map[string]string{parentOpt: "eth0", vrfTableOpt: "1001"},
+	}, ipv4, nil, phaseCreate)
+	assert.EqualError(t, err, "-o vrf_table requires -o vrf")
+}
+
+func TestVrfSlaves(t *testing.T) {
+	for _, c := range []struct {
+		config *configuration
+		slaves []string
+	}{
+		{&configuration{Parent: "eth0"}, nil},
+		{&configuration{Parent: "eth0.10", CreatedSlaveLink: true}, []string{"eth0.10"}},
+		{&configuration{Parent: "eth0.10", CreatedSlaveLink: true, LinkType: linkBridge, Bridge: "mb-1", CreatedBridge: true}, []string{"mb-1"}},
+		{&configuration{Parent: "eth0.10", CreatedSlaveLink: true, LinkType: linkBridge, Bridge: "br0"}, nil},
+	} {
+		assert.Equal(t, c.slaves, c.config.vrfSlaves())
+	}
+}
+
+func TestSetupVrfWithoutTable(t *testing.T) {
+	d := NewDriver(Options{})
+	err := d.setupVrf(&configuration{ID: "1", Parent: "eth0", Vrf: "mvrfnone"})
+	assert.EqualError(t, err, "vrf mvrfnone not found, -o vrf_table is required to create it")
+	err = d.setupVrf(&configuration{ID: "1", Parent: "eth0", Vrf: "eth0"})
+	assert.EqualError(t, err, "link eth0 is not a vrf")
+}
+
+func TestSetupVrf(t *testing.T) {
+	if err := createVrfLink("mvrfprobe", 1000); err != nil {
+		t.Skipf("vrf links are not supported: %v", err)
+	}
+	if link, err := ns.NlHandle().LinkByName("mvrfprobe"); err == nil {
+		ns.NlHandle().LinkDel(link)
+	}
+	defer initBridgeParent(t)()
+	_, d := initStressData(0)
+
+	config := &configuration{ID: "1", Parent: "mbparent0", LinkType: linkBridge, Vrf: "mvrftest", VrfTable: "1000"}
+	assert.Nil(t, config.setupBridge())
+	defer delBridge(config)
+	assert.Nil(t, d.setupVrf(config))
+	assert.True(t, config.CreatedVrf)
+	assert.Equal(t, "mvrftest", masterOf(t, config.Bridge))
+	d.addNetwork(&network{id: "1", driver: d, endpoints: endpointTable{}, config: config})
+
+	// a second network shares the vrf, the last one deletes it
+	other := &configuration{ID: "2", Parent: "mbparent1", Vrf: "mvrftest"}
+	assert.Nil(t, d.setupVrf(other))
+	assert.True(t, other.CreatedVrf)
+	assert.Nil(t, d.delVrf(other))
+	_, err := ns.NlHandle().LinkByName("mvrftest")
+	assert.Nil(t, err)
+	d.deleteNetwork("1")
+	assert.Nil(t, d.delVrf(config))
+	_, err = ns.NlHandle().LinkByName("mvrftest")
+	assert.NotNil(t, err)
+}
+
+func TestCreateNetworkVrfFailureDeletesBridge(t *testing.T) {
+	defer initBridgeParent(t)()
+	for _, c := range []struct {
+		vrf string
+		err string
+	}{
+		{"mvrfnone", "CreateNetwork is failed vrf mvrfnone not found, -o vrf_table is required to create it"},
+		{"mbparent1", "CreateNetwork is failed link mbparent1 is not a vrf"},
+	} {
+		ms, d, r, _ := initNetworkData()
+		ms.On("StoreUpdate", mock.Anything).Return(nil)
+		r.Options[netlabel.GenericData] = map[string]string{parentOpt: "mbparent0", linkTypeOpt: linkBridge, vrfOpt: c.vrf}
+		r.IPv6Data = nil
+		assert.EqualError(t, d.CreateNetwork(r), c.err)
+		assert.Empty(t, d.networks)
+		// the retry creates the bridge again rather than adopting it
+		_, err := ns.NlHandle().LinkByName("mb-1")
+		assert.NotNil(t, err)
+		assert.Equal(t, "", masterOf(t, "mbparent0"))
+	}
+}
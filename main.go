@@ -6,7 +6,6 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/XiaoweiQian/macvlan-driver/drivers"
 	"github.com/codegangsta/cli"
-	pluginNet "github.com/docker/go-plugins-helpers/network"
 )
 
 const (
@@ -24,25 +23,49 @@ func main() {
 	app.Name = "docker-macvlan"
 	app.Usage = "Docker Macvlan Networking"
 	app.Version = version
-	app.Flags = []cli.Flag{
-		flagDebug,
-	}
+	app.Flags = append([]cli.Flag{flagDebug}, configFlags...)
+	app.Commands = commands
 	app.Action = Run
 	app.Run(os.Args)
 }
 
 // Run initializes the driver
 func Run(ctx *cli.Context) {
-	if ctx.Bool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
-	} else {
-		logrus.SetLevel(logrus.InfoLevel)
+	dm := &daemon{
+		configPath: ctx.String("config"),
+		flags:      flagsConfig(ctx),
+		debug:      ctx.Bool("debug"),
+	}
+	cfg, err := resolveConfig(dm.configPath, dm.flags)
+	if err != nil {
+		logrus.Fatal(err)
 	}
+	if err := setupLogging(cfg, dm.debug); err != nil {
+		logrus.Fatal(err)
+	}
+	dm.config = cfg
 
-	d, err := drivers.Init(nil)
+	// report host problems early, the driver still starts to serve what it can
+	parents, err := drivers.StoredParents(cfg.driverOptions())
 	if err != nil {
-		panic(err)
+		logrus.Debugf("Preflight: the parents of the stored networks are not checked: %v", err)
+	}
+	for _, r := range drivers.Preflight(cfg.driverOptions(), parents, false) {
+		switch r.Status {
+		case drivers.CheckFail:
+			logrus.Errorf("Preflight %s: %s, %s", r.Name, r.Detail, r.Hint)
+		case drivers.CheckWarn:
+			logrus.Warnf("Preflight %s: %s, %s", r.Name, r.Detail, r.Hint)
+		}
+	}
+
+	dm.driver, err = drivers.Init(drivers.NewDriver(cfg.driverOptions()))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	dm.drainer = drivers.NewDrainer(dm.driver)
+	h := drivers.NewHandler(dm.drainer)
+	if err := dm.serve(h, cfg.Group, cfg.Socket); err != nil {
+		logrus.Fatal(err)
 	}
-	h := pluginNet.NewHandler(d)
-	h.ServeUnix("root", networkType)
 }
@@ -2,6 +2,7 @@ package netutils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"io"
 	"net"
@@ -42,6 +43,30 @@ func GenerateMACFromIP(ip net.IP) net.HardwareAddr {
 	return genMAC(ip)
 }
 
+// GenerateMACFromSeed returns a locally administered unicast MAC address
+// derived from a hash of the seed, a nil seed returns a random address.
+func GenerateMACFromSeed(seed []byte) net.HardwareAddr {
+	hw := GenerateMACWithPrefix(nil, seed)
+	// clear the multicast bit and set the locally administered bit
+	hw[0] = hw[0]&^0x01 | 0x02
+	return hw
+}
+
+// GenerateMACWithPrefix returns a MAC address starting with prefix, ex. a
+// vendor OUI, where the remaining bytes are derived from a hash of the seed.
+// A nil seed fills the remaining bytes randomly.
+func GenerateMACWithPrefix(prefix net.HardwareAddr, seed []byte) net.HardwareAddr {
+	hw := make(net.HardwareAddr, 6)
+	n := copy(hw, prefix)
+	if seed == nil {
+		rand.Read(hw[n:])
+	} else {
+		sum := sha256.Sum256(seed)
+		copy(hw[n:], sum[:])
+	}
+	return hw
+}
+
 // GenerateRandomName returns a new name joined with a prefix.  This size
 // specified is used to truncate the randomly generated value
 func GenerateRandomName(prefix string, size int) (string, error) {
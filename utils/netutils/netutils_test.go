@@ -43,3 +43,27 @@ func TestCreateVethPair(t *testing.T) {
 	err = DeleteVethPair(name1, name2)
 	assert.Nil(t, err)
 }
+
+func TestGenerateMACFromSeed(t *testing.T) {
+	mac1 := GenerateMACFromSeed([]byte("net1/ep1"))
+	mac2 := GenerateMACFromSeed([]byte("net1/ep1"))
+	mac3 := GenerateMACFromSeed([]byte("net1/ep2"))
+	assert.Equal(t, mac1.String(), mac2.String())
+	assert.NotEqual(t, mac1.String(), mac3.String())
+	assert.EqualValues(t, 0x02, mac1[0]&0x03)
+
+	mac4 := GenerateMACFromSeed(nil)
+	mac5 := GenerateMACFromSeed(nil)
+	assert.NotEqual(t, mac4.String(), mac5.String())
+	assert.EqualValues(t, 0x02, mac4[0]&0x03)
+}
+
+func TestGenerateMACWithPrefix(t *testing.T) {
+	prefix, _ := net.ParseMAC("00:16:3e:00:00:00")
+	mac1 := GenerateMACWithPrefix(prefix[:3], []byte("net1/ep1"))
+	mac2 := GenerateMACWithPrefix(prefix[:3], []byte("net1/ep1"))
+	assert.Equal(t, mac1.String(), mac2.String())
+	assert.Equal(t, "00:16:3e", mac1.String()[:8])
+	mac3 := GenerateMACWithPrefix(prefix[:3], nil)
+	assert.Equal(t, "00:16:3e", mac3.String()[:8])
+}